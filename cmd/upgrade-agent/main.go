@@ -1,30 +1,56 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"upgrade-agent/internal/agent"
 	"upgrade-agent/internal/config"
+	"upgrade-agent/internal/logging"
+	"upgrade-agent/internal/metrics"
+	"upgrade-agent/internal/statusapi"
+
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	defaultConfigPath = "/etc/upgrade-agent/config.yaml"
+	// defaultShutdownTimeout stays below the 30 second grace period
+	// Kubernetes gives a pod before killing it
+	defaultShutdownTimeout = 20 * time.Second
 )
 
 func main() {
-	log.Println("Upgrade agent daemon starting...")
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(validateConfig(os.Args[2:]))
+	}
 
-	// Determine config path (default or from env var)
-	configPath := getEnvOrDefault("CONFIG_PATH", defaultConfigPath)
-	log.Printf("Using config file: %s", configPath)
+	// Determine config path and the overrides layered on top of the file
+	shutdownTimeout := flag.Duration("shutdown-timeout", defaultShutdownTimeout,
+		"How long a shutdown waits for a running upgrade to reach a point where it can stop")
+	statusAddr := flag.String("status-addr", statusapi.DefaultAddr, "Address of the local status API, empty to disable it")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve /metrics on besides the status API, e.g. :9102 for a remote Prometheus")
+	logFormat := flag.String("log-format", os.Getenv("LOG_FORMAT"), "Log format, text or json (env LOG_FORMAT)")
+	configPath, overrides := parseArgs(flag.CommandLine, os.Args[1:])
+
+	// Log at LOG_LEVEL until the config, which may set the level, is loaded
+	if err := logging.Setup(os.Stderr, os.Getenv("LOG_LEVEL"), *logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging settings: %v\n", err)
+		os.Exit(2)
+	}
+	slog.Info("Upgrade agent daemon starting...")
+	slog.Info("Using config file", "path", configPath)
 
 	// Ensure parent directory exists
 	if err := ensureConfigDir(configPath); err != nil {
-		log.Fatalf("Failed to create config directory: %v", err)
+		logging.Fatal("Failed to create config directory", logging.Err(err))
 	}
 
 	// Create the agent
@@ -32,28 +58,124 @@ func main() {
 	defer svc.Close()
 
 	// Setup config manager with callback
-	cfgManager, err := config.NewManager(configPath, func(cfg config.Config) {
+	cfgManager, err := config.NewManager(configPath, overrides, func(cfg config.Config, changes []config.Change) {
+		applyLogLevel(cfg)
 		svc.UpdateConfig(cfg)
 	})
 	if err != nil {
-		log.Fatalf("Failed to initialize config manager: %v", err)
+		logging.Fatal("Failed to initialize config manager", logging.Err(err))
 	}
+	applyLogLevel(cfgManager.GetConfig())
 
 	// Initialize the service with the initial config
 	if err := svc.Initialize(cfgManager.GetConfig()); err != nil {
-		log.Fatalf("Failed to initialize service: %v", err)
+		logging.Fatal("Failed to initialize service", logging.Err(err))
+	}
+
+	// Serve the status API
+	var statusServer *statusapi.Server
+	if *statusAddr != "" {
+		statusServer = statusapi.NewServer(*statusAddr, svc)
+		if err := statusServer.Start(); err != nil {
+			logging.Fatal("Failed to start status API", logging.Err(err))
+		}
+	}
+
+	if *metricsAddr != "" {
+		if _, err := metrics.Serve(*metricsAddr); err != nil {
+			logging.Fatal("Failed to serve metrics", logging.Err(err))
+		}
 	}
 
 	// Start watching for config changes
 	if err := cfgManager.StartWatcher(); err != nil {
-		log.Fatalf("Failed to start config watcher: %v", err)
+		logging.Fatal("Failed to start config watcher", logging.Err(err))
 	}
+	defer cfgManager.Close()
 
 	// Wait for termination signal
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-sigCh
-	log.Printf("Received signal %v, shutting down...", sig)
+	slog.Info("Received signal, shutting down...", "signal", sig)
+
+	go func() {
+		sig := <-sigCh
+		logging.Fatal("Received signal again, exiting immediately", "signal", sig)
+	}()
+
+	// Stop reloads first so no new upgrade starts, then let the running one
+	// reach a safe point
+	cfgManager.Close()
+	svc.Shutdown(*shutdownTimeout)
+
+	if statusServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		statusServer.Shutdown(ctx)
+	}
+}
+
+// applyLogLevel sets the log level from the config, falling back to
+// LOG_LEVEL when the config does not set one
+func applyLogLevel(cfg config.Config) {
+	name := cfg.LogLevel
+	if name == "" {
+		name = os.Getenv("LOG_LEVEL")
+	}
+	previous := logging.Level()
+	if err := logging.SetLevel(name); err != nil {
+		slog.Warn("Keeping the current log level", logging.Err(err))
+		return
+	}
+	if current := logging.Level(); current != previous {
+		slog.Log(context.Background(), max(current, previous), "Log level changed", "from", previous, "to", current)
+	}
+}
+
+// parseArgs parses the flags shared by the daemon and validate-config. It
+// returns the config path and the overrides of config fields, environment
+// variables first so that flags take precedence over them.
+func parseArgs(fs *flag.FlagSet, args []string) (string, config.Overrides) {
+	configPath := fs.String("config", getEnvOrDefault("CONFIG_PATH", defaultConfigPath), "Config file to load (env CONFIG_PATH)")
+	flagOverrides := config.RegisterFlags(fs)
+	fs.Parse(args)
+	return *configPath, append(config.EnvOverrides(), flagOverrides()...)
+}
+
+// validateConfig implements `upgrade-agent validate-config [flags] [path]`.
+// It checks the config at path, or the one the daemon would load, with the
+// same overrides and prints it with defaults filled in. The exit code is 1 if
+// the config is invalid.
+func validateConfig(args []string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	configPath, overrides := parseArgs(fs, args)
+	if fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: upgrade-agent validate-config [flags] [path]")
+		return 2
+	}
+	if fs.NArg() == 1 {
+		configPath = fs.Arg(0)
+	}
+
+	cfg, err := config.Load(configPath, overrides)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		return 1
+	}
+
+	fmt.Printf("%s: config OK\n", configPath)
+	for _, override := range overrides {
+		fmt.Printf("# %s from %s\n", override.Field, override.Source)
+	}
+	fmt.Println("---")
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: failed to print config: %v\n", configPath, err)
+		return 1
+	}
+	return 0
 }
 
 // getEnvOrDefault returns the value of an environment variable or a default value
@@ -2,48 +2,92 @@ package main
 
 import (
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 	"strings"
 
 	"upgrade-agent/internal/grpcserver"
+	"upgrade-agent/internal/logging"
+	"upgrade-agent/internal/metrics"
+	"upgrade-agent/internal/osservice"
+	"upgrade-agent/internal/sonicservice"
+	"upgrade-agent/internal/systemservice"
 )
 
-func init() {
-	// Set up logging
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-
-	// Check if verbose logging is enabled via environment
-	logLevel := strings.ToLower(os.Getenv("LOG_LEVEL"))
-	if logLevel == "debug" || logLevel == "verbose" {
-		log.Println("Debug logging enabled")
-	}
-}
-
 func main() {
 	// Parse command line flags
 	port := flag.String("port", "8080", "The server port")
 	fakeReboot := flag.Bool("fake-reboot", false, "If enabled, the server will fake reboots instead of actually rebooting")
+	rebootStateFile := flag.String("reboot-state-file", systemservice.DefaultRebootStateFile, "File recording the reboot counter and the last reboot across restarts")
+	executorName := flag.String("executor", "nsenter",
+		"How host commands (installer, sonic-installer, reboot) are run: nsenter, systemd, local or fake")
+	installer := flag.String("installer", strings.Join(sonicservice.DefaultInstallerCommand, " "),
+		"Command used to install firmware images; the image path is appended as the last argument")
+	downloadDir := flag.String("download-dir", sonicservice.DefaultDownloadDir, "Directory where firmware fetched from a URL is staged")
+	imageDir := flag.String("image-dir", osservice.DefaultImageDir, "Directory where OS.Install stages transferred images")
+	bootloaderName := flag.String("bootloader", "sonic-installer", "Bootloader backend used by OS.Activate and the image inventory: sonic-installer or file")
+	bootloaderFile := flag.String("bootloader-file", "", "State file of the file bootloader, for testing without a switch")
+	trustedKeys := flag.String("trusted-keys", "", "PEM file or directory of public keys that firmware signatures are verified against")
+	requireSignature := flag.Bool("require-signature", false, "Reject firmware images without a valid signature")
+	tlsCert := flag.String("tls-cert", "", "Server certificate file; enables TLS together with --tls-key")
+	tlsKey := flag.String("tls-key", "", "Server private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA bundle client certificates must be signed by; enables mutual TLS")
+	authzPolicy := flag.String("authz-policy", "", "Authorization policy file mapping callers to the RPCs they may call")
+	metricsAddr := flag.String("metrics-addr", "127.0.0.1:9101", "Address to serve Prometheus metrics on under /metrics, e.g. :9101 for a remote Prometheus, empty to disable them")
+	logLevel := flag.String("log-level", os.Getenv("LOG_LEVEL"), "Minimum level logged: debug, info, warn or error (env LOG_LEVEL)")
+	logFormat := flag.String("log-format", os.Getenv("LOG_FORMAT"), "Log format, text or json (env LOG_FORMAT)")
 	flag.Parse()
 
-	log.Printf("Starting upgrade server on port %s", *port)
+	if err := logging.Setup(os.Stderr, *logLevel, *logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging settings: %v\n", err)
+		os.Exit(2)
+	}
+	slog.Debug("Debug logging enabled")
+
+	slog.Info("Starting upgrade server", "port", *port)
 	if *fakeReboot {
-		log.Printf("Fake reboot mode enabled - the server will not actually reboot the system")
+		slog.Info("Fake reboot mode enabled - the server will not actually reboot the system")
 	}
+	slog.Info("Firmware installer command", "command", *installer)
 
 	// Show some diagnostic information
 	procMounted := fileExists("/proc/cmdline")
-	log.Printf("Diagnostic: /proc/cmdline accessible: %v", procMounted)
+	slog.Debug("Diagnostic: /proc/cmdline accessible", "accessible", procMounted)
 
 	if !procMounted {
-		log.Printf("Warning: /proc/cmdline is not accessible. OS.Verify service may not work correctly.")
-		log.Printf("To fix, run the container with: docker run -v /proc:/proc:ro ...")
+		slog.Warn("/proc/cmdline is not accessible, OS.Verify may not work correctly. " +
+			"To fix, run the container with: docker run -v /proc:/proc:ro ...")
 	}
 
 	// Create and run the server
-	srv, err := grpcserver.NewServer(*port, *fakeReboot)
+	srv, err := grpcserver.NewServer(grpcserver.Options{
+		Port:             *port,
+		FakeReboot:       *fakeReboot,
+		Executor:         *executorName,
+		RebootStateFile:  *rebootStateFile,
+		InstallerCommand: strings.Fields(*installer),
+		DownloadDir:      *downloadDir,
+		ImageDir:         *imageDir,
+		Bootloader:       *bootloaderName,
+		BootloaderFile:   *bootloaderFile,
+		TrustedKeys:      *trustedKeys,
+		RequireSignature: *requireSignature,
+		TLSCertFile:      *tlsCert,
+		TLSKeyFile:       *tlsKey,
+		TLSClientCAFile:  *tlsClientCA,
+		AuthzPolicy:      *authzPolicy,
+	})
 	if err != nil {
-		log.Fatalf("Failed to create server: %v", err)
+		logging.Fatal("Failed to create server", logging.Err(err))
+	}
+
+	if *metricsAddr != "" {
+		metricsServer, err := metrics.Serve(*metricsAddr)
+		if err != nil {
+			logging.Fatal("Failed to serve metrics", logging.Err(err))
+		}
+		defer metricsServer.Close()
 	}
 
 	// Run the server until it receives a termination signal
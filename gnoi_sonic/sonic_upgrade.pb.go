@@ -149,8 +149,11 @@ type FirmwareUpdateParams struct {
 	FirmwareSource string `protobuf:"bytes,1,opt,name=firmware_source,json=firmwareSource,proto3" json:"firmware_source,omitempty"`
 	// If true, pass UPDATE_MLNX_CPLD_FW="1" to the script (cold-boot vs. warm-reboot).
 	UpdateMlnxCpldFw bool `protobuf:"varint,2,opt,name=update_mlnx_cpld_fw,json=updateMlnxCpldFw,proto3" json:"update_mlnx_cpld_fw,omitempty"`
-	unknownFields    protoimpl.UnknownFields
-	sizeCache        protoimpl.SizeCache
+	// Optional hex SHA-256 of the firmware .bin. When set, the image is checked
+	// against it before installing, whether it was downloaded or local.
+	ExpectedSha256 string `protobuf:"bytes,3,opt,name=expected_sha256,json=expectedSha256,proto3" json:"expected_sha256,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
 }
 
 func (x *FirmwareUpdateParams) Reset() {
@@ -197,6 +200,13 @@ func (x *FirmwareUpdateParams) GetUpdateMlnxCpldFw() bool {
 	return false
 }
 
+func (x *FirmwareUpdateParams) GetExpectedSha256() string {
+	if x != nil {
+		return x.ExpectedSha256
+	}
+	return ""
+}
+
 // Status message for firmware update progress.
 type UpdateFirmwareStatus struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
@@ -260,6 +270,271 @@ func (x *UpdateFirmwareStatus) GetExitCode() int32 {
 	return 0
 }
 
+// Request message to list installed images.
+type ListImagesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListImagesRequest) Reset() {
+	*x = ListImagesRequest{}
+	mi := &file_proto_sonic_upgrade_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListImagesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListImagesRequest) ProtoMessage() {}
+
+func (x *ListImagesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_sonic_upgrade_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListImagesRequest.ProtoReflect.Descriptor instead.
+func (*ListImagesRequest) Descriptor() ([]byte, []int) {
+	return file_proto_sonic_upgrade_proto_rawDescGZIP(), []int{3}
+}
+
+// An image installed on the switch.
+type ImageInfo struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Image name as reported by sonic-installer, e.g. "SONiC-OS-202311.1".
+	Version string `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	// True for the image the switch is running.
+	Current bool `protobuf:"varint,2,opt,name=current,proto3" json:"current,omitempty"`
+	// True for the image the switch boots next.
+	NextBoot bool `protobuf:"varint,3,opt,name=next_boot,json=nextBoot,proto3" json:"next_boot,omitempty"`
+	// Disk space used by the image, 0 if unknown.
+	SizeBytes uint64 `protobuf:"varint,4,opt,name=size_bytes,json=sizeBytes,proto3" json:"size_bytes,omitempty"`
+	// Install time in nanoseconds since the Unix epoch, 0 if unknown.
+	InstallTime   int64 `protobuf:"varint,5,opt,name=install_time,json=installTime,proto3" json:"install_time,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ImageInfo) Reset() {
+	*x = ImageInfo{}
+	mi := &file_proto_sonic_upgrade_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ImageInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ImageInfo) ProtoMessage() {}
+
+func (x *ImageInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_sonic_upgrade_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ImageInfo.ProtoReflect.Descriptor instead.
+func (*ImageInfo) Descriptor() ([]byte, []int) {
+	return file_proto_sonic_upgrade_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ImageInfo) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *ImageInfo) GetCurrent() bool {
+	if x != nil {
+		return x.Current
+	}
+	return false
+}
+
+func (x *ImageInfo) GetNextBoot() bool {
+	if x != nil {
+		return x.NextBoot
+	}
+	return false
+}
+
+func (x *ImageInfo) GetSizeBytes() uint64 {
+	if x != nil {
+		return x.SizeBytes
+	}
+	return 0
+}
+
+func (x *ImageInfo) GetInstallTime() int64 {
+	if x != nil {
+		return x.InstallTime
+	}
+	return 0
+}
+
+// Response message listing installed images.
+type ListImagesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Images        []*ImageInfo           `protobuf:"bytes,1,rep,name=images,proto3" json:"images,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListImagesResponse) Reset() {
+	*x = ListImagesResponse{}
+	mi := &file_proto_sonic_upgrade_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListImagesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListImagesResponse) ProtoMessage() {}
+
+func (x *ListImagesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_sonic_upgrade_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListImagesResponse.ProtoReflect.Descriptor instead.
+func (*ListImagesResponse) Descriptor() ([]byte, []int) {
+	return file_proto_sonic_upgrade_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ListImagesResponse) GetImages() []*ImageInfo {
+	if x != nil {
+		return x.Images
+	}
+	return nil
+}
+
+// Request message to remove an installed image.
+type RemoveImageRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Image to remove. The "SONiC-OS-" and "SONiC." prefixes are optional.
+	Version       string `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RemoveImageRequest) Reset() {
+	*x = RemoveImageRequest{}
+	mi := &file_proto_sonic_upgrade_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RemoveImageRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RemoveImageRequest) ProtoMessage() {}
+
+func (x *RemoveImageRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_sonic_upgrade_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RemoveImageRequest.ProtoReflect.Descriptor instead.
+func (*RemoveImageRequest) Descriptor() ([]byte, []int) {
+	return file_proto_sonic_upgrade_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *RemoveImageRequest) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+// Response message for a removed image.
+type RemoveImageResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Image that was removed, as named by sonic-installer.
+	Version string `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	// Disk space freed by the removal, 0 if unknown.
+	ReclaimedBytes uint64 `protobuf:"varint,2,opt,name=reclaimed_bytes,json=reclaimedBytes,proto3" json:"reclaimed_bytes,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *RemoveImageResponse) Reset() {
+	*x = RemoveImageResponse{}
+	mi := &file_proto_sonic_upgrade_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RemoveImageResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RemoveImageResponse) ProtoMessage() {}
+
+func (x *RemoveImageResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_sonic_upgrade_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RemoveImageResponse.ProtoReflect.Descriptor instead.
+func (*RemoveImageResponse) Descriptor() ([]byte, []int) {
+	return file_proto_sonic_upgrade_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *RemoveImageResponse) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *RemoveImageResponse) GetReclaimedBytes() uint64 {
+	if x != nil {
+		return x.ReclaimedBytes
+	}
+	return 0
+}
+
 var File_proto_sonic_upgrade_proto protoreflect.FileDescriptor
 
 const file_proto_sonic_upgrade_proto_rawDesc = "" +
@@ -268,10 +543,11 @@ const file_proto_sonic_upgrade_proto_rawDesc = "" +
 	"gnoi.sonic\"o\n" +
 	"\x15UpdateFirmwareRequest\x12K\n" +
 	"\x0ffirmware_update\x18\x01 \x01(\v2 .gnoi.sonic.FirmwareUpdateParamsH\x00R\x0efirmwareUpdateB\t\n" +
-	"\arequest\"n\n" +
+	"\arequest\"\x97\x01\n" +
 	"\x14FirmwareUpdateParams\x12'\n" +
 	"\x0ffirmware_source\x18\x01 \x01(\tR\x0efirmwareSource\x12-\n" +
-	"\x13update_mlnx_cpld_fw\x18\x02 \x01(\bR\x10updateMlnxCpldFw\"\xca\x01\n" +
+	"\x13update_mlnx_cpld_fw\x18\x02 \x01(\bR\x10updateMlnxCpldFw\x12'\n" +
+	"\x0fexpected_sha256\x18\x03 \x01(\tR\x0eexpectedSha256\"\xca\x01\n" +
 	"\x14UpdateFirmwareStatus\x12\x19\n" +
 	"\blog_line\x18\x01 \x01(\tR\alogLine\x12<\n" +
 	"\x05state\x18\x02 \x01(\x0e2&.gnoi.sonic.UpdateFirmwareStatus.StateR\x05state\x12\x1b\n" +
@@ -281,9 +557,27 @@ const file_proto_sonic_upgrade_proto_rawDesc = "" +
 	"\aRUNNING\x10\x01\x12\r\n" +
 	"\tSUCCEEDED\x10\x02\x12\n" +
 	"\n" +
-	"\x06FAILED\x10\x032r\n" +
+	"\x06FAILED\x10\x03\"\x13\n" +
+	"\x11ListImagesRequest\"\x9e\x01\n" +
+	"\tImageInfo\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\tR\aversion\x12\x18\n" +
+	"\acurrent\x18\x02 \x01(\bR\acurrent\x12\x1b\n" +
+	"\tnext_boot\x18\x03 \x01(\bR\bnextBoot\x12\x1d\n" +
+	"\n" +
+	"size_bytes\x18\x04 \x01(\x04R\tsizeBytes\x12!\n" +
+	"\finstall_time\x18\x05 \x01(\x03R\vinstallTime\"C\n" +
+	"\x12ListImagesResponse\x12-\n" +
+	"\x06images\x18\x01 \x03(\v2\x15.gnoi.sonic.ImageInfoR\x06images\".\n" +
+	"\x12RemoveImageRequest\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\tR\aversion\"X\n" +
+	"\x13RemoveImageResponse\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\tR\aversion\x12'\n" +
+	"\x0freclaimed_bytes\x18\x02 \x01(\x04R\x0ereclaimedBytes2\x93\x02\n" +
 	"\x13SonicUpgradeService\x12[\n" +
-	"\x0eUpdateFirmware\x12!.gnoi.sonic.UpdateFirmwareRequest\x1a .gnoi.sonic.UpdateFirmwareStatus\"\x00(\x010\x01B\x0fZ\r./;gnoi_sonicb\x06proto3"
+	"\x0eUpdateFirmware\x12!.gnoi.sonic.UpdateFirmwareRequest\x1a .gnoi.sonic.UpdateFirmwareStatus\"\x00(\x010\x01\x12M\n" +
+	"\n" +
+	"ListImages\x12\x1d.gnoi.sonic.ListImagesRequest\x1a\x1e.gnoi.sonic.ListImagesResponse\"\x00\x12P\n" +
+	"\vRemoveImage\x12\x1e.gnoi.sonic.RemoveImageRequest\x1a\x1f.gnoi.sonic.RemoveImageResponse\"\x00B\x0fZ\r./;gnoi_sonicb\x06proto3"
 
 var (
 	file_proto_sonic_upgrade_proto_rawDescOnce sync.Once
@@ -298,23 +592,33 @@ func file_proto_sonic_upgrade_proto_rawDescGZIP() []byte {
 }
 
 var file_proto_sonic_upgrade_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_proto_sonic_upgrade_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_proto_sonic_upgrade_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
 var file_proto_sonic_upgrade_proto_goTypes = []any{
 	(UpdateFirmwareStatus_State)(0), // 0: gnoi.sonic.UpdateFirmwareStatus.State
 	(*UpdateFirmwareRequest)(nil),   // 1: gnoi.sonic.UpdateFirmwareRequest
 	(*FirmwareUpdateParams)(nil),    // 2: gnoi.sonic.FirmwareUpdateParams
 	(*UpdateFirmwareStatus)(nil),    // 3: gnoi.sonic.UpdateFirmwareStatus
+	(*ListImagesRequest)(nil),       // 4: gnoi.sonic.ListImagesRequest
+	(*ImageInfo)(nil),               // 5: gnoi.sonic.ImageInfo
+	(*ListImagesResponse)(nil),      // 6: gnoi.sonic.ListImagesResponse
+	(*RemoveImageRequest)(nil),      // 7: gnoi.sonic.RemoveImageRequest
+	(*RemoveImageResponse)(nil),     // 8: gnoi.sonic.RemoveImageResponse
 }
 var file_proto_sonic_upgrade_proto_depIdxs = []int32{
 	2, // 0: gnoi.sonic.UpdateFirmwareRequest.firmware_update:type_name -> gnoi.sonic.FirmwareUpdateParams
 	0, // 1: gnoi.sonic.UpdateFirmwareStatus.state:type_name -> gnoi.sonic.UpdateFirmwareStatus.State
-	1, // 2: gnoi.sonic.SonicUpgradeService.UpdateFirmware:input_type -> gnoi.sonic.UpdateFirmwareRequest
-	3, // 3: gnoi.sonic.SonicUpgradeService.UpdateFirmware:output_type -> gnoi.sonic.UpdateFirmwareStatus
-	3, // [3:4] is the sub-list for method output_type
-	2, // [2:3] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	5, // 2: gnoi.sonic.ListImagesResponse.images:type_name -> gnoi.sonic.ImageInfo
+	1, // 3: gnoi.sonic.SonicUpgradeService.UpdateFirmware:input_type -> gnoi.sonic.UpdateFirmwareRequest
+	4, // 4: gnoi.sonic.SonicUpgradeService.ListImages:input_type -> gnoi.sonic.ListImagesRequest
+	7, // 5: gnoi.sonic.SonicUpgradeService.RemoveImage:input_type -> gnoi.sonic.RemoveImageRequest
+	3, // 6: gnoi.sonic.SonicUpgradeService.UpdateFirmware:output_type -> gnoi.sonic.UpdateFirmwareStatus
+	6, // 7: gnoi.sonic.SonicUpgradeService.ListImages:output_type -> gnoi.sonic.ListImagesResponse
+	8, // 8: gnoi.sonic.SonicUpgradeService.RemoveImage:output_type -> gnoi.sonic.RemoveImageResponse
+	6, // [6:9] is the sub-list for method output_type
+	3, // [3:6] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
 }
 
 func init() { file_proto_sonic_upgrade_proto_init() }
@@ -331,7 +635,7 @@ func file_proto_sonic_upgrade_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_sonic_upgrade_proto_rawDesc), len(file_proto_sonic_upgrade_proto_rawDesc)),
 			NumEnums:      1,
-			NumMessages:   3,
+			NumMessages:   8,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
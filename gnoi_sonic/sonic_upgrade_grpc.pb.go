@@ -20,6 +20,8 @@ const _ = grpc.SupportPackageIsVersion9
 
 const (
 	SonicUpgradeService_UpdateFirmware_FullMethodName = "/gnoi.sonic.SonicUpgradeService/UpdateFirmware"
+	SonicUpgradeService_ListImages_FullMethodName     = "/gnoi.sonic.SonicUpgradeService/ListImages"
+	SonicUpgradeService_RemoveImage_FullMethodName    = "/gnoi.sonic.SonicUpgradeService/RemoveImage"
 )
 
 // SonicUpgradeServiceClient is the client API for SonicUpgradeService service.
@@ -30,6 +32,11 @@ const (
 type SonicUpgradeServiceClient interface {
 	// Starts a firmware update and streams status/log lines back to the client.
 	UpdateFirmware(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[UpdateFirmwareRequest, UpdateFirmwareStatus], error)
+	// Lists the SONiC images installed on the switch.
+	ListImages(ctx context.Context, in *ListImagesRequest, opts ...grpc.CallOption) (*ListImagesResponse, error)
+	// Removes an installed image to reclaim disk space. The running and
+	// next-boot images cannot be removed.
+	RemoveImage(ctx context.Context, in *RemoveImageRequest, opts ...grpc.CallOption) (*RemoveImageResponse, error)
 }
 
 type sonicUpgradeServiceClient struct {
@@ -53,6 +60,26 @@ func (c *sonicUpgradeServiceClient) UpdateFirmware(ctx context.Context, opts ...
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type SonicUpgradeService_UpdateFirmwareClient = grpc.BidiStreamingClient[UpdateFirmwareRequest, UpdateFirmwareStatus]
 
+func (c *sonicUpgradeServiceClient) ListImages(ctx context.Context, in *ListImagesRequest, opts ...grpc.CallOption) (*ListImagesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListImagesResponse)
+	err := c.cc.Invoke(ctx, SonicUpgradeService_ListImages_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sonicUpgradeServiceClient) RemoveImage(ctx context.Context, in *RemoveImageRequest, opts ...grpc.CallOption) (*RemoveImageResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RemoveImageResponse)
+	err := c.cc.Invoke(ctx, SonicUpgradeService_RemoveImage_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // SonicUpgradeServiceServer is the server API for SonicUpgradeService service.
 // All implementations must embed UnimplementedSonicUpgradeServiceServer
 // for forward compatibility.
@@ -61,6 +88,11 @@ type SonicUpgradeService_UpdateFirmwareClient = grpc.BidiStreamingClient[UpdateF
 type SonicUpgradeServiceServer interface {
 	// Starts a firmware update and streams status/log lines back to the client.
 	UpdateFirmware(grpc.BidiStreamingServer[UpdateFirmwareRequest, UpdateFirmwareStatus]) error
+	// Lists the SONiC images installed on the switch.
+	ListImages(context.Context, *ListImagesRequest) (*ListImagesResponse, error)
+	// Removes an installed image to reclaim disk space. The running and
+	// next-boot images cannot be removed.
+	RemoveImage(context.Context, *RemoveImageRequest) (*RemoveImageResponse, error)
 	mustEmbedUnimplementedSonicUpgradeServiceServer()
 }
 
@@ -74,6 +106,12 @@ type UnimplementedSonicUpgradeServiceServer struct{}
 func (UnimplementedSonicUpgradeServiceServer) UpdateFirmware(grpc.BidiStreamingServer[UpdateFirmwareRequest, UpdateFirmwareStatus]) error {
 	return status.Errorf(codes.Unimplemented, "method UpdateFirmware not implemented")
 }
+func (UnimplementedSonicUpgradeServiceServer) ListImages(context.Context, *ListImagesRequest) (*ListImagesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListImages not implemented")
+}
+func (UnimplementedSonicUpgradeServiceServer) RemoveImage(context.Context, *RemoveImageRequest) (*RemoveImageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveImage not implemented")
+}
 func (UnimplementedSonicUpgradeServiceServer) mustEmbedUnimplementedSonicUpgradeServiceServer() {}
 func (UnimplementedSonicUpgradeServiceServer) testEmbeddedByValue()                             {}
 
@@ -102,13 +140,58 @@ func _SonicUpgradeService_UpdateFirmware_Handler(srv interface{}, stream grpc.Se
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type SonicUpgradeService_UpdateFirmwareServer = grpc.BidiStreamingServer[UpdateFirmwareRequest, UpdateFirmwareStatus]
 
+func _SonicUpgradeService_ListImages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListImagesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SonicUpgradeServiceServer).ListImages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SonicUpgradeService_ListImages_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SonicUpgradeServiceServer).ListImages(ctx, req.(*ListImagesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SonicUpgradeService_RemoveImage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveImageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SonicUpgradeServiceServer).RemoveImage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SonicUpgradeService_RemoveImage_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SonicUpgradeServiceServer).RemoveImage(ctx, req.(*RemoveImageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // SonicUpgradeService_ServiceDesc is the grpc.ServiceDesc for SonicUpgradeService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var SonicUpgradeService_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "gnoi.sonic.SonicUpgradeService",
 	HandlerType: (*SonicUpgradeServiceServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListImages",
+			Handler:    _SonicUpgradeService_ListImages_Handler,
+		},
+		{
+			MethodName: "RemoveImage",
+			Handler:    _SonicUpgradeService_RemoveImage_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "UpdateFirmware",
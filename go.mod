@@ -4,6 +4,7 @@ go 1.24.1
 
 require (
 	github.com/coreos/go-systemd/v22 v22.5.0
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/openconfig/gnoi v0.6.1
 	google.golang.org/grpc v1.72.1
 	google.golang.org/protobuf v1.36.6
@@ -2,29 +2,78 @@ package agent
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"sync"
 	"time"
 
+	ospb "github.com/openconfig/gnoi/os"
+	syspb "github.com/openconfig/gnoi/system"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	"upgrade-agent/gnoi_sonic"
 	"upgrade-agent/internal/config"
+	"upgrade-agent/internal/firmwaresource"
 	"upgrade-agent/internal/grpcclient"
+	"upgrade-agent/internal/logging"
+	"upgrade-agent/internal/tlsconfig"
 )
 
+// Number of OS.Verify attempts made after a reboot and the pause between them
+const (
+	verifyAttempts      = 5
+	verifyRetryInterval = 15 * time.Second
+)
+
+// maxInstallAttempts bounds how many times an install interrupted by an agent
+// restart is retried before the upgrade is marked as failed
+const maxInstallAttempts = 3
+
+// updateBusyRetryInterval is the pause between firmware update requests while
+// the server is still running an earlier install
+const updateBusyRetryInterval = 15 * time.Second
+
+// rebootWait is how long a job lingers after requesting a reboot, giving the
+// logs time to be written before the switch goes down. Tests shorten it.
+var rebootWait = 5 * time.Second
+
 // Agent manages the firmware update process
 type Agent struct {
-	client        *grpcclient.Client
+	conn          *connection
 	currentConfig config.Config
 	lastVersion   string
 	lock          sync.Mutex
+
+	// The worker runs one job at a time: current, while queued holds the
+	// next one. A connection change arriving while a job runs is kept in
+	// pendingConn until it finishes.
+	current     *job
+	queued      *job
+	nextJobID   uint64
+	pendingConn *config.Config
+	wake        chan struct{}
+	// done tells the worker to stop, stopped is closed once it has. stopped
+	// is nil until Initialize starts the worker.
+	done         chan struct{}
+	stopped      chan struct{}
+	shuttingDown bool
+
+	// What the status API reports beyond the journal: the version OS.Verify
+	// last returned and the firmware update output of the current or last
+	// install
+	lastSeenVersion string
+	lastSeenAt      time.Time
+	progress        []string
 }
 
 // NewAgent creates a new agent instance
 func NewAgent() *Agent {
-	return &Agent{}
+	return &Agent{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
 }
 
 // UpdateConfig handles updates to the configuration
@@ -32,17 +81,22 @@ func (a *Agent) UpdateConfig(cfg config.Config) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	log.Printf("Received config update: target version=%s", cfg.TargetVersion)
+	slog.Info("Received config update", logging.KeyTargetVersion, cfg.TargetVersion)
+
+	if a.current != nil && a.currentConfig.Timeouts != cfg.Timeouts {
+		slog.Info("Timeouts changed, the running upgrade keeps the ones it started with")
+	}
 
 	// Save the new config
 	a.currentConfig = cfg
+	a.reconnectLocked(cfg)
 
 	// If target version has changed, trigger update
 	if a.lastVersion != "" && a.lastVersion != cfg.TargetVersion {
-		log.Printf("Target version changed from %s to %s, triggering update",
-			a.lastVersion, cfg.TargetVersion)
+		slog.Info("Target version changed, triggering update",
+			"previous_version", a.lastVersion, logging.KeyTargetVersion, cfg.TargetVersion)
 
-		go a.performUpdate(cfg)
+		a.enqueueLocked(JobUpdate, newUpgradeState(cfg))
 	}
 
 	a.lastVersion = cfg.TargetVersion
@@ -54,202 +108,463 @@ func (a *Agent) Initialize(cfg config.Config) error {
 	defer a.lock.Unlock()
 
 	// Create a new gRPC client
-	client, err := grpcclient.NewClient(cfg.GrpcTarget)
+	client, err := newClient(cfg)
 	if err != nil {
 		return err
 	}
 
-	a.client = client
+	a.conn = &connection{client: client, cfg: cfg}
 	a.currentConfig = cfg
 	a.lastVersion = cfg.TargetVersion
 
-	log.Printf("Agent initialized with target version: %s", cfg.TargetVersion)
+	slog.Info("Agent initialized", logging.KeyTargetVersion, cfg.TargetVersion)
+	a.stopped = make(chan struct{})
+	go a.work()
 
-	// Check if we need to resume an upgrade after reboot
+	// Check if we need to resume an upgrade interrupted by a reboot or restart
 	state, err := loadUpgradeState()
 	if err != nil {
-		log.Printf("Warning: Failed to load upgrade state: %v", err)
-	} else if state.InProgress {
-		log.Printf("Detected incomplete upgrade. Resuming post-reboot verification...")
-		go a.performPostRebootVerification(cfg)
+		slog.Warn("Failed to load upgrade state", logging.Err(err))
+	} else if state.InProgress() {
+		a.resumeUpgrade(state)
 	}
 
 	return nil
 }
 
-// performUpdate initiates a firmware update based on the provided config
-func (a *Agent) performUpdate(cfg config.Config) {
-	// Create a copy of the config to avoid race conditions
-	a.lock.Lock()
-	client := a.client
-	a.lock.Unlock()
+// newClient connects to cfg.GrpcTarget, over TLS if the config asks for it
+func newClient(cfg config.Config) (*grpcclient.Client, error) {
+	if !cfg.UseTLS() {
+		return grpcclient.NewClient(cfg.GrpcTarget, nil, cfg.AuthTokenFile)
+	}
+
+	serverName := cfg.TLSServerName
+	if serverName == "" {
+		serverName = cfg.GrpcTarget
+		if host, _, err := net.SplitHostPort(cfg.GrpcTarget); err == nil {
+			serverName = host
+		}
+	}
+
+	tlsConfig, err := tlsconfig.NewClientConfig(tlsconfig.Files{
+		CertFile: cfg.TLSCertFile,
+		KeyFile:  cfg.TLSKeyFile,
+		CAFile:   cfg.TLSCAFile,
+	}, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up TLS: %w", err)
+	}
+	return grpcclient.NewClient(cfg.GrpcTarget, tlsConfig, cfg.AuthTokenFile)
+}
+
+// resumeUpgrade continues an upgrade from the phase recorded in its state.
+// Called with a.lock held.
+func (a *Agent) resumeUpgrade(state UpgradeState) {
+	logger := state.logger().With(logging.KeyPhase, state.Phase)
+	switch state.Phase {
+	case PhasePending:
+		logger.Info("Detected upgrade that was accepted but not started, starting install")
+		a.enqueueLocked(JobUpdate, state)
+	case PhaseDownloading, PhaseInstalling:
+		// The agent died while the firmware update RPC was running, so the
+		// install has to be started over
+		if state.Attempts >= maxInstallAttempts {
+			logger.Error("Install was interrupted too often, giving up", "attempts", state.Attempts)
+			failUpgrade(&state, fmt.Errorf("install interrupted %d times", state.Attempts))
+			return
+		}
+		logger.Info("Detected interrupted install, restarting it")
+		a.enqueueLocked(JobUpdate, state)
+	case PhaseRebooting, PhaseVerifying:
+		logger.Info("Detected incomplete upgrade, resuming post-reboot verification")
+		a.enqueueLocked(JobVerify, state)
+	case PhaseRollingBack:
+		logger.Info("Detected rollback, resuming rollback verification", "source_version", state.SourceVersion)
+		a.enqueueLocked(JobVerifyRollback, state)
+	}
+}
+
+// newUpgradeState creates the state for a fresh upgrade to cfg.TargetVersion
+func newUpgradeState(cfg config.Config) UpgradeState {
+	return UpgradeState{
+		ID:            newUpgradeID(),
+		TargetVersion: cfg.TargetVersion,
+		Config:        cfg,
+		StartedAt:     time.Now(),
+	}
+}
+
+// recordPhase moves the upgrade to the given phase and persists it. A
+// finished upgrade is also added to the history.
+func recordPhase(state *UpgradeState, phase Phase) {
+	state.Phase = phase
+	if err := saveUpgradeState(*state); err != nil {
+		state.logger().Warn("Failed to save upgrade state", logging.KeyPhase, phase, logging.Err(err))
+	}
+	if finished(phase) {
+		upgradesFinished.Inc(state.TargetVersion, string(phase))
+		if err := appendHistory(*state); err != nil {
+			state.logger().Warn("Failed to record upgrade history", logging.Err(err))
+		}
+	}
+}
+
+// failUpgrade marks the upgrade as failed with the given error
+func failUpgrade(state *UpgradeState, err error) {
+	state.LastError = err.Error()
+	recordPhase(state, PhaseFailed)
+}
+
+// performUpdate initiates the firmware update described by state. Until the
+// reboot is requested, cancelling ctx abandons the update.
+func (a *Agent) performUpdate(ctx context.Context, state UpgradeState) {
+	cfg := state.Config
+	logger := logging.FromContext(ctx)
+
+	client, release := a.acquireClient()
+	defer release()
 
 	if client == nil {
-		log.Println("Cannot perform update: client not initialized")
+		logger.Error("Cannot perform update: client not initialized")
 		return
 	}
 
-	log.Printf("Starting firmware update to version %s", cfg.TargetVersion)
-	log.Printf("Using target: %s, firmware: %s, updateMlnxCpld: %s",
-		cfg.GrpcTarget, cfg.FirmwareSource, cfg.UpdateMlnxCpldFw)
+	state.Attempts++
+	state.LastError = ""
+	a.resetProgress()
+	upgradeAttempts.Inc(cfg.TargetVersion)
 
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	logger.Info("Starting firmware update", "attempt", state.Attempts, "grpc_target", cfg.GrpcTarget,
+		"firmware_source", cfg.Redacted().FirmwareSource, "update_mlnx_cpld_fw", cfg.UpdateMlnxCpldFw,
+		"reboot_method", cfg.EffectiveRebootMethod())
+
+	// Refuse a reboot method that cannot complete the upgrade before touching
+	// the switch
+	method, err := rebootMethod(cfg)
+	if err != nil {
+		logger.Error("Invalid upgrade configuration", logging.Err(err))
+		failUpgrade(&state, err)
+		return
+	}
+
+	// Create context with timeout; the server has to fetch remote images first
+	updateTimeout := cfg.Timeouts.Update
+	if firmwaresource.IsURL(cfg.FirmwareSource) {
+		updateTimeout = cfg.Timeouts.RemoteUpdate
+	}
+	updateCtx, cancel := context.WithTimeout(ctx, updateTimeout)
 	defer cancel()
 
 	// First, get the system time via gNOI.System.Time
-	timeCtx, timeCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	timeCtx, timeCancel := context.WithTimeout(ctx, cfg.Timeouts.RPC)
 	defer timeCancel()
 
 	timeResp, err := client.GetSystemTime(timeCtx)
 	if err != nil {
-		log.Printf("Warning: Failed to get system time: %v", err)
 		// Continue with update even if time request fails
-		if !a.shouldIgnoreError(err, cfg) {
+		if !a.shouldIgnoreError(ctx, err, cfg) {
 			// Only log as warning if not an ignored error type
-			log.Printf("Warning: Failed to get system time: %v", err)
+			logger.Warn("Failed to get system time", logging.Err(err))
 		}
-		// Continue with update even if time request fails
 	} else {
 		nanos := int64(timeResp.GetTime())
-		systemTime := time.Unix(nanos/1e9, nanos%1e9)
-		log.Printf("System time before update: %v (timestamp: %d ns)",
-			systemTime, timeResp.GetTime())
+		logger.Info("System time before update", "time", time.Unix(nanos/1e9, nanos%1e9))
 	}
 
 	// Get OS version via gNOI.OS.Verify
-	osCtx, osCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	osCtx, osCancel := context.WithTimeout(ctx, cfg.Timeouts.RPC)
 	defer osCancel()
 
 	osResp, err := client.GetOSVersion(osCtx)
 	if err != nil {
-		if !a.shouldIgnoreError(err, cfg) {
-			log.Printf("Warning: Failed to get OS version: %v", err)
+		if !a.shouldIgnoreError(ctx, err, cfg) {
+			logger.Warn("Failed to get OS version", logging.Err(err))
 		}
 		// Continue with update even if OS version request fails
 	} else {
-		log.Printf("OS version before update: %s", osResp.GetVersion())
+		a.sawVersion(osResp.GetVersion())
+		logger.Info("OS version before update", "version", osResp.GetVersion())
+		if state.SourceVersion == "" {
+			state.SourceVersion = osResp.GetVersion()
+		}
 		if failMsg := osResp.GetActivationFailMessage(); failMsg != "" {
-			log.Printf("Previous activation failure message: %s", failMsg)
+			logger.Warn("Previous activation failed", "message", failMsg)
 		}
 	}
 
 	// Prepare update parameters
 	params := &gnoi_sonic.FirmwareUpdateParams{
 		FirmwareSource:   cfg.FirmwareSource,
-		UpdateMlnxCpldFw: cfg.UpdateMlnxCpldFw == "true",
+		UpdateMlnxCpldFw: cfg.UpdateMlnxCpldFw,
+		ExpectedSha256:   cfg.FirmwareSHA256,
+	}
+
+	// A newer target may have arrived while the switch was being queried
+	if cancelledUpgrade(ctx, &state) {
+		return
+	}
+
+	// Record the install before starting it so a restart can pick it up
+	if firmwaresource.IsURL(cfg.FirmwareSource) {
+		recordPhase(&state, PhaseDownloading)
+	} else {
+		recordPhase(&state, PhaseInstalling)
 	}
 
 	// Initiate the update
-	if err := client.UpdateFirmware(ctx, params); err != nil {
-		if a.shouldIgnoreError(err, cfg) {
-			log.Printf("Firmware update RPC unimplemented, skipping ahead: %v", err)
+	installStart := time.Now()
+	err = a.updateFirmware(updateCtx, client, params)
+	if ctx.Err() == nil {
+		observePhase("install", installStart)
+	}
+	if err != nil {
+		if cancelledUpgrade(ctx, &state) {
+			return
+		}
+		if a.shouldIgnoreError(ctx, err, cfg) {
+			logger.Warn("Firmware update RPC unimplemented, skipping ahead", logging.Err(err))
 		} else {
-			log.Printf("Firmware update failed: %v", err)
+			logger.Error("Firmware update failed", logging.Err(err))
+			failUpgrade(&state, fmt.Errorf("firmware update failed: %w", err))
 			return
 		}
 	}
 
-	log.Printf("Firmware update to version %s completed successfully", cfg.TargetVersion)
+	logger.Info("Firmware update completed")
 
-	// Save the upgrade state before initiating reboot
-	state := UpgradeState{
-		InProgress:    true,
-		TargetVersion: cfg.TargetVersion,
-		Config:        cfg,
+	// Past this point the job runs to completion, a reboot cannot be taken back
+	if err := a.commitReboot(ctx); err != nil {
+		cancelledUpgrade(ctx, &state)
+		return
 	}
+	ctx = context.WithoutCancel(ctx)
 
-	if err := saveUpgradeState(state); err != nil {
-		log.Printf("Warning: Failed to save upgrade state: %v", err)
-	} else {
-		log.Printf("Marked upgrade in progress before reboot")
-	}
+	// Save the upgrade state before initiating reboot
+	state.RebootRequestedAt = time.Now()
+	recordPhase(&state, PhaseRebooting)
 
 	// Initiate a system reboot after successful firmware update
-	log.Printf("Initiating system reboot to complete firmware update process")
-	rebootCtx, rebootCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	logger.Info("Initiating system reboot to complete the firmware update")
+	rebootCtx, rebootCancel := context.WithTimeout(ctx, cfg.Timeouts.RPC)
 	defer rebootCancel()
 
-	if err := client.Reboot(rebootCtx); err != nil {
-		if a.shouldIgnoreError(err, cfg) {
-			log.Printf("Reboot RPC unimplemented, skipping ahead: %v", err)
+	if err := client.Reboot(rebootCtx, method); err != nil {
+		if a.shouldIgnoreError(ctx, err, cfg) {
+			logger.Warn("Reboot RPC unimplemented, skipping ahead", logging.Err(err))
 			// Since we're not actually rebooting, continue with post-reboot verification
-			a.performPostRebootVerification(cfg)
+			a.performPostRebootVerification(ctx, state)
 		} else {
-			log.Printf("Warning: Failed to initiate reboot after firmware update: %v", err)
-			// Clear the upgrade state since the reboot failed
-			if err := clearUpgradeState(); err != nil {
-				log.Printf("Warning: Failed to mark post-upgrade completion: %v", err)
-			}
+			logger.Error("Failed to initiate reboot after firmware update", logging.Err(err))
+			failUpgrade(&state, fmt.Errorf("reboot failed: %w", err))
 		}
 	} else {
-		log.Printf("System reboot request sent successfully")
-		log.Printf("Agent will be terminated by the reboot. Post-reboot verification will resume after restart.")
+		rebootsRequested.Inc("upgrade")
+		logger.Info("System reboot requested, post-reboot verification resumes after the restart")
 
 		// Give some time for the logs to be written and the reboot to start
-		time.Sleep(5 * time.Second)
+		time.Sleep(rebootWait)
 
 		// The agent will be terminated here by the system reboot
 		// The remaining verification will be performed when the agent restarts
 	}
 }
 
+// updateFirmware runs the firmware update RPC. The server refuses it while an
+// earlier install is still running, such as one left behind by a cancelled
+// job or an agent restart; that install cannot be interrupted, so it is waited
+// for until ctx expires.
+func (a *Agent) updateFirmware(ctx context.Context, client *grpcclient.Client, params *gnoi_sonic.FirmwareUpdateParams) error {
+	for {
+		err := client.UpdateFirmware(ctx, params, a.recordProgress)
+		if status.Code(err) != codes.FailedPrecondition {
+			return err
+		}
+		logging.FromContext(ctx).Info("Server is still running an earlier firmware update, waiting for it",
+			"retry_in", updateBusyRetryInterval, logging.Err(err))
+		a.recordProgress("Waiting for an earlier firmware update on the server to finish")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(updateBusyRetryInterval):
+		}
+	}
+}
+
+// rebootMethod returns the method of the reboot completing an upgrade with cfg
+func rebootMethod(cfg config.Config) (syspb.RebootMethod, error) {
+	name := cfg.EffectiveRebootMethod()
+	method, err := grpcclient.ParseRebootMethod(name)
+	if err != nil {
+		return syspb.RebootMethod_UNKNOWN, err
+	}
+	switch {
+	case method == syspb.RebootMethod_POWERDOWN:
+		return syspb.RebootMethod_UNKNOWN, fmt.Errorf("reboot method %s would not bring the switch back to finish the upgrade", name)
+	case cfg.UpdateMlnxCpldFw && method != syspb.RebootMethod_COLD:
+		return syspb.RebootMethod_UNKNOWN, fmt.Errorf("reboot method %s cannot complete a CPLD update, which needs a cold reboot", name)
+	}
+	return method, nil
+}
+
 // performPostRebootVerification performs the verification steps after a reboot
-func (a *Agent) performPostRebootVerification(cfg config.Config) {
-	log.Printf("Starting post-reboot verification for version %s", cfg.TargetVersion)
+func (a *Agent) performPostRebootVerification(ctx context.Context, state UpgradeState) {
+	cfg := state.Config
+	logger := logging.FromContext(ctx)
+	logger.Info("Starting post-reboot verification")
 
-	a.lock.Lock()
-	client := a.client
-	a.lock.Unlock()
+	client, release := a.acquireClient()
+	defer release()
 
 	if client == nil {
-		log.Println("Cannot perform post-reboot verification: client not initialized")
+		logger.Error("Cannot perform post-reboot verification: client not initialized")
 		return
 	}
 
-	// Wait for system services to stabilize
-	log.Printf("Waiting for system services to stabilize (60 seconds)...")
-	time.Sleep(60 * time.Second)
-	log.Printf("System stabilization period complete, proceeding with post-update verification")
+	// The reboot lasted from its request until the agent came back
+	if state.Phase == PhaseRebooting && !state.RebootRequestedAt.IsZero() {
+		observePhase("reboot", state.RebootRequestedAt)
+	}
+	recordPhase(&state, PhaseVerifying)
+	verifyStart := time.Now()
+	defer func() {
+		if ctx.Err() == nil {
+			observePhase("verification", verifyStart)
+		}
+	}()
+
+	if err := waitForStabilization(ctx, cfg.Timeouts.Stabilization); err != nil {
+		logger.Info("Post-reboot verification interrupted", logging.Err(err))
+		return
+	}
 
 	// Get OS version after update via gNOI.OS.Verify to confirm successful update
-	postUpdateOsCtx, postUpdateOsCancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer postUpdateOsCancel()
+	postUpdateOsResp, err := a.getRunningVersion(ctx, client, cfg)
+	if err != nil {
+		if cancelledUpgrade(ctx, &state) {
+			return
+		}
+		if a.shouldIgnoreError(ctx, err, cfg) {
+			logger.Warn("OS.Verify unimplemented, skipping version check")
+			a.completeVerification(ctx, client, &state, OutcomeSkipped, nil)
+			return
+		}
+		a.completeVerification(ctx, client, &state, OutcomeVerifyError,
+			fmt.Errorf("failed to get OS version after update: %w", err))
+		return
+	}
+
+	state.RunningVersion = postUpdateOsResp.GetVersion()
+	logger.Info("OS version after update", "version", state.RunningVersion)
 
-	postUpdateOsResp, err := client.GetOSVersion(postUpdateOsCtx)
+	if failMsg := postUpdateOsResp.GetActivationFailMessage(); failMsg != "" {
+		logger.Warn("Update activation failed", "message", failMsg)
+		a.completeVerification(ctx, client, &state, OutcomeActivationFailed,
+			fmt.Errorf("activation failed: %s", failMsg))
+		return
+	}
+
+	matched, err := versionMatches(state.RunningVersion, cfg.TargetVersion, cfg.VersionMatch)
 	if err != nil {
-		if !a.shouldIgnoreError(err, cfg) {
-			log.Printf("Warning: Failed to get OS version after update: %v", err)
+		a.completeVerification(ctx, client, &state, OutcomeVerifyError, err)
+		return
+	}
+	if !matched {
+		a.completeVerification(ctx, client, &state, OutcomeVersionMismatch,
+			fmt.Errorf("running version %s does not match target version %s", state.RunningVersion, cfg.TargetVersion))
+		return
+	}
+
+	a.completeVerification(ctx, client, &state, OutcomeSucceeded, nil)
+}
+
+// waitForStabilization gives system services time to come up after a
+// reboot. It returns early with the cause if ctx is cancelled.
+func waitForStabilization(ctx context.Context, d time.Duration) error {
+	logger := logging.FromContext(ctx)
+	logger.Info("Waiting for system services to stabilize", "duration", d)
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-time.After(d):
+	}
+	logger.Info("System stabilization period complete")
+	return nil
+}
+
+// getRunningVersion queries the running OS version via gNOI.OS.Verify. The
+// server may still be starting after the reboot, so retry a few times.
+func (a *Agent) getRunningVersion(ctx context.Context, client *grpcclient.Client, cfg config.Config) (*ospb.VerifyResponse, error) {
+	var resp *ospb.VerifyResponse
+	var err error
+	for attempt := 1; attempt <= verifyAttempts; attempt++ {
+		rpcCtx, cancel := context.WithTimeout(ctx, cfg.Timeouts.RPC)
+		resp, err = client.GetOSVersion(rpcCtx)
+		cancel()
+		if err == nil {
+			a.sawVersion(resp.GetVersion())
+			break
 		}
-	} else {
-		log.Printf("OS version after update: %s", postUpdateOsResp.GetVersion())
-		if failMsg := postUpdateOsResp.GetActivationFailMessage(); failMsg != "" {
-			log.Printf("Update activation failure message: %s", failMsg)
+		if a.shouldIgnoreError(ctx, err, cfg) {
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		logging.FromContext(ctx).Warn("Failed to get OS version after reboot",
+			"attempt", attempt, "max_attempts", verifyAttempts, logging.Err(err))
+		if attempt < verifyAttempts {
+			select {
+			case <-ctx.Done():
+				return nil, context.Cause(ctx)
+			case <-time.After(verifyRetryInterval):
+			}
 		}
 	}
+	return resp, err
+}
 
-	// Clear the upgrade state file since we've completed the verification
-	if err := clearUpgradeState(); err != nil {
-		log.Printf("Warning: Failed to mark post-upgrade completion: %v", err)
-	} else {
-		log.Printf("Upgrade completed successfully and marked as done")
+// completeVerification records the verification outcome and finishes the
+// upgrade as done, or as failed after attempting a rollback when the switch
+// is not running the target image
+func (a *Agent) completeVerification(ctx context.Context, client *grpcclient.Client, state *UpgradeState, outcome Outcome, err error) {
+	state.Outcome = outcome
+	state.CompletedAt = time.Now()
+
+	logger := logging.FromContext(ctx).With("outcome", outcome)
+	if err != nil {
+		logger.Error("Post-reboot verification failed", logging.Err(err))
+		if outcome == OutcomeVersionMismatch || outcome == OutcomeActivationFailed {
+			a.performRollback(ctx, client, *state, err)
+			return
+		}
+		failUpgrade(state, err)
+		return
 	}
+
+	recordPhase(state, PhaseDone)
+	logger.Info("Upgrade completed successfully")
+}
+
+// UpgradeStatus returns the journaled state of the current or last upgrade,
+// including the verification outcome once it is known
+func (a *Agent) UpgradeStatus() (UpgradeState, error) {
+	return loadUpgradeState()
 }
 
-// Close cleans up resources
+// Close cleans up resources. Call Shutdown first to stop the worker.
 func (a *Agent) Close() error {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	if a.client != nil {
-		return a.client.Close()
+	if a.conn != nil {
+		return a.conn.client.Close()
 	}
 	return nil
 }
 
 // shouldIgnoreError determines if the given error should be ignored
 // based on configuration settings
-func (a *Agent) shouldIgnoreError(err error, cfg config.Config) bool {
+func (a *Agent) shouldIgnoreError(ctx context.Context, err error, cfg config.Config) bool {
 	if !cfg.IgnoreUnimplementedRPC {
 		return false
 	}
@@ -257,7 +572,7 @@ func (a *Agent) shouldIgnoreError(err error, cfg config.Config) bool {
 	// Check if the error is a gRPC Unimplemented error
 	if st, ok := status.FromError(err); ok {
 		if st.Code() == codes.Unimplemented {
-			log.Printf("Ignoring unimplemented RPC error: %v", err)
+			logging.FromContext(ctx).Debug("Ignoring unimplemented RPC error", logging.Err(err))
 			return true
 		}
 	}
@@ -0,0 +1,358 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	ospb "github.com/openconfig/gnoi/os"
+	syspb "github.com/openconfig/gnoi/system"
+	"google.golang.org/grpc"
+
+	gnoisonic "upgrade-agent/gnoi_sonic"
+	"upgrade-agent/internal/config"
+)
+
+// fakeServer is an upgrade server that records the RPCs the agent makes. It
+// reports version as running and lets every firmware update succeed unless
+// updateFirmware is set.
+type fakeServer struct {
+	gnoisonic.UnimplementedSonicUpgradeServiceServer
+	syspb.UnimplementedSystemServer
+	ospb.UnimplementedOSServer
+
+	addr string
+
+	lock    sync.Mutex
+	version string
+	// activationFailMessage is reported by OS.Verify
+	activationFailMessage string
+	// verifyGate, if not nil, holds OS.Verify until it is closed
+	verifyGate chan struct{}
+	// updateFirmware, if not nil, handles the nth firmware update (starting
+	// at 1) instead of a successful install
+	updateFirmware func(n int, stream grpc.BidiStreamingServer[gnoisonic.UpdateFirmwareRequest, gnoisonic.UpdateFirmwareStatus]) error
+	activateErr    error
+
+	updates     []*gnoisonic.FirmwareUpdateParams
+	activations []*ospb.ActivateRequest
+	reboots     []*syspb.RebootRequest
+	// updateStarted receives a value whenever a firmware update arrives
+	updateStarted chan struct{}
+}
+
+// newFakeServer starts a fakeServer running version on a local port
+func newFakeServer(t *testing.T, version string) *fakeServer {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{addr: lis.Addr().String(), version: version, updateStarted: make(chan struct{}, 10)}
+	server := grpc.NewServer()
+	gnoisonic.RegisterSonicUpgradeServiceServer(server, s)
+	syspb.RegisterSystemServer(server, s)
+	ospb.RegisterOSServer(server, s)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return s
+}
+
+func (s *fakeServer) UpdateFirmware(stream grpc.BidiStreamingServer[gnoisonic.UpdateFirmwareRequest, gnoisonic.UpdateFirmwareStatus]) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.updates = append(s.updates, req.GetFirmwareUpdate())
+	n := len(s.updates)
+	handler := s.updateFirmware
+	s.lock.Unlock()
+	s.updateStarted <- struct{}{}
+
+	if handler != nil {
+		return handler(n, stream)
+	}
+	return stream.Send(&gnoisonic.UpdateFirmwareStatus{
+		LogLine: "Firmware update completed successfully",
+		State:   gnoisonic.UpdateFirmwareStatus_SUCCEEDED,
+	})
+}
+
+func (s *fakeServer) Time(ctx context.Context, req *syspb.TimeRequest) (*syspb.TimeResponse, error) {
+	return &syspb.TimeResponse{Time: uint64(time.Now().UnixNano())}, nil
+}
+
+func (s *fakeServer) Reboot(ctx context.Context, req *syspb.RebootRequest) (*syspb.RebootResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reboots = append(s.reboots, req)
+	return &syspb.RebootResponse{}, nil
+}
+
+func (s *fakeServer) Verify(ctx context.Context, req *ospb.VerifyRequest) (*ospb.VerifyResponse, error) {
+	s.lock.Lock()
+	gate := s.verifyGate
+	s.lock.Unlock()
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &ospb.VerifyResponse{Version: s.version, ActivationFailMessage: s.activationFailMessage}, nil
+}
+
+func (s *fakeServer) Activate(ctx context.Context, req *ospb.ActivateRequest) (*ospb.ActivateResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.activations = append(s.activations, req)
+	if s.activateErr != nil {
+		return nil, s.activateErr
+	}
+	return &ospb.ActivateResponse{Response: &ospb.ActivateResponse_ActivateOk{ActivateOk: &ospb.ActivateOK{}}}, nil
+}
+
+// setVersion changes the version reported by OS.Verify
+func (s *fakeServer) setVersion(version string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.version = version
+}
+
+// calls returns how many firmware updates, activations and reboots the
+// server received
+func (s *fakeServer) calls() (updates, activations, reboots int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.updates), len(s.activations), len(s.reboots)
+}
+
+// useTempState points the upgrade journal and history at a temporary
+// directory and makes reboot requests return at once
+func useTempState(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	stateFile, historyFile, wait := upgradeStateFile, upgradeHistoryFile, rebootWait
+	upgradeStateFile = filepath.Join(dir, "upgrade_agent_state.json")
+	upgradeHistoryFile = filepath.Join(dir, "upgrade_agent_history.json")
+	rebootWait = 0
+	t.Cleanup(func() {
+		upgradeStateFile, upgradeHistoryFile, rebootWait = stateFile, historyFile, wait
+	})
+}
+
+// testConfig returns a config upgrading to target through server
+func testConfig(server *fakeServer, target string) config.Config {
+	return config.Config{
+		GrpcTarget:     server.addr,
+		FirmwareSource: "/images/sonic.bin",
+		TargetVersion:  target,
+		Timeouts: config.Timeouts{
+			RPC:           5 * time.Second,
+			Update:        10 * time.Second,
+			RemoteUpdate:  10 * time.Second,
+			Stabilization: time.Millisecond,
+		},
+	}.WithDefaults()
+}
+
+// startAgent initializes an agent with cfg and stops it when the test ends
+func startAgent(t *testing.T, cfg config.Config) *Agent {
+	t.Helper()
+	a := NewAgent()
+	if err := a.Initialize(cfg); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+	t.Cleanup(func() {
+		a.Shutdown(5 * time.Second)
+		a.Close()
+	})
+	return a
+}
+
+// waitIdle waits until the agent has neither a running nor a waiting job
+func waitIdle(t *testing.T, a *Agent) {
+	t.Helper()
+	waitFor(t, "the agent to be idle", func() bool {
+		status, _ := a.Status()
+		return status.Current == nil && status.Queued == nil
+	})
+}
+
+// waitFor polls cond until it holds, failing the test after a while
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeState journals state as left behind by an earlier run of the agent
+func writeState(t *testing.T, state UpgradeState) {
+	t.Helper()
+	if err := saveUpgradeState(state); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readState returns the journaled upgrade state
+func readState(t *testing.T) UpgradeState {
+	t.Helper()
+	state, err := readUpgradeState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// readHistory returns the finished upgrades
+func readHistory(t *testing.T) []HistoryEntry {
+	t.Helper()
+	history, err := loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return history
+}
+
+func TestUpgrade(t *testing.T) {
+	useTempState(t)
+	server := newFakeServer(t, "SONiC.1.0")
+	cfg := testConfig(server, "1.0")
+	a := startAgent(t, cfg)
+
+	cfg.TargetVersion = "2.0"
+	a.UpdateConfig(cfg)
+	waitIdle(t, a)
+
+	state := readState(t)
+	if state.Phase != PhaseRebooting || state.TargetVersion != "2.0" || state.SourceVersion != "SONiC.1.0" || state.Attempts != 1 {
+		t.Errorf("journal = %s %s from %s after %d attempts, want rebooting 2.0 from SONiC.1.0 after 1",
+			state.Phase, state.TargetVersion, state.SourceVersion, state.Attempts)
+	}
+	if state.ID == "" || state.RebootRequestedAt.IsZero() {
+		t.Errorf("journal = %+v, want an upgrade ID and the reboot request time", state)
+	}
+	if updates, _, reboots := server.calls(); updates != 1 || reboots != 1 {
+		t.Errorf("server got %d updates and %d reboots, want 1 each", updates, reboots)
+	}
+	if got := server.updates[0].GetFirmwareSource(); got != cfg.FirmwareSource {
+		t.Errorf("firmware source = %q, want %q", got, cfg.FirmwareSource)
+	}
+	if got := server.reboots[0].GetMethod(); got != syspb.RebootMethod_COLD {
+		t.Errorf("reboot method = %v, want COLD", got)
+	}
+
+	// The agent restarts after the reboot and verifies the new version
+	server.setVersion("SONiC.2.0")
+	a.Shutdown(time.Second)
+	a = startAgent(t, cfg)
+	waitIdle(t, a)
+
+	state = readState(t)
+	if state.Phase != PhaseDone || state.Outcome != OutcomeSucceeded || state.RunningVersion != "SONiC.2.0" {
+		t.Errorf("journal = %s %s running %s, want done succeeded running SONiC.2.0", state.Phase, state.Outcome, state.RunningVersion)
+	}
+	history := readHistory(t)
+	if len(history) != 1 || history[0].ID != state.ID || history[0].Phase != PhaseDone {
+		t.Errorf("history = %+v, want the finished upgrade", history)
+	}
+}
+
+func TestResumeUpgrade(t *testing.T) {
+	tests := []struct {
+		name  string
+		state UpgradeState
+		// running is the version the server reports
+		running     string
+		wantPhase   Phase
+		wantUpdates int
+		// wantAttempts is the number of install attempts journaled
+		wantAttempts int
+	}{
+		{
+			name:         "pending",
+			state:        UpgradeState{Phase: PhasePending},
+			running:      "SONiC.1.0",
+			wantPhase:    PhaseRebooting,
+			wantUpdates:  1,
+			wantAttempts: 1,
+		},
+		{
+			name:         "interrupted download",
+			state:        UpgradeState{Phase: PhaseDownloading, Attempts: 1},
+			running:      "SONiC.1.0",
+			wantPhase:    PhaseRebooting,
+			wantUpdates:  1,
+			wantAttempts: 2,
+		},
+		{
+			name:         "install interrupted too often",
+			state:        UpgradeState{Phase: PhaseInstalling, Attempts: maxInstallAttempts},
+			running:      "SONiC.1.0",
+			wantPhase:    PhaseFailed,
+			wantAttempts: maxInstallAttempts,
+		},
+		{
+			name:      "rebooting",
+			state:     UpgradeState{Phase: PhaseRebooting, Attempts: 1},
+			running:   "SONiC.2.0",
+			wantPhase: PhaseDone,
+			// wantAttempts is carried over from the install
+			wantAttempts: 1,
+		},
+		{
+			name:         "interrupted verification",
+			state:        UpgradeState{Phase: PhaseVerifying, Attempts: 1},
+			running:      "SONiC.2.0",
+			wantPhase:    PhaseDone,
+			wantAttempts: 1,
+		},
+		{
+			name:         "finished",
+			state:        UpgradeState{Phase: PhaseFailed, Attempts: 1},
+			running:      "SONiC.1.0",
+			wantPhase:    PhaseFailed,
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempState(t)
+			server := newFakeServer(t, tt.running)
+			cfg := testConfig(server, "2.0")
+			state := tt.state
+			state.ID = "0123456789abcdef"
+			state.TargetVersion = cfg.TargetVersion
+			state.SourceVersion = "SONiC.1.0"
+			state.Config = cfg
+			writeState(t, state)
+
+			a := startAgent(t, cfg)
+			waitIdle(t, a)
+
+			got := readState(t)
+			if got.Phase != tt.wantPhase || got.Attempts != tt.wantAttempts {
+				t.Errorf("journal = %s after %d attempts (%s), want %s after %d",
+					got.Phase, got.Attempts, got.LastError, tt.wantPhase, tt.wantAttempts)
+			}
+			if got.ID != state.ID {
+				t.Errorf("journal ID = %q, want the resumed upgrade's %q", got.ID, state.ID)
+			}
+			if updates, _, _ := server.calls(); updates != tt.wantUpdates {
+				t.Errorf("server got %d firmware updates, want %d", updates, tt.wantUpdates)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+
+	"upgrade-agent/internal/config"
+	"upgrade-agent/internal/grpcclient"
+	"upgrade-agent/internal/logging"
+)
+
+// connectionFields are the config fields the gRPC client is built from. A
+// change to any of them needs a new client.
+var connectionFields = map[string]bool{
+	"grpcTarget":    true,
+	"tlsEnabled":    true,
+	"tlsCAFile":     true,
+	"tlsCertFile":   true,
+	"tlsKeyFile":    true,
+	"tlsServerName": true,
+	"authTokenFile": true,
+}
+
+// connection is a gRPC client together with the RPC work using it, so that
+// it is only closed once that work has drained
+type connection struct {
+	client *grpcclient.Client
+	// cfg is the config the client was built from
+	cfg   config.Config
+	users sync.WaitGroup
+}
+
+// connectionChanges returns the names of the connection fields that differ
+// between the config the client was built from and cfg
+func connectionChanges(current, cfg config.Config) []string {
+	var changed []string
+	for _, change := range config.Diff(current, cfg) {
+		if connectionFields[change.Field] {
+			changed = append(changed, change.Field)
+		}
+	}
+	return changed
+}
+
+// acquireClient returns the current client for a stretch of RPCs and a
+// function to call once they are done. The client is nil if none was built.
+func (a *Agent) acquireClient() (*grpcclient.Client, func()) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	conn := a.conn
+	if conn == nil {
+		return nil, func() {}
+	}
+	conn.users.Add(1)
+	return conn.client, conn.users.Done
+}
+
+// reconnectLocked rebuilds the client for cfg if its connection settings
+// changed. While a job is running the swap is deferred until it finishes,
+// so an upgrade never moves to another server half way. Called with a.lock
+// held.
+func (a *Agent) reconnectLocked(cfg config.Config) {
+	if a.conn == nil {
+		return
+	}
+	changed := connectionChanges(a.conn.cfg, cfg)
+	if len(changed) == 0 {
+		a.pendingConn = nil
+		return
+	}
+	fields := strings.Join(changed, ",")
+	if a.current != nil {
+		slog.Info("Connection settings changed during an upgrade, reconnecting once it finishes", "fields", fields)
+		a.pendingConn = &cfg
+		return
+	}
+
+	client, err := newClient(cfg)
+	if err != nil {
+		slog.Error("Failed to reconnect for changed connection settings, keeping the current connection",
+			"fields", fields, "grpc_target", a.conn.cfg.GrpcTarget, logging.Err(err))
+		return
+	}
+	slog.Info("Connection settings changed, switched connection",
+		"fields", fields, "previous_grpc_target", a.conn.cfg.GrpcTarget, "grpc_target", cfg.GrpcTarget)
+
+	old := a.conn
+	a.conn = &connection{client: client, cfg: cfg}
+	a.pendingConn = nil
+	go drain(old)
+}
+
+// drain closes a replaced connection once the RPCs still using it are done
+func drain(conn *connection) {
+	conn.users.Wait()
+	if err := conn.client.Close(); err != nil {
+		slog.Warn("Failed to close replaced connection", "grpc_target", conn.cfg.GrpcTarget, logging.Err(err))
+	}
+}
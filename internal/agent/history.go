@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"upgrade-agent/internal/fileutils"
+	"upgrade-agent/internal/logging"
+)
+
+// maxHistoryEntries bounds the history, the oldest entries are dropped
+const maxHistoryEntries = 50
+
+// upgradeHistoryFile is the JSON list of finished upgrades, next to the
+// upgrade state journal. Tests point it elsewhere.
+var upgradeHistoryFile = "/etc/sonic/upgrade_agent_history.json"
+
+// HistoryEntry summarizes a finished upgrade
+type HistoryEntry struct {
+	ID              string    `json:"id,omitempty"`
+	TargetVersion   string    `json:"targetVersion"`
+	SourceVersion   string    `json:"sourceVersion,omitempty"`
+	RunningVersion  string    `json:"runningVersion,omitempty"`
+	Phase           Phase     `json:"phase"`
+	Outcome         Outcome   `json:"outcome,omitempty"`
+	LastError       string    `json:"lastError,omitempty"`
+	Attempts        int       `json:"attempts"`
+	RolledBack      bool      `json:"rolledBack,omitempty"`
+	StartedAt       time.Time `json:"startedAt"`
+	CompletedAt     time.Time `json:"completedAt"`
+	DurationSeconds float64   `json:"durationSeconds"`
+}
+
+// finished reports whether the phase ends an upgrade
+func finished(phase Phase) bool {
+	return phase == PhaseDone || phase == PhaseFailed || phase == PhaseCancelled
+}
+
+// appendHistory records a finished upgrade, keeping the newest entries
+func appendHistory(state UpgradeState) error {
+	completed := state.CompletedAt
+	if completed.IsZero() {
+		completed = time.Now()
+	}
+	entry := HistoryEntry{
+		ID:              state.ID,
+		TargetVersion:   state.TargetVersion,
+		SourceVersion:   state.SourceVersion,
+		RunningVersion:  state.RunningVersion,
+		Phase:           state.Phase,
+		Outcome:         state.Outcome,
+		LastError:       state.LastError,
+		Attempts:        state.Attempts,
+		RolledBack:      state.RolledBack,
+		StartedAt:       state.StartedAt,
+		CompletedAt:     completed,
+		DurationSeconds: completed.Sub(state.StartedAt).Seconds(),
+	}
+
+	history, err := loadHistory()
+	if err != nil {
+		slog.Warn("Starting a new upgrade history", logging.Err(err))
+		history = nil
+	}
+	history = append(history, entry)
+	if len(history) > maxHistoryEntries {
+		history = history[len(history)-maxHistoryEntries:]
+	}
+
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode upgrade history: %w", err)
+	}
+	if err := fileutils.WriteAtomic(upgradeHistoryFile, data); err != nil {
+		return fmt.Errorf("failed to save upgrade history: %w", err)
+	}
+	return nil
+}
+
+// loadHistory reads the finished upgrades, oldest first. A missing file
+// yields an empty history.
+func loadHistory() ([]HistoryEntry, error) {
+	data, err := os.ReadFile(upgradeHistoryFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read upgrade history: %w", err)
+	}
+
+	var history []HistoryEntry
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("failed to parse upgrade history %s: %w", upgradeHistoryFile, err)
+	}
+	return history, nil
+}
+
+// History returns the finished upgrades, oldest first
+func (a *Agent) History() ([]HistoryEntry, error) {
+	return loadHistory()
+}
@@ -0,0 +1,26 @@
+package agent
+
+import (
+	"time"
+
+	"upgrade-agent/internal/metrics"
+)
+
+// Upgrade metrics, served by the status API and --metrics-addr
+var (
+	upgradeAttempts = metrics.NewCounter("upgrade_agent_upgrade_attempts_total",
+		"Firmware installs started, by target version", "target_version")
+	upgradesFinished = metrics.NewCounter("upgrade_agent_upgrades_total",
+		"Upgrades finished, by target version and outcome: done, failed or cancelled", "target_version", "outcome")
+	phaseDuration = metrics.NewHistogram("upgrade_agent_phase_duration_seconds",
+		"Duration of the install, reboot and verification phases of upgrades", metrics.DurationBuckets, "phase")
+	rebootsRequested = metrics.NewCounter("upgrade_agent_reboots_requested_total",
+		"Reboots requested from the server, by reason: upgrade or rollback", "reason")
+	upgradeInProgress = metrics.NewGauge("upgrade_agent_upgrade_in_progress",
+		"1 while an upgrade job is running, 0 otherwise")
+)
+
+// observePhase records how long a phase of an upgrade took since start
+func observePhase(phase string, start time.Time) {
+	phaseDuration.Observe(time.Since(start).Seconds(), phase)
+}
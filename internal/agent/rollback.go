@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	syspb "github.com/openconfig/gnoi/system"
+
+	"upgrade-agent/internal/grpcclient"
+	"upgrade-agent/internal/logging"
+)
+
+// maxRollbackAttempts bounds how many times the agent reboots into the
+// previous image for a single failed upgrade, so a switch that cannot boot
+// either image does not reboot forever
+const maxRollbackAttempts = 2
+
+// performRollback makes the pre-upgrade image the next-boot image via
+// gNOI.OS.Activate and reboots into it. cause is the verification failure
+// that triggered the rollback.
+func (a *Agent) performRollback(ctx context.Context, client *grpcclient.Client, state UpgradeState, cause error) {
+	cfg := state.Config
+	logger := logging.FromContext(ctx).With("source_version", state.SourceVersion)
+
+	if state.SourceVersion == "" {
+		logger.Error("Cannot roll back: pre-upgrade version was not recorded")
+		failUpgrade(&state, fmt.Errorf("%v; no pre-upgrade version recorded to roll back to", cause))
+		return
+	}
+
+	// The install may simply not have taken effect, in which case the switch
+	// is already running the previous image
+	if normalizeVersion(state.RunningVersion) == normalizeVersion(state.SourceVersion) {
+		logger.Info("Switch is still running the pre-upgrade version, no rollback needed")
+		failUpgrade(&state, cause)
+		return
+	}
+
+	if state.RollbackAttempts >= maxRollbackAttempts {
+		logger.Error("Rollback already attempted too often, giving up", "rollback_attempts", state.RollbackAttempts)
+		failUpgrade(&state, fmt.Errorf("%v; rollback to %s abandoned after %d attempts",
+			cause, state.SourceVersion, state.RollbackAttempts))
+		return
+	}
+
+	// Activating the previous image and rebooting into it go together, a
+	// shutdown leaves the upgrade in verification to be retried instead
+	if err := a.commitReboot(ctx); err != nil {
+		cancelledUpgrade(ctx, &state)
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	state.RollbackAttempts++
+	state.LastError = cause.Error()
+	recordPhase(&state, PhaseRollingBack)
+
+	logger.Warn("Rolling back to the pre-upgrade version",
+		"rollback_attempt", state.RollbackAttempts, "max_rollback_attempts", maxRollbackAttempts)
+
+	// Set the previous image as next boot without letting the server reboot,
+	// so the reboot goes through the same System.Reboot path as the upgrade
+	activateCtx, activateCancel := context.WithTimeout(ctx, cfg.Timeouts.RPC)
+	defer activateCancel()
+
+	if _, err := client.ActivateOS(activateCtx, state.SourceVersion, true); err != nil {
+		logger.Error("Failed to activate the pre-upgrade version", logging.Err(err))
+		failUpgrade(&state, fmt.Errorf("%v; rollback activation of %s failed: %w", cause, state.SourceVersion, err))
+		return
+	}
+
+	rebootCtx, rebootCancel := context.WithTimeout(ctx, cfg.Timeouts.RPC)
+	defer rebootCancel()
+
+	// Always cold reboot out of a failed image, a warm or fast reboot would
+	// carry its state over into the previous version
+	if err := client.Reboot(rebootCtx, syspb.RebootMethod_COLD); err != nil {
+		if a.shouldIgnoreError(ctx, err, cfg) {
+			logger.Warn("Reboot RPC unimplemented, skipping ahead", logging.Err(err))
+			a.verifyRollback(ctx, state)
+			return
+		}
+		logger.Error("Failed to reboot into the pre-upgrade version", logging.Err(err))
+		failUpgrade(&state, fmt.Errorf("%v; rollback reboot failed: %w", cause, err))
+		return
+	}
+
+	rebootsRequested.Inc("rollback")
+	logger.Info("Rollback reboot requested, rollback verification resumes after the restart")
+
+	// Give some time for the logs to be written and the reboot to start
+	time.Sleep(rebootWait)
+}
+
+// verifyRollback checks that the switch came back on the pre-upgrade image
+// after a rollback reboot, and retries the rollback within its budget if not
+func (a *Agent) verifyRollback(ctx context.Context, state UpgradeState) {
+	cfg := state.Config
+	logger := logging.FromContext(ctx).With("source_version", state.SourceVersion)
+	logger.Info("Starting rollback verification")
+
+	client, release := a.acquireClient()
+	defer release()
+
+	if client == nil {
+		logger.Error("Cannot perform rollback verification: client not initialized")
+		return
+	}
+
+	if err := waitForStabilization(ctx, cfg.Timeouts.Stabilization); err != nil {
+		logger.Info("Rollback verification interrupted", logging.Err(err))
+		return
+	}
+
+	resp, err := a.getRunningVersion(ctx, client, cfg)
+	if err != nil {
+		if cancelledUpgrade(ctx, &state) {
+			return
+		}
+		failUpgrade(&state, fmt.Errorf("%s; failed to verify rollback to %s: %w",
+			state.LastError, state.SourceVersion, err))
+		return
+	}
+
+	state.RunningVersion = resp.GetVersion()
+	logger.Info("OS version after rollback", "version", state.RunningVersion)
+
+	if normalizeVersion(state.RunningVersion) != normalizeVersion(state.SourceVersion) {
+		a.performRollback(ctx, client, state, fmt.Errorf("%s; rollback booted %s instead of %s",
+			state.LastError, state.RunningVersion, state.SourceVersion))
+		return
+	}
+
+	// The upgrade still failed, but the switch is back on a known-good image
+	state.RolledBack = true
+	state.CompletedAt = time.Now()
+	logger.Warn("Rolled back to the pre-upgrade version after the failed upgrade")
+	failUpgrade(&state, fmt.Errorf("%s; rolled back to %s", state.LastError, state.SourceVersion))
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	syspb "github.com/openconfig/gnoi/system"
+)
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name  string
+		phase Phase
+		// running is the version the server reports after the reboot
+		running               string
+		activationFailMessage string
+		sourceVersion         string
+		rollbackAttempts      int
+		activateErr           error
+
+		wantPhase            Phase
+		wantOutcome          Outcome
+		wantRollbackAttempts int
+		wantRolledBack       bool
+		wantActivate         bool
+		wantReboot           bool
+		wantError            string
+	}{
+		{
+			name:                 "version mismatch",
+			phase:                PhaseRebooting,
+			running:              "SONiC.3.0",
+			sourceVersion:        "SONiC.1.0",
+			wantPhase:            PhaseRollingBack,
+			wantOutcome:          OutcomeVersionMismatch,
+			wantRollbackAttempts: 1,
+			wantActivate:         true,
+			wantReboot:           true,
+		},
+		{
+			name:                  "activation failed",
+			phase:                 PhaseRebooting,
+			running:               "SONiC.2.0",
+			activationFailMessage: "image failed to boot",
+			sourceVersion:         "SONiC.1.0",
+			wantPhase:             PhaseRollingBack,
+			wantOutcome:           OutcomeActivationFailed,
+			wantRollbackAttempts:  1,
+			wantActivate:          true,
+			wantReboot:            true,
+		},
+		{
+			name:          "still on the previous version",
+			phase:         PhaseRebooting,
+			running:       "SONiC.1.0",
+			sourceVersion: "SONiC.1.0",
+			wantPhase:     PhaseFailed,
+			wantOutcome:   OutcomeVersionMismatch,
+			wantError:     "does not match target version",
+		},
+		{
+			name:        "no previous version",
+			phase:       PhaseRebooting,
+			running:     "SONiC.3.0",
+			wantPhase:   PhaseFailed,
+			wantOutcome: OutcomeVersionMismatch,
+			wantError:   "no pre-upgrade version recorded",
+		},
+		{
+			name:                 "rollbacks exhausted",
+			phase:                PhaseRebooting,
+			running:              "SONiC.3.0",
+			sourceVersion:        "SONiC.1.0",
+			rollbackAttempts:     maxRollbackAttempts,
+			wantPhase:            PhaseFailed,
+			wantOutcome:          OutcomeVersionMismatch,
+			wantRollbackAttempts: maxRollbackAttempts,
+			wantError:            "abandoned after 2 attempts",
+		},
+		{
+			name:                 "activation of the previous version fails",
+			phase:                PhaseRebooting,
+			running:              "SONiC.3.0",
+			sourceVersion:        "SONiC.1.0",
+			activateErr:          errors.New("no such image"),
+			wantPhase:            PhaseFailed,
+			wantOutcome:          OutcomeVersionMismatch,
+			wantRollbackAttempts: 1,
+			wantActivate:         true,
+			wantError:            "rollback activation of SONiC.1.0 failed",
+		},
+		{
+			name:                 "rolled back",
+			phase:                PhaseRollingBack,
+			running:              "SONiC.1.0",
+			sourceVersion:        "SONiC.1.0",
+			rollbackAttempts:     1,
+			wantPhase:            PhaseFailed,
+			wantRollbackAttempts: 1,
+			wantRolledBack:       true,
+			wantError:            "rolled back to SONiC.1.0",
+		},
+		{
+			name:                 "rollback booted another version",
+			phase:                PhaseRollingBack,
+			running:              "SONiC.3.0",
+			sourceVersion:        "SONiC.1.0",
+			rollbackAttempts:     1,
+			wantPhase:            PhaseRollingBack,
+			wantRollbackAttempts: 2,
+			wantActivate:         true,
+			wantReboot:           true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempState(t)
+			server := newFakeServer(t, tt.running)
+			server.activationFailMessage = tt.activationFailMessage
+			server.activateErr = tt.activateErr
+			cfg := testConfig(server, "2.0")
+			state := newUpgradeState(cfg)
+			state.Phase = tt.phase
+			state.SourceVersion = tt.sourceVersion
+			state.RollbackAttempts = tt.rollbackAttempts
+			state.Attempts = 1
+			writeState(t, state)
+
+			a := startAgent(t, cfg)
+			waitIdle(t, a)
+
+			got := readState(t)
+			if got.Phase != tt.wantPhase || got.RollbackAttempts != tt.wantRollbackAttempts || got.RolledBack != tt.wantRolledBack {
+				t.Errorf("journal = %s after %d rollbacks, rolled back %v, want %s after %d, rolled back %v",
+					got.Phase, got.RollbackAttempts, got.RolledBack, tt.wantPhase, tt.wantRollbackAttempts, tt.wantRolledBack)
+			}
+			if tt.phase == PhaseRebooting && got.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", got.Outcome, tt.wantOutcome)
+			}
+			if !strings.Contains(got.LastError, tt.wantError) {
+				t.Errorf("last error = %q, want it to contain %q", got.LastError, tt.wantError)
+			}
+
+			_, activations, reboots := server.calls()
+			if (activations > 0) != tt.wantActivate || (reboots > 0) != tt.wantReboot {
+				t.Errorf("server got %d activations and %d reboots, want activation %v and reboot %v",
+					activations, reboots, tt.wantActivate, tt.wantReboot)
+			}
+			if tt.wantActivate {
+				if req := server.activations[0]; req.GetVersion() != tt.sourceVersion || !req.GetNoReboot() {
+					t.Errorf("activated %q with no_reboot %v, want %q without a reboot", req.GetVersion(), req.GetNoReboot(), tt.sourceVersion)
+				}
+			}
+			if tt.wantReboot && server.reboots[0].GetMethod() != syspb.RebootMethod_COLD {
+				t.Errorf("rollback reboot method = %v, want COLD", server.reboots[0].GetMethod())
+			}
+		})
+	}
+}
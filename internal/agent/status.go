@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"time"
+
+	"upgrade-agent/internal/config"
+)
+
+// maxProgressLines bounds the firmware update output kept for status queries
+const maxProgressLines = 200
+
+// Status is what the agent is doing and what it last did
+type Status struct {
+	// Config is the current configuration, with secrets redacted
+	Config config.Config `json:"config"`
+	// LastSeenVersion is the version OS.Verify last reported, at LastSeenAt
+	LastSeenVersion string    `json:"lastSeenVersion,omitempty"`
+	LastSeenAt      time.Time `json:"lastSeenAt,omitzero"`
+	// Current is the running job, nil when idle
+	Current *JobStatus `json:"current,omitempty"`
+	// Queued is the job to run next, nil when none is waiting
+	Queued *JobStatus `json:"queued,omitempty"`
+	// Upgrade is the journaled state of the current or last upgrade,
+	// including its phase and last error, nil before the first upgrade
+	Upgrade *UpgradeState `json:"upgrade,omitempty"`
+	// Progress is the latest firmware update output of the current or last
+	// install since the agent started
+	Progress []string `json:"progress"`
+}
+
+// Status reports the current and queued jobs along with the upgrade journal
+func (a *Agent) Status() (Status, error) {
+	a.lock.Lock()
+	status := Status{
+		Config:          a.currentConfig.Redacted(),
+		LastSeenVersion: a.lastSeenVersion,
+		LastSeenAt:      a.lastSeenAt,
+		Progress:        append([]string{}, a.progress...),
+	}
+	if a.current != nil {
+		status.Current = a.current.status()
+	}
+	if a.queued != nil {
+		status.Queued = a.queued.status()
+	}
+	a.lock.Unlock()
+
+	upgrade, err := readUpgradeState()
+	if err != nil {
+		return status, err
+	}
+	if upgrade.TargetVersion != "" {
+		upgrade.Config = upgrade.Config.Redacted()
+		status.Upgrade = &upgrade
+	}
+	return status, nil
+}
+
+// sawVersion remembers the running version OS.Verify reported
+func (a *Agent) sawVersion(version string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.lastSeenVersion = version
+	a.lastSeenAt = time.Now()
+}
+
+// recordProgress keeps a line of firmware update output, dropping the oldest
+// once maxProgressLines are kept
+func (a *Agent) recordProgress(line string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.progress) >= maxProgressLines {
+		a.progress = a.progress[1:]
+	}
+	a.progress = append(a.progress, line)
+}
+
+// resetProgress forgets the output of the previous install
+func (a *Agent) resetProgress() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.progress = nil
+}
@@ -1,87 +1,151 @@
 package agent
 
 import (
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"time"
 
 	"upgrade-agent/internal/config"
+	"upgrade-agent/internal/fileutils"
+	"upgrade-agent/internal/logging"
 )
 
+// upgradeStateFile is the JSON journal recording the progress of the current
+// or last upgrade. It lives on the host's /etc/sonic so it survives the
+// reboot. Tests point it elsewhere.
+var upgradeStateFile = "/etc/sonic/upgrade_agent_state.json"
+
+// Phase identifies how far an upgrade has progressed
+type Phase string
+
 const (
-	// Simple flag file to indicate if post-upgrade check has been completed
-	postUpgradeDoneFile = "/etc/sonic/post_upgrade_done"
+	// PhasePending means the upgrade was accepted but the agent stopped
+	// before it started installing
+	PhasePending Phase = "pending"
+	// PhaseDownloading means the server is fetching a remote image and installing it
+	PhaseDownloading Phase = "downloading"
+	// PhaseInstalling means the server is installing a local image
+	PhaseInstalling Phase = "installing"
+	// PhaseRebooting means the image is installed and a reboot was requested
+	PhaseRebooting Phase = "rebooting"
+	// PhaseVerifying means the switch came back and the new image is being checked
+	PhaseVerifying Phase = "verifying"
+	// PhaseRollingBack means verification failed and the previous image was
+	// activated and rebooted into
+	PhaseRollingBack Phase = "rolling_back"
+	// PhaseDone means the upgrade completed successfully
+	PhaseDone Phase = "done"
+	// PhaseFailed means the upgrade was abandoned, see LastError
+	PhaseFailed Phase = "failed"
+	// PhaseCancelled means the upgrade was stopped before its reboot, by a
+	// newer target version or the agent shutting down
+	PhaseCancelled Phase = "cancelled"
 )
 
-// UpgradeState tracks the current upgrade process state (simplified)
+// UpgradeState tracks the current upgrade process state
 type UpgradeState struct {
-	InProgress    bool
-	TargetVersion string
-	Config        config.Config
+	// ID identifies the upgrade in logs from the install until the
+	// verification after the reboot
+	ID            string        `json:"id,omitempty"`
+	Phase         Phase         `json:"phase"`
+	TargetVersion string        `json:"targetVersion"`
+	SourceVersion string        `json:"sourceVersion,omitempty"`
+	Config        config.Config `json:"config"`
+	StartedAt     time.Time     `json:"startedAt"`
+	UpdatedAt     time.Time     `json:"updatedAt"`
+	Attempts      int           `json:"attempts"`
+	LastError     string        `json:"lastError,omitempty"`
+	// RebootRequestedAt is when the upgrade reboot was requested, for the
+	// reboot duration metric
+	RebootRequestedAt time.Time `json:"rebootRequestedAt,omitzero"`
+
+	// Filled in by post-reboot verification
+	RunningVersion string    `json:"runningVersion,omitempty"`
+	Outcome        Outcome   `json:"outcome,omitempty"`
+	CompletedAt    time.Time `json:"completedAt,omitzero"`
+
+	// Filled in when a failed upgrade is rolled back to SourceVersion
+	RollbackAttempts int  `json:"rollbackAttempts,omitempty"`
+	RolledBack       bool `json:"rolledBack,omitempty"`
 }
 
-// saveUpgradeState marks that an upgrade is in progress
-func saveUpgradeState(state UpgradeState) error {
-	// Just delete the post_upgrade_done file to indicate an upgrade is needed
-	if err := os.Remove(postUpgradeDoneFile); err != nil {
-		if !os.IsNotExist(err) {
-			log.Printf("Failed to remove post upgrade done file: %v", err)
-			return err
-		}
+// InProgress reports whether the upgrade still has work left to do
+func (s UpgradeState) InProgress() bool {
+	switch s.Phase {
+	case PhasePending, PhaseDownloading, PhaseInstalling, PhaseRebooting, PhaseVerifying, PhaseRollingBack:
+		return true
 	}
+	return false
+}
 
-	// Ensure directory exists
-	dir := filepath.Dir(postUpgradeDoneFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		log.Printf("Failed to create state directory: %v", err)
-		return err
+// newUpgradeID returns a random ID for a new upgrade
+func newUpgradeID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logger returns the logger for everything concerning the upgrade
+func (s UpgradeState) logger() *slog.Logger {
+	return slog.Default().With(logging.KeyUpgradeID, s.ID, logging.KeyTargetVersion, s.TargetVersion)
+}
+
+// saveUpgradeState atomically writes the upgrade state to disk
+func saveUpgradeState(state UpgradeState) error {
+	state.UpdatedAt = time.Now()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode upgrade state: %w", err)
+	}
+	if err := fileutils.WriteAtomic(upgradeStateFile, data); err != nil {
+		return fmt.Errorf("failed to save upgrade state: %w", err)
 	}
 
-	log.Printf("Successfully marked upgrade in progress by removing %s", postUpgradeDoneFile)
+	state.logger().Info("Saved upgrade state", logging.KeyPhase, state.Phase, "attempts", state.Attempts)
 	return nil
 }
 
-// loadUpgradeState checks if a post-upgrade verification is needed
+// loadUpgradeState reads the upgrade state from disk. A missing file means no
+// upgrade has ever run and yields a zero state.
 func loadUpgradeState() (UpgradeState, error) {
-	var state UpgradeState
-
-	// Check if the post_upgrade_done file exists
-	_, err := os.Stat(postUpgradeDoneFile)
+	state, err := readUpgradeState()
 	if err != nil {
-		if os.IsNotExist(err) {
-			// File does not exist, post-upgrade check is needed
-			state.InProgress = true
-			log.Printf("Post-upgrade verification needed: %s not found", postUpgradeDoneFile)
-			return state, nil
-		}
-		// Some other error occurred
-		log.Printf("Error checking post upgrade done file: %v", err)
 		return state, err
 	}
+	if state.Phase == "" {
+		slog.Info("No upgrade state found", "path", upgradeStateFile)
+		return state, nil
+	}
+	// Journals written before upgrades had IDs
+	if state.ID == "" {
+		state.ID = newUpgradeID()
+	}
 
-	// File exists, no post-upgrade check needed
-	state.InProgress = false
-	log.Printf("Post-upgrade verification not needed: %s exists", postUpgradeDoneFile)
+	state.logger().Info("Loaded upgrade state", logging.KeyPhase, state.Phase, "attempts", state.Attempts)
 	return state, nil
 }
 
-// clearUpgradeState marks that the post-upgrade check is complete
-func clearUpgradeState() error {
-	// Create an empty file to indicate post-upgrade is done
-	dir := filepath.Dir(postUpgradeDoneFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		log.Printf("Failed to create state directory: %v", err)
-		return err
-	}
+// readUpgradeState is loadUpgradeState without logging, for status queries
+func readUpgradeState() (UpgradeState, error) {
+	var state UpgradeState
 
-	// Create the file
-	f, err := os.Create(postUpgradeDoneFile)
+	data, err := os.ReadFile(upgradeStateFile)
 	if err != nil {
-		log.Printf("Failed to create post upgrade done file: %v", err)
-		return err
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, fmt.Errorf("failed to read upgrade state: %w", err)
 	}
-	defer f.Close()
 
-	log.Printf("Successfully marked post-upgrade complete by creating %s", postUpgradeDoneFile)
-	return nil
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse upgrade state %s: %w", upgradeStateFile, err)
+	}
+	// Journals written by older agents lack the fields added to the config since
+	state.Config = state.Config.WithDefaults()
+	return state, nil
 }
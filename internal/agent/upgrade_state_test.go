@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"upgrade-agent/internal/config"
+)
+
+func TestLoadUpgradeState(t *testing.T) {
+	tests := []struct {
+		name      string
+		journal   string
+		wantPhase Phase
+		wantErr   bool
+		// wantTimeouts are the timeouts of the journaled config
+		wantTimeouts config.Timeouts
+	}{
+		{
+			name:      "no journal",
+			wantPhase: "",
+		},
+		{
+			name: "current format",
+			journal: `{"id": "0123456789abcdef", "phase": "installing", "targetVersion": "2.0", "attempts": 1,
+				"config": {"targetVersion": "2.0", "timeouts": {"rpc": "10s", "update": "1m", "remoteUpdate": "2m", "stabilization": "5s"}}}`,
+			wantPhase:    PhaseInstalling,
+			wantTimeouts: config.Timeouts{RPC: 10 * time.Second, Update: time.Minute, RemoteUpdate: 2 * time.Minute, Stabilization: 5 * time.Second},
+		},
+		{
+			// Older agents wrote no ID, nanosecond timeouts and no remoteUpdate
+			name: "older agent",
+			journal: `{"phase": "rebooting", "targetVersion": "2.0",
+				"config": {"targetVersion": "2.0", "timeouts": {"rpc": 10000000000, "update": 60000000000, "stabilization": 5000000000}}}`,
+			wantPhase:    PhaseRebooting,
+			wantTimeouts: config.Timeouts{RPC: 10 * time.Second, Update: time.Minute, RemoteUpdate: config.DefaultTimeouts.RemoteUpdate, Stabilization: 5 * time.Second},
+		},
+		{
+			name:    "corrupt",
+			journal: `{"phase": `,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempState(t)
+			if tt.journal != "" {
+				if err := os.WriteFile(upgradeStateFile, []byte(tt.journal), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			state, err := loadUpgradeState()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadUpgradeState() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if state.Phase != tt.wantPhase {
+				t.Errorf("phase = %q, want %q", state.Phase, tt.wantPhase)
+			}
+			if tt.wantPhase != "" && (state.ID == "" || state.Config.Timeouts != tt.wantTimeouts) {
+				t.Errorf("state = ID %q timeouts %+v, want an ID and timeouts %+v", state.ID, state.Config.Timeouts, tt.wantTimeouts)
+			}
+		})
+	}
+}
+
+func TestSaveUpgradeState(t *testing.T) {
+	useTempState(t)
+	state := newUpgradeState(config.Config{TargetVersion: "2.0", FirmwareSource: "/images/sonic.bin"}.WithDefaults())
+	state.Phase = PhaseInstalling
+	state.Attempts = 2
+	state.LastError = "connection reset"
+
+	if err := saveUpgradeState(state); err != nil {
+		t.Fatalf("saveUpgradeState() error = %v", err)
+	}
+	got, err := loadUpgradeState()
+	if err != nil {
+		t.Fatalf("loadUpgradeState() error = %v", err)
+	}
+	if got.ID != state.ID || got.Phase != state.Phase || got.Attempts != 2 || got.LastError != state.LastError ||
+		got.Config != state.Config || !got.StartedAt.Equal(state.StartedAt) || got.UpdatedAt.IsZero() {
+		t.Errorf("loaded %+v, want the saved %+v with UpdatedAt set", got, state)
+	}
+}
+
+func TestRecordPhaseHistory(t *testing.T) {
+	useTempState(t)
+	state := newUpgradeState(config.Config{TargetVersion: "2.0"}.WithDefaults())
+
+	for _, phase := range []Phase{PhaseInstalling, PhaseRebooting, PhaseVerifying} {
+		recordPhase(&state, phase)
+	}
+	if history := readHistory(t); len(history) != 0 {
+		t.Fatalf("history = %+v before the upgrade finished, want none", history)
+	}
+
+	for i := 0; i < maxHistoryEntries+1; i++ {
+		recordPhase(&state, PhaseDone)
+	}
+	history := readHistory(t)
+	if len(history) != maxHistoryEntries {
+		t.Errorf("history holds %d entries, want %d", len(history), maxHistoryEntries)
+	}
+	if last := history[len(history)-1]; last.ID != state.ID || last.Phase != PhaseDone || last.TargetVersion != "2.0" {
+		t.Errorf("last history entry = %+v, want the finished upgrade", last)
+	}
+}
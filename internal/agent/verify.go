@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Version match rules accepted in config.Config.VersionMatch
+const (
+	VersionMatchExact    = "exact"
+	VersionMatchPrefix   = "prefix"
+	VersionMatchContains = "contains"
+	VersionMatchRegex    = "regex"
+)
+
+// Outcome describes how post-reboot verification of an upgrade ended
+type Outcome string
+
+const (
+	// OutcomeSucceeded means the switch booted the target version
+	OutcomeSucceeded Outcome = "succeeded"
+	// OutcomeVersionMismatch means the switch booted some other version
+	OutcomeVersionMismatch Outcome = "version_mismatch"
+	// OutcomeActivationFailed means the server reported an activation failure
+	OutcomeActivationFailed Outcome = "activation_failed"
+	// OutcomeVerifyError means the running version could not be retrieved
+	OutcomeVerifyError Outcome = "verify_error"
+	// OutcomeSkipped means OS.Verify is unimplemented and was ignored by config
+	OutcomeSkipped Outcome = "skipped"
+)
+
+// normalizeVersion strips the "SONiC." prefix osservice puts in front of the
+// image name, so a target of "master.858213-545f73f0a" matches a running
+// version of "SONiC.master.858213-545f73f0a"
+func normalizeVersion(version string) string {
+	version = strings.TrimSpace(version)
+	if len(version) >= len("SONiC.") && strings.EqualFold(version[:len("SONiC.")], "SONiC.") {
+		return version[len("SONiC."):]
+	}
+	return version
+}
+
+// versionMatches reports whether the running version satisfies the target
+// version under the given match rule. An empty rule means exact matching.
+func versionMatches(running, target, rule string) (bool, error) {
+	if target == "" {
+		return false, fmt.Errorf("no target version to compare against")
+	}
+
+	switch strings.ToLower(rule) {
+	case "", VersionMatchExact:
+		return normalizeVersion(running) == normalizeVersion(target), nil
+	case VersionMatchPrefix:
+		return strings.HasPrefix(normalizeVersion(running), normalizeVersion(target)), nil
+	case VersionMatchContains:
+		return strings.Contains(running, normalizeVersion(target)), nil
+	case VersionMatchRegex:
+		// The target is used verbatim as a pattern against the raw version
+		re, err := regexp.Compile(target)
+		if err != nil {
+			return false, fmt.Errorf("invalid target version pattern %q: %w", target, err)
+		}
+		return re.MatchString(running), nil
+	default:
+		return false, fmt.Errorf("unknown version match rule %q", rule)
+	}
+}
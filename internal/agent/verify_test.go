@@ -0,0 +1,42 @@
+package agent
+
+import "testing"
+
+func TestVersionMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		running string
+		target  string
+		rule    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "exact", running: "SONiC.master.858213-545f73f0a", target: "master.858213-545f73f0a", rule: "exact", want: true},
+		{name: "exact by default", running: "SONiC.master.858213-545f73f0a", target: "master.858213-545f73f0a", want: true},
+		{name: "exact with prefix on both sides", running: "SONiC.202311.1", target: "SONiC.202311.1", want: true},
+		{name: "exact ignores prefix case and spaces", running: " sonic.202311.1\n", target: "202311.1", want: true},
+		{name: "exact mismatch", running: "SONiC.202311.1", target: "202311.10", want: false},
+		{name: "exact only strips a leading prefix", running: "202311.1", target: "SONiC.202311.1.SONiC", want: false},
+		{name: "rule is case insensitive", running: "SONiC.202311.1", target: "202311.1", rule: "EXACT", want: true},
+		{name: "prefix", running: "SONiC.202311.1-abcdef", target: "202311.1", rule: "prefix", want: true},
+		{name: "prefix mismatch", running: "SONiC.202305.1", target: "202311", rule: "prefix", want: false},
+		{name: "contains", running: "SONiC.master.858213-545f73f0a", target: "858213", rule: "contains", want: true},
+		{name: "contains mismatch", running: "SONiC.master.858213-545f73f0a", target: "858214", rule: "contains", want: false},
+		{name: "regex", running: "SONiC.202311.12-abc", target: `^SONiC\.202311\.\d+-`, rule: "regex", want: true},
+		{name: "regex mismatch", running: "SONiC.202305.1", target: `^SONiC\.202311\.`, rule: "regex", want: false},
+		{name: "invalid regex", running: "SONiC.202311.1", target: "202311.(", rule: "regex", wantErr: true},
+		{name: "unknown rule", running: "SONiC.202311.1", target: "202311.1", rule: "fuzzy", wantErr: true},
+		{name: "no target", running: "SONiC.202311.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := versionMatches(tt.running, tt.target, tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("versionMatches(%q, %q, %q) error = %v, want error %v", tt.running, tt.target, tt.rule, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("versionMatches(%q, %q, %q) = %v, want %v", tt.running, tt.target, tt.rule, got, tt.want)
+			}
+		})
+	}
+}
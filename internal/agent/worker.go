@@ -0,0 +1,282 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"upgrade-agent/internal/logging"
+)
+
+// JobKind identifies the upgrade step a job runs
+type JobKind string
+
+const (
+	// JobUpdate installs a firmware image and reboots into it
+	JobUpdate JobKind = "update"
+	// JobVerify checks the running version after the upgrade reboot
+	JobVerify JobKind = "verify"
+	// JobVerifyRollback checks the running version after a rollback reboot
+	JobVerifyRollback JobKind = "verify_rollback"
+)
+
+// errShutdown is the cancellation cause when the agent stops
+var errShutdown = errors.New("agent shutting down")
+
+// job is one unit of upgrade work run by the worker
+type job struct {
+	id    uint64
+	kind  JobKind
+	state UpgradeState
+	// queuedAt and startedAt are when the job was enqueued and picked up
+	queuedAt  time.Time
+	startedAt time.Time
+	// ctx is cancelled when the job is superseded or the agent stops, but
+	// only until the job is committed to a reboot. A newer target only
+	// cancels update jobs. It carries the job's logger and upgrade ID.
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	committed bool
+}
+
+// JobStatus describes a queued or running upgrade job
+type JobStatus struct {
+	ID            uint64    `json:"id"`
+	Kind          JobKind   `json:"kind"`
+	TargetVersion string    `json:"targetVersion"`
+	QueuedAt      time.Time `json:"queuedAt"`
+	StartedAt     time.Time `json:"startedAt,omitzero"`
+	// Cancelling is set once the job was told to stop but has not yet
+	Cancelling bool `json:"cancelling,omitempty"`
+}
+
+// status describes the job
+func (j *job) status() *JobStatus {
+	return &JobStatus{
+		ID:            j.id,
+		Kind:          j.kind,
+		TargetVersion: j.state.TargetVersion,
+		QueuedAt:      j.queuedAt,
+		StartedAt:     j.startedAt,
+		Cancelling:    j.ctx.Err() != nil,
+	}
+}
+
+// jobLogger returns the logger for the work of a job
+func jobLogger(id uint64, kind JobKind, state UpgradeState) *slog.Logger {
+	return state.logger().With("job_id", id, "job", kind)
+}
+
+// enqueueLocked queues an upgrade job. There is only ever one job waiting:
+// a newer job replaces the waiting one, and cancels the running update if
+// it has not requested its reboot yet. Called with a.lock held.
+func (a *Agent) enqueueLocked(kind JobKind, state UpgradeState) {
+	if a.shuttingDown {
+		state.logger().Info("Not starting job, the agent is shutting down", "job", kind)
+		return
+	}
+	a.nextJobID++
+	logger := jobLogger(a.nextJobID, kind, state)
+	// The upgrade ID goes with every RPC of the job, so the server logs can
+	// be matched with the agent's
+	ctx := logging.WithUpgradeID(logging.WithLogger(context.Background(), logger), state.ID)
+	ctx, cancel := context.WithCancelCause(ctx)
+	j := &job{
+		id:       a.nextJobID,
+		kind:     kind,
+		state:    state,
+		queuedAt: time.Now(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	if a.queued != nil {
+		logging.FromContext(a.queued.ctx).Info("Job superseded before it started", "superseded_by", j.id)
+		a.queued.cancel(fmt.Errorf("superseded by target version %s", j.state.TargetVersion))
+	}
+	a.queued = j
+
+	if cur := a.current; cur != nil {
+		if cur.kind == JobUpdate && !cur.committed && cur.ctx.Err() == nil {
+			logging.FromContext(cur.ctx).Info("Cancelling job in favor of a newer target version",
+				"superseded_by", j.id, "new_target_version", j.state.TargetVersion)
+			cur.cancel(fmt.Errorf("superseded by target version %s", j.state.TargetVersion))
+		} else {
+			logger.Info("Job queued until the running job finishes", "running_job_id", cur.id)
+		}
+	}
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work runs queued jobs one at a time until the agent shuts down
+func (a *Agent) work() {
+	defer close(a.stopped)
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-a.wake:
+		}
+
+		for {
+			a.lock.Lock()
+			j := a.queued
+			a.queued = nil
+			if j != nil && a.shuttingDown {
+				j = nil
+			}
+			if j != nil {
+				j.startedAt = time.Now()
+				a.current = j
+			}
+			a.lock.Unlock()
+			if j == nil {
+				break
+			}
+
+			logger := logging.FromContext(j.ctx)
+			logger.Info("Starting job")
+			upgradeInProgress.Set(1)
+			a.runJob(j)
+			upgradeInProgress.Set(0)
+			logger.Info("Finished job", "duration", time.Since(j.startedAt).Round(time.Second))
+
+			a.lock.Lock()
+			a.current = nil
+			j.cancel(nil)
+			// Catch up with a target version that has no job, such as one
+			// dropped by a shutdown while the previous target was rebooting
+			if a.queued == nil && !a.shuttingDown && j.state.TargetVersion != a.currentConfig.TargetVersion {
+				logger.Info("Configured target version differs from the finished job, starting update",
+					"configured_target_version", a.currentConfig.TargetVersion)
+				a.enqueueLocked(JobUpdate, newUpgradeState(a.currentConfig))
+			}
+			// Apply a connection change that waited for the job
+			if a.pendingConn != nil {
+				a.reconnectLocked(*a.pendingConn)
+			}
+			a.lock.Unlock()
+		}
+	}
+}
+
+// runJob runs the upgrade step of a job
+func (a *Agent) runJob(j *job) {
+	switch j.kind {
+	case JobUpdate:
+		a.performUpdate(j.ctx, j.state)
+	case JobVerify:
+		a.performPostRebootVerification(j.ctx, j.state)
+	case JobVerifyRollback:
+		a.verifyRollback(j.ctx, j.state)
+	}
+}
+
+// commitReboot makes the running job uncancellable before it requests a
+// reboot. It fails if the job was cancelled first, in which case the reboot
+// must not be requested.
+func (a *Agent) commitReboot(ctx context.Context) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return context.Cause(ctx)
+	}
+	if a.current != nil && a.current.ctx == ctx {
+		a.current.committed = true
+	}
+	return nil
+}
+
+// Shutdown stops the worker. A running job that is not committed to a
+// reboot is cancelled, leaving its phase in the upgrade state for the next
+// start to resume; a committed one is given up to timeout to finish
+// requesting its reboot. A job still waiting to run is dropped. A new update
+// dropped this way is journaled as pending once the worker has stopped, so
+// the next start runs it; behind a committed job it is left to the catch-up
+// after the next start's verification.
+func (a *Agent) Shutdown(timeout time.Duration) {
+	a.lock.Lock()
+	if a.shuttingDown {
+		a.lock.Unlock()
+		return
+	}
+	a.shuttingDown = true
+	close(a.done)
+	dropped := a.queued
+	if a.current != nil && a.current.committed {
+		// The journal belongs to the reboot under way
+		dropped = nil
+	}
+	if j := a.queued; j != nil {
+		logging.FromContext(j.ctx).Info("Dropping job that has not started")
+		j.cancel(errShutdown)
+		a.queued = nil
+	}
+	if j := a.current; j != nil {
+		logger := logging.FromContext(j.ctx)
+		if j.committed {
+			logger.Info("Waiting for the job to finish its reboot request", "timeout", timeout)
+		} else {
+			logger.Info("Stopping job")
+			j.cancel(errShutdown)
+		}
+	}
+	stopped := a.stopped
+	a.lock.Unlock()
+
+	if stopped == nil {
+		return
+	}
+	select {
+	case <-stopped:
+		slog.Info("Upgrade worker stopped")
+		journalDropped(dropped)
+	case <-time.After(timeout):
+		slog.Warn("Upgrade worker still busy, the next start resumes from the saved upgrade state", "timeout", timeout)
+	}
+}
+
+// journalDropped records an update dropped by Shutdown before it started as
+// pending, after the running job has written its last phase. Jobs resumed
+// from the journal are already in it.
+func journalDropped(j *job) {
+	if j == nil || j.kind != JobUpdate || j.state.Phase != "" {
+		return
+	}
+	logging.FromContext(j.ctx).Info("Journaling job that has not started, the next start runs it")
+	recordPhase(&j.state, PhasePending)
+}
+
+// cancelledUpgrade records an upgrade abandoned because its job was
+// cancelled and reports whether that happened. It is checked after every
+// failing step, since a cancelled context surfaces as an RPC error. An
+// upgrade stopped by a shutdown keeps its journaled phase so the next start
+// resumes it.
+func cancelledUpgrade(ctx context.Context, state *UpgradeState) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	cause := context.Cause(ctx)
+	logger := logging.FromContext(ctx)
+	if errors.Is(cause, errShutdown) {
+		logger.Info("Upgrade interrupted by shutdown", logging.KeyPhase, state.Phase)
+		if state.Phase == "" {
+			// Not journaled yet, record it so it is not forgotten. The
+			// install never started, so this was no attempt.
+			state.Attempts--
+			recordPhase(state, PhasePending)
+		}
+		return true
+	}
+	logger.Info("Upgrade cancelled", logging.KeyPhase, state.Phase, "cause", cause)
+	state.LastError = "cancelled: " + cause.Error()
+	recordPhase(state, PhaseCancelled)
+	return true
+}
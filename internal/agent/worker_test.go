@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	gnoisonic "upgrade-agent/gnoi_sonic"
+)
+
+// blockFirstUpdate makes the server hold the first firmware update until the
+// agent gives up on it, and lets later ones succeed
+func blockFirstUpdate(n int, stream grpc.BidiStreamingServer[gnoisonic.UpdateFirmwareRequest, gnoisonic.UpdateFirmwareStatus]) error {
+	if n == 1 {
+		<-stream.Context().Done()
+		return stream.Context().Err()
+	}
+	return stream.Send(&gnoisonic.UpdateFirmwareStatus{
+		LogLine: "Firmware update completed successfully",
+		State:   gnoisonic.UpdateFirmwareStatus_SUCCEEDED,
+	})
+}
+
+// waitStatus waits until the agent's status satisfies cond
+func waitStatus(t *testing.T, a *Agent, what string, cond func(Status) bool) {
+	t.Helper()
+	waitFor(t, what, func() bool {
+		status, _ := a.Status()
+		return cond(status)
+	})
+}
+
+func TestNewTargetCancelsRunningUpdate(t *testing.T) {
+	useTempState(t)
+	server := newFakeServer(t, "SONiC.1.0")
+	server.updateFirmware = blockFirstUpdate
+	cfg := testConfig(server, "1.0")
+	a := startAgent(t, cfg)
+
+	cfg.TargetVersion = "2.0"
+	a.UpdateConfig(cfg)
+	<-server.updateStarted
+	waitStatus(t, a, "the 2.0 install to run", func(s Status) bool {
+		return s.Current != nil && s.Current.Kind == JobUpdate && s.Current.TargetVersion == "2.0"
+	})
+
+	cfg.TargetVersion = "3.0"
+	a.UpdateConfig(cfg)
+	waitIdle(t, a)
+
+	history := readHistory(t)
+	if len(history) != 1 || history[0].TargetVersion != "2.0" || history[0].Phase != PhaseCancelled {
+		t.Fatalf("history = %+v, want the 2.0 upgrade cancelled", history)
+	}
+	if !strings.Contains(history[0].LastError, "superseded by target version 3.0") {
+		t.Errorf("cancelled upgrade error = %q, want it superseded by 3.0", history[0].LastError)
+	}
+	state := readState(t)
+	if state.TargetVersion != "3.0" || state.Phase != PhaseRebooting {
+		t.Errorf("journal = %s %s, want 3.0 rebooting", state.TargetVersion, state.Phase)
+	}
+	if updates, _, reboots := server.calls(); updates != 2 || reboots != 1 {
+		t.Errorf("server got %d updates and %d reboots, want 2 updates and only the 3.0 reboot", updates, reboots)
+	}
+}
+
+func TestNewTargetSupersedesQueuedJob(t *testing.T) {
+	useTempState(t)
+	server := newFakeServer(t, "SONiC.2.0")
+	gate := make(chan struct{})
+	server.verifyGate = gate
+	cfg := testConfig(server, "2.0")
+	state := newUpgradeState(cfg)
+	state.Phase = PhaseRebooting
+	state.Attempts = 1
+	writeState(t, state)
+
+	a := startAgent(t, cfg)
+	waitStatus(t, a, "the verification to run", func(s Status) bool {
+		return s.Current != nil && s.Current.Kind == JobVerify
+	})
+
+	// A verification is not cancelled by a new target, which waits for it
+	for _, target := range []string{"3.0", "4.0"} {
+		cfg.TargetVersion = target
+		a.UpdateConfig(cfg)
+	}
+	status, _ := a.Status()
+	if status.Current == nil || status.Current.Cancelling {
+		t.Errorf("running job = %+v, want the verification left running", status.Current)
+	}
+	if status.Queued == nil || status.Queued.TargetVersion != "4.0" {
+		t.Errorf("queued job = %+v, want the 4.0 update replacing the 3.0 one", status.Queued)
+	}
+
+	close(gate)
+	waitIdle(t, a)
+
+	history := readHistory(t)
+	if len(history) != 1 || history[0].ID != state.ID || history[0].Phase != PhaseDone {
+		t.Errorf("history = %+v, want the 2.0 upgrade done", history)
+	}
+	if got := readState(t); got.TargetVersion != "4.0" || got.Phase != PhaseRebooting {
+		t.Errorf("journal = %s %s, want 4.0 rebooting", got.TargetVersion, got.Phase)
+	}
+	if updates, _, _ := server.calls(); updates != 1 || server.updates[0].GetFirmwareSource() != cfg.FirmwareSource {
+		t.Errorf("server got %d firmware updates, want only the one for 4.0", updates)
+	}
+}
+
+func TestShutdownDuringInstall(t *testing.T) {
+	useTempState(t)
+	server := newFakeServer(t, "SONiC.1.0")
+	server.updateFirmware = blockFirstUpdate
+	cfg := testConfig(server, "1.0")
+	a := startAgent(t, cfg)
+
+	cfg.TargetVersion = "2.0"
+	a.UpdateConfig(cfg)
+	<-server.updateStarted
+	a.Shutdown(5 * time.Second)
+
+	state := readState(t)
+	if state.Phase != PhaseInstalling || state.TargetVersion != "2.0" || state.Attempts != 1 {
+		t.Fatalf("journal after shutdown = %s %s after %d attempts, want 2.0 installing after 1",
+			state.Phase, state.TargetVersion, state.Attempts)
+	}
+	if _, _, reboots := server.calls(); reboots != 0 {
+		t.Errorf("server got %d reboots from an interrupted install, want none", reboots)
+	}
+
+	// The next start restarts the install of the same upgrade
+	a = startAgent(t, cfg)
+	waitIdle(t, a)
+	got := readState(t)
+	if got.ID != state.ID || got.Phase != PhaseRebooting || got.Attempts != 2 {
+		t.Errorf("journal after restart = %s %s after %d attempts, want upgrade %s rebooting after 2",
+			got.ID, got.Phase, got.Attempts, state.ID)
+	}
+}
+
+func TestShutdownJournalsDroppedUpdate(t *testing.T) {
+	useTempState(t)
+	server := newFakeServer(t, "SONiC.2.0")
+	server.verifyGate = make(chan struct{})
+	cfg := testConfig(server, "2.0")
+	state := newUpgradeState(cfg)
+	state.Phase = PhaseRebooting
+	state.Attempts = 1
+	writeState(t, state)
+
+	a := startAgent(t, cfg)
+	waitStatus(t, a, "the verification to run", func(s Status) bool {
+		return s.Current != nil && s.Current.Kind == JobVerify
+	})
+	cfg.TargetVersion = "3.0"
+	a.UpdateConfig(cfg)
+	a.Shutdown(5 * time.Second)
+
+	got := readState(t)
+	if got.TargetVersion != "3.0" || got.Phase != PhasePending || got.Attempts != 0 {
+		t.Fatalf("journal after shutdown = %s %s after %d attempts, want 3.0 pending", got.TargetVersion, got.Phase, got.Attempts)
+	}
+	if updates, _, _ := server.calls(); updates != 0 {
+		t.Errorf("server got %d firmware updates, want the dropped update not started", updates)
+	}
+
+	// The next start runs the dropped update
+	server.lock.Lock()
+	server.verifyGate = nil
+	server.lock.Unlock()
+	a = startAgent(t, cfg)
+	waitIdle(t, a)
+	if got := readState(t); got.TargetVersion != "3.0" || got.Phase != PhaseRebooting {
+		t.Errorf("journal after restart = %s %s, want 3.0 rebooting", got.TargetVersion, got.Phase)
+	}
+}
@@ -0,0 +1,83 @@
+// Package bootloader manages the installed SONiC images and the image booted next
+package bootloader
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"upgrade-agent/internal/executor"
+)
+
+// Images describes the images known to the bootloader
+type Images struct {
+	// Current is the image the system is running
+	Current string
+	// Next is the image that will be booted on the next reboot
+	Next string
+	// Available lists every installed image, including Current and Next
+	Available []string
+}
+
+// ImageDetails describes the disk footprint of an installed image
+type ImageDetails struct {
+	// SizeBytes is the disk space used by the image, 0 if unknown
+	SizeBytes uint64 `json:"sizeBytes"`
+	// InstalledAt is when the image was installed, zero if unknown
+	InstalledAt time.Time `json:"installedAt"`
+}
+
+// Bootloader is implemented by the backends that can inspect and change the
+// installed images
+type Bootloader interface {
+	// ListImages returns the installed images
+	ListImages() (Images, error)
+	// ImageDetails returns size and install time of an installed image
+	ImageDetails(image string) (ImageDetails, error)
+	// InstallImage installs the image file at path as the given version
+	InstallImage(version, path string) error
+	// SetNextBoot makes the installed image the one booted next
+	SetNextBoot(image string) error
+	// RemoveImage uninstalls an image. Callers must not remove the current
+	// or next-boot image.
+	RemoveImage(image string) error
+}
+
+// New creates the bootloader backend with the given name. "sonic-installer"
+// drives the real bootloader on the host through hostExecutor, "file" keeps
+// the images in a JSON file at path and is meant for testing on machines that
+// are not switches.
+func New(name, path string, hostExecutor executor.Executor) (Bootloader, error) {
+	switch name {
+	case "", "sonic-installer":
+		return NewSonicInstaller(nil, "", hostExecutor), nil
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("the file bootloader requires a state file path")
+		}
+		return NewFileBootloader(path), nil
+	default:
+		return nil, fmt.Errorf("unknown bootloader %q", name)
+	}
+}
+
+// FindImage returns the installed image matching version, ignoring the
+// "SONiC-OS-" and "SONiC." prefixes used by sonic-installer and OS.Verify
+func (i Images) FindImage(version string) (string, bool) {
+	for _, image := range i.Available {
+		if TrimVersionPrefix(image) == TrimVersionPrefix(version) {
+			return image, true
+		}
+	}
+	return "", false
+}
+
+// TrimVersionPrefix strips a leading "SONiC-OS-" or "SONiC."
+func TrimVersionPrefix(version string) string {
+	for _, prefix := range []string{"SONiC-OS-", "SONiC."} {
+		if strings.HasPrefix(version, prefix) {
+			return version[len(prefix):]
+		}
+	}
+	return version
+}
@@ -0,0 +1,161 @@
+package bootloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileBootloader is a fake Bootloader that keeps its images in a JSON file.
+// It lets OS.Activate and friends run on a plain Linux box.
+type FileBootloader struct {
+	path string
+	lock sync.Mutex
+}
+
+// fileState is the JSON layout of the FileBootloader state file
+type fileState struct {
+	Current   string                  `json:"current"`
+	Next      string                  `json:"next"`
+	Available []string                `json:"available"`
+	Details   map[string]ImageDetails `json:"details,omitempty"`
+}
+
+// images returns the bootloader view of the state
+func (s fileState) images() Images {
+	return Images{Current: s.Current, Next: s.Next, Available: s.Available}
+}
+
+// NewFileBootloader creates a FileBootloader backed by the file at path
+func NewFileBootloader(path string) *FileBootloader {
+	return &FileBootloader{path: path}
+}
+
+// ListImages implements Bootloader
+func (f *FileBootloader) ListImages() (Images, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	state, err := f.load()
+	if err != nil {
+		return Images{}, err
+	}
+	return state.images(), nil
+}
+
+// InstallImage implements Bootloader by recording the version as installed
+func (f *FileBootloader) InstallImage(version, path string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("image %s not found: %w", path, err)
+	}
+
+	state, err := f.load()
+	if err != nil {
+		return err
+	}
+	// Name the image the way sonic-installer does
+	if _, ok := state.images().FindImage(version); !ok {
+		image := "SONiC-OS-" + TrimVersionPrefix(version)
+		state.Available = append(state.Available, image)
+
+		var size uint64
+		if info, err := os.Stat(path); err == nil {
+			size = uint64(info.Size())
+		}
+		if state.Details == nil {
+			state.Details = make(map[string]ImageDetails)
+		}
+		state.Details[image] = ImageDetails{SizeBytes: size, InstalledAt: time.Now()}
+	}
+	slog.Info("Fake bootloader: installed image", "version", version, "path", path)
+	return f.save(state)
+}
+
+// SetNextBoot implements Bootloader
+func (f *FileBootloader) SetNextBoot(image string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	state, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := state.images().FindImage(image); !ok {
+		return fmt.Errorf("image %s is not installed", image)
+	}
+	state.Next = image
+	slog.Info("Fake bootloader: next boot set", "image", image)
+	return f.save(state)
+}
+
+// ImageDetails implements Bootloader
+func (f *FileBootloader) ImageDetails(image string) (ImageDetails, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	state, err := f.load()
+	if err != nil {
+		return ImageDetails{}, err
+	}
+	if _, ok := state.images().FindImage(image); !ok {
+		return ImageDetails{}, fmt.Errorf("image %s is not installed", image)
+	}
+	return state.Details[image], nil
+}
+
+// RemoveImage implements Bootloader
+func (f *FileBootloader) RemoveImage(image string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	state, err := f.load()
+	if err != nil {
+		return err
+	}
+
+	available := state.Available[:0]
+	found := false
+	for _, name := range state.Available {
+		if name == image {
+			found = true
+			continue
+		}
+		available = append(available, name)
+	}
+	if !found {
+		return fmt.Errorf("image %s is not installed", image)
+	}
+	state.Available = available
+	delete(state.Details, image)
+
+	slog.Info("Fake bootloader: removed image", "image", image)
+	return f.save(state)
+}
+
+// load reads the state file
+func (f *FileBootloader) load() (fileState, error) {
+	var state fileState
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return state, fmt.Errorf("failed to read bootloader state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse bootloader state %s: %w", f.path, err)
+	}
+	return state, nil
+}
+
+// save writes the state file
+func (f *FileBootloader) save(state fileState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.path, data, 0644)
+}
@@ -0,0 +1,162 @@
+package bootloader
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"upgrade-agent/internal/executor"
+)
+
+// DefaultSonicInstallerCommand is how sonic-installer is invoked
+var DefaultSonicInstallerCommand = []string{"sonic-installer"}
+
+// DefaultImageRoot is where the image directories live when the host root
+// filesystem is mounted at /host: SONiC keeps each image in /host/image-<version>
+const DefaultImageRoot = "/host/host"
+
+// SonicInstaller is the Bootloader backed by the sonic-installer CLI, which
+// handles both GRUB and U-Boot platforms
+type SonicInstaller struct {
+	command   []string
+	imageRoot string
+	executor  executor.Executor
+}
+
+// NewSonicInstaller creates a SonicInstaller that runs the given command
+// (DefaultSonicInstallerCommand if empty) with sonic-installer subcommands
+// through hostExecutor (locally if nil) and finds image directories under
+// imageRoot (DefaultImageRoot if empty)
+func NewSonicInstaller(command []string, imageRoot string, hostExecutor executor.Executor) *SonicInstaller {
+	if len(command) == 0 {
+		command = DefaultSonicInstallerCommand
+	}
+	if imageRoot == "" {
+		imageRoot = DefaultImageRoot
+	}
+	if hostExecutor == nil {
+		hostExecutor = executor.Local{}
+	}
+	return &SonicInstaller{command: command, imageRoot: imageRoot, executor: hostExecutor}
+}
+
+// ListImages implements Bootloader by parsing `sonic-installer list`
+func (s *SonicInstaller) ListImages() (Images, error) {
+	out, err := s.run("list")
+	if err != nil {
+		return Images{}, err
+	}
+	return parseList(out)
+}
+
+// InstallImage implements Bootloader. sonic-installer also makes the new
+// image the default, so the previous next-boot image is restored afterwards
+// and activation stays a separate step.
+func (s *SonicInstaller) InstallImage(version, path string) error {
+	before, err := s.ListImages()
+	if err != nil {
+		return err
+	}
+	if _, err := s.run("install", "-y", s.executor.HostPath(path)); err != nil {
+		return err
+	}
+	if before.Next != "" {
+		return s.SetNextBoot(before.Next)
+	}
+	return nil
+}
+
+// SetNextBoot implements Bootloader
+func (s *SonicInstaller) SetNextBoot(image string) error {
+	_, err := s.run("set-next-boot", image)
+	return err
+}
+
+// RemoveImage implements Bootloader
+func (s *SonicInstaller) RemoveImage(image string) error {
+	_, err := s.run("remove", "-y", image)
+	return err
+}
+
+// ImageDetails implements Bootloader by inspecting the image directory
+func (s *SonicInstaller) ImageDetails(image string) (ImageDetails, error) {
+	dir := filepath.Join(s.imageRoot, "image-"+TrimVersionPrefix(image))
+	info, err := os.Stat(dir)
+	if err != nil {
+		return ImageDetails{}, fmt.Errorf("failed to inspect image %s: %w", image, err)
+	}
+
+	var size uint64
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += uint64(fi.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return ImageDetails{}, fmt.Errorf("failed to measure image %s: %w", image, err)
+	}
+
+	// The image directory is created by the installer and not touched after
+	return ImageDetails{SizeBytes: size, InstalledAt: info.ModTime()}, nil
+}
+
+// run executes a sonic-installer subcommand and returns its output
+func (s *SonicInstaller) run(args ...string) (string, error) {
+	cmdArgs := append(append([]string{}, s.command[1:]...), args...)
+	slog.Debug("Running sonic-installer", "command", s.command[0]+" "+strings.Join(cmdArgs, " "))
+
+	out, err := executor.Output(context.Background(), s.executor, executor.Command{Name: s.command[0], Args: cmdArgs})
+	if err != nil {
+		return "", fmt.Errorf("sonic-installer %s failed: %w", strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+// parseList parses the output of `sonic-installer list`:
+//
+//	Current: SONiC-OS-master.858213-545f73f0a
+//	Next: SONiC-OS-master.858213-545f73f0a
+//	Available:
+//	SONiC-OS-master.858213-545f73f0a
+//	SONiC-OS-202311.125362094-44bd097e78
+func parseList(out string) (Images, error) {
+	var images Images
+	inAvailable := false
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "Current:"):
+			images.Current = strings.TrimSpace(strings.TrimPrefix(line, "Current:"))
+			inAvailable = false
+		case strings.HasPrefix(line, "Next:"):
+			images.Next = strings.TrimSpace(strings.TrimPrefix(line, "Next:"))
+			inAvailable = false
+		case strings.HasPrefix(line, "Available:"):
+			inAvailable = true
+		case inAvailable:
+			images.Available = append(images.Available, line)
+		}
+	}
+
+	if images.Current == "" || len(images.Available) == 0 {
+		return images, fmt.Errorf("unexpected sonic-installer list output: %q", out)
+	}
+	return images, nil
+}
@@ -1,44 +1,103 @@
 package config
 
 import (
-	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
-	"gopkg.in/yaml.v3"
+	"upgrade-agent/internal/logging"
+	"upgrade-agent/internal/metrics"
+
+	"github.com/fsnotify/fsnotify"
 )
 
+// configReloads counts the reloads that changed the config or were rejected
+var configReloads = metrics.NewCounter("upgrade_agent_config_reloads_total",
+	"Config file reloads that changed the config (success) or were rejected (failure)", "result")
+
 // Config holds the application configuration loaded from YAML
 type Config struct {
-	GrpcTarget              string `yaml:"grpcTarget"`
-	FirmwareSource          string `yaml:"firmwareSource"`
-	UpdateMlnxCpldFw        string `yaml:"updateMlnxCpldFw"`
-	TargetVersion           string `yaml:"targetVersion"`
-	IgnoreUnimplementedRPC  bool   `yaml:"ignoreUnimplementedRPC"`  // When true, treat "unimplemented" gRPC errors as success
+	Version                 int    `yaml:"version" json:"version"`                                // Schema version, CurrentVersion if omitted
+	GrpcTarget              string `yaml:"grpcTarget" json:"grpcTarget"`
+	FirmwareSource          string `yaml:"firmwareSource" json:"firmwareSource"`
+	FirmwareSHA256          string `yaml:"firmwareSha256" json:"firmwareSha256"`                  // Optional hex SHA-256 the server checks the image against before installing
+	UpdateMlnxCpldFw        bool   `yaml:"updateMlnxCpldFw" json:"updateMlnxCpldFw"`
+	TargetVersion           string `yaml:"targetVersion" json:"targetVersion"`
+	IgnoreUnimplementedRPC  bool   `yaml:"ignoreUnimplementedRPC" json:"ignoreUnimplementedRPC"`  // When true, treat "unimplemented" gRPC errors as success
+	VersionMatch            string `yaml:"versionMatch" json:"versionMatch"`                      // How the running version is compared to TargetVersion: exact (default), prefix, contains or regex
+	RebootMethod            string `yaml:"rebootMethod" json:"rebootMethod"`                      // Reboot after installing: cold, warm or fast; cold if empty
+	LogLevel                string `yaml:"logLevel" json:"logLevel"`                              // Minimum level logged: debug, info, warn or error; LOG_LEVEL or info if empty
+
+	// TLS settings of the connection to GrpcTarget. TLS is used when TLSEnabled
+	// is set or any of the files is given.
+	TLSEnabled    bool   `yaml:"tlsEnabled" json:"tlsEnabled"`
+	TLSCAFile     string `yaml:"tlsCAFile" json:"tlsCAFile"`         // CA bundle the server certificate is verified against, system roots if empty
+	TLSCertFile   string `yaml:"tlsCertFile" json:"tlsCertFile"`     // Client certificate for mutual TLS
+	TLSKeyFile    string `yaml:"tlsKeyFile" json:"tlsKeyFile"`       // Client private key for mutual TLS
+	TLSServerName string `yaml:"tlsServerName" json:"tlsServerName"` // Name expected in the server certificate, the GrpcTarget host if empty
+
+	AuthTokenFile string `yaml:"authTokenFile" json:"authTokenFile"` // File holding a bearer token sent with every RPC, for servers with an authz policy
+
+	Timeouts Timeouts `yaml:"timeouts" json:"timeouts"`
 }
 
+// UseTLS reports whether the connection to GrpcTarget uses TLS
+func (c Config) UseTLS() bool {
+	return c.TLSEnabled || c.TLSCAFile != "" || c.TLSCertFile != "" || c.TLSKeyFile != ""
+}
+
+// EffectiveRebootMethod returns the reboot method used after installing: the
+// explicit RebootMethod, or a cold reboot as before reboot methods could be
+// chosen. A CPLD update needs the cold reboot anyway.
+func (c Config) EffectiveRebootMethod() string {
+	if c.RebootMethod != "" {
+		return strings.ToLower(c.RebootMethod)
+	}
+	return "cold"
+}
+
+// pollInterval is how often the config file is checked when it cannot be
+// watched for events
+const pollInterval = 10 * time.Second
+
+// reloadDelay collects the burst of events a single update causes, such as a
+// ConfigMap swapping its ..data symlink, into one reload
+const reloadDelay = 200 * time.Millisecond
+
 // Manager handles loading and watching configuration
 type Manager struct {
-	configPath   string
-	currentCfg   Config
-	lock         sync.RWMutex
-	lastModified time.Time
-	onUpdate     func(cfg Config)
+	configPath string
+	overrides  Overrides
+	currentCfg Config
+	lock       sync.RWMutex
+	onUpdate   func(cfg Config, changes []Change)
+	done       chan struct{}
+	closeOnce  sync.Once
+	// watchers tracks the watch or poll goroutine so Close can wait for it
+	watchers sync.WaitGroup
 }
 
-// NewManager creates a new config manager
-func NewManager(configPath string, onUpdate func(cfg Config)) (*Manager, error) {
+// NewManager creates a new config manager. overrides take precedence over
+// the file on every load. The configuration must be valid. onUpdate is
+// called with the new configuration and what changed whenever the file
+// changes to a different valid configuration.
+func NewManager(configPath string, overrides Overrides, onUpdate func(cfg Config, changes []Change)) (*Manager, error) {
 	m := &Manager{
 		configPath: configPath,
+		overrides:  overrides,
 		onUpdate:   onUpdate,
+		done:       make(chan struct{}),
 	}
 
 	// Initial load
-	if err := m.loadConfig(); err != nil {
+	cfg, err := m.readConfig()
+	if err != nil {
 		return nil, err
 	}
+	m.currentCfg = cfg
+	slog.Info("Effective config", "config", cfg.Describe(overrides))
 
 	return m, nil
 }
@@ -50,60 +109,119 @@ func (m *Manager) GetConfig() Config {
 	return m.currentCfg
 }
 
-// loadConfig reads and parses the configuration file
-func (m *Manager) loadConfig() error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// readConfig reads, parses and validates the configuration file
+func (m *Manager) readConfig() (Config, error) {
+	return Load(m.configPath, m.overrides)
+}
 
-	fileInfo, err := os.Stat(m.configPath)
+// reload rereads the configuration and reports it to onUpdate if it changed.
+// An invalid configuration is rejected and the last good one stays in use.
+func (m *Manager) reload() {
+	newCfg, err := m.readConfig()
 	if err != nil {
-		return fmt.Errorf("failed to stat config file: %w", err)
+		slog.Error("Rejected config update, keeping the current config", "path", m.configPath, logging.Err(err))
+		configReloads.Inc("failure")
+		return
 	}
 
-	// Skip if file hasn't been modified
-	modTime := fileInfo.ModTime()
-	if !modTime.After(m.lastModified) {
-		return nil
+	m.lock.Lock()
+	changes := Diff(m.currentCfg, newCfg)
+	if len(changes) > 0 {
+		m.currentCfg = newCfg
 	}
+	m.lock.Unlock()
 
-	data, err := os.ReadFile(m.configPath)
-	if err != nil {
-		return fmt.Errorf("failed to read config file: %w", err)
+	if len(changes) == 0 {
+		return
 	}
-
-	var newCfg Config
-	if err := yaml.Unmarshal(data, &newCfg); err != nil {
-		return fmt.Errorf("failed to parse config file: %w", err)
+	configReloads.Inc("success")
+	for _, change := range changes {
+		change = change.Redacted()
+		slog.Info("Config changed", "field", change.Field,
+			"old", formatValue(change.Old), "new", formatValue(change.New))
+	}
+	slog.Info("Effective config", "config", newCfg.Describe(m.overrides))
+	if m.onUpdate != nil {
+		m.onUpdate(newCfg, changes)
 	}
+}
 
-	// Update the config and last modified time
-	m.currentCfg = newCfg
-	m.lastModified = modTime
+// StartWatcher starts watching the config file for changes. The directory is
+// watched rather than the file, which catches editors replacing the file and
+// Kubernetes swapping the ..data symlink of a mounted ConfigMap. If events
+// are unavailable the file is polled every 10 seconds instead.
+func (m *Manager) StartWatcher() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(filepath.Dir(m.configPath)); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		slog.Warn("Cannot watch config file, polling it instead", "path", m.configPath, "interval", pollInterval, logging.Err(err))
+		m.watchers.Add(1)
+		go m.poll()
+		return nil
+	}
 
+	slog.Info("Watching config file for changes", "path", m.configPath)
+	m.watchers.Add(1)
+	go m.watch(watcher)
 	return nil
 }
 
-// StartWatcher starts polling the config file for changes every 10 seconds
-func (m *Manager) StartWatcher() error {
-	log.Printf("Started polling config file every 10 seconds: %s", m.configPath)
-
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
+// Close stops the watcher and waits for a reload in progress to finish, so
+// onUpdate is not called once Close returns
+func (m *Manager) Close() {
+	m.closeOnce.Do(func() { close(m.done) })
+	m.watchers.Wait()
+}
 
-		for range ticker.C {
-			// Check for changes and reload if needed
-			if err := m.loadConfig(); err != nil {
-				log.Printf("Error reloading config: %v", err)
+// watch reloads the config after events that may have changed it
+func (m *Manager) watch(watcher *fsnotify.Watcher) {
+	defer m.watchers.Done()
+	defer watcher.Close()
+
+	name := filepath.Base(m.configPath)
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			base := filepath.Base(event.Name)
+			if base != name && base != "..data" {
 				continue
 			}
-
-			// Call the callback with the new config
-			if m.onUpdate != nil {
-				m.onUpdate(m.GetConfig())
+			timer.Reset(reloadDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
 			}
+			slog.Warn("Config watcher error", logging.Err(err))
+		case <-timer.C:
+			m.reload()
 		}
-	}()
+	}
+}
 
-	return nil
+// poll reloads the config periodically
+func (m *Manager) poll() {
+	defer m.watchers.Done()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.reload()
+		}
+	}
 }
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig is a minimal config file that passes validation
+const validConfig = `
+grpcTarget: switch:8080
+firmwareSource: /host/images/sonic.bin
+targetVersion: SONiC.1.0
+`
+
+// update is one call of the manager's onUpdate
+type update struct {
+	cfg     Config
+	changes []Change
+}
+
+// startManager watches path and returns the updates it reports
+func startManager(t *testing.T, path string) (*Manager, chan update) {
+	t.Helper()
+	updates := make(chan update, 10)
+	m, err := NewManager(path, nil, func(cfg Config, changes []Change) {
+		updates <- update{cfg, changes}
+	})
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	if err := m.StartWatcher(); err != nil {
+		t.Fatalf("StartWatcher() error = %v", err)
+	}
+	t.Cleanup(m.Close)
+	return m, updates
+}
+
+// nextUpdate waits for the manager to report an update
+func nextUpdate(t *testing.T, updates chan update) update {
+	t.Helper()
+	select {
+	case u := <-updates:
+		return u
+	case <-time.After(5 * time.Second):
+		t.Fatal("no config update reported")
+		return update{}
+	}
+}
+
+// noUpdate checks that the manager reports nothing for a while
+func noUpdate(t *testing.T, updates chan update) {
+	t.Helper()
+	select {
+	case u := <-updates:
+		t.Fatalf("got update %v, want none", u.changes)
+	case <-time.After(3 * reloadDelay):
+	}
+}
+
+func writeConfig(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewManagerRejectsInvalidConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "grpcTarget: switch:8080\n")
+	if _, err := NewManager(path, nil, nil); err == nil {
+		t.Errorf("NewManager() succeeded with an invalid config, want an error")
+	}
+}
+
+func TestManagerWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, validConfig)
+	m, updates := startManager(t, path)
+
+	writeConfig(t, path, validConfig+"rebootMethod: warm\n")
+	u := nextUpdate(t, updates)
+	if len(u.changes) != 1 || u.changes[0].Field != "rebootMethod" || u.cfg.RebootMethod != "warm" {
+		t.Errorf("update = %v, want rebootMethod changed to warm", u.changes)
+	}
+
+	// Rewriting the same config is not a change
+	writeConfig(t, path, "# unchanged\n"+validConfig+"rebootMethod: warm\n")
+	noUpdate(t, updates)
+
+	// An invalid config is rejected and the last good one kept
+	writeConfig(t, path, validConfig+"rebootMethod: sideways\n")
+	noUpdate(t, updates)
+	if got := m.GetConfig().RebootMethod; got != "warm" {
+		t.Errorf("config after an invalid update has rebootMethod %q, want warm", got)
+	}
+
+	writeConfig(t, path, validConfig)
+	if u := nextUpdate(t, updates); u.cfg.RebootMethod != "" {
+		t.Errorf("config after fixing the file has rebootMethod %q, want it cleared", u.cfg.RebootMethod)
+	}
+}
+
+func TestManagerWatchConfigMap(t *testing.T) {
+	// A mounted ConfigMap links config.yaml through ..data to a timestamped
+	// directory and is updated by swapping ..data to a new one
+	dir := t.TempDir()
+	for i, data := range []string{validConfig, strings.Replace(validConfig, "SONiC.1.0", "SONiC.2.0", 1)} {
+		version := filepath.Join(dir, fmt.Sprintf("..v%d", i+1))
+		if err := os.Mkdir(version, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeConfig(t, filepath.Join(version, "config.yaml"), data)
+	}
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.Symlink("..data/config.yaml", path); err != nil {
+		t.Fatal(err)
+	}
+	_, updates := startManager(t, path)
+
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if u := nextUpdate(t, updates); u.cfg.TargetVersion != "SONiC.2.0" {
+		t.Errorf("config after the swap targets %q, want SONiC.2.0", u.cfg.TargetVersion)
+	}
+}
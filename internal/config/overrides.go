@@ -0,0 +1,222 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"upgrade-agent/internal/firmwaresource"
+)
+
+// EnvPrefix starts the name of every environment variable overriding a
+// config field, e.g. UPGRADE_AGENT_GRPC_TARGET for grpcTarget
+const EnvPrefix = "UPGRADE_AGENT_"
+
+// Override sets one config field regardless of the config file
+type Override struct {
+	// Field is the YAML path of the field, such as "timeouts.rpc"
+	Field string
+	Value string
+	// Source names where the value came from, such as "env UPGRADE_AGENT_GRPC_TARGET"
+	Source string
+}
+
+// Overrides are applied in order, so a later override of the same field wins
+type Overrides []Override
+
+// field is a config field addressable by its YAML path
+type field struct {
+	path  string
+	index []int
+	typ   reflect.Type
+}
+
+// fields lists every scalar field of Config, descending into nested structs
+// such as Timeouts
+func fields() []field {
+	var out []field
+	var walk func(t reflect.Type, prefix string, index []int)
+	walk = func(t reflect.Type, prefix string, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			path := prefix + name
+			idx := append(append([]int{}, index...), i)
+			if f.Type.Kind() == reflect.Struct {
+				walk(f.Type, path+".", idx)
+				continue
+			}
+			out = append(out, field{path: path, index: idx, typ: f.Type})
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "", nil)
+	return out
+}
+
+// words splits a YAML path into lowercase words, keeping acronyms together:
+// "tlsCAFile" becomes tls, ca, file
+func words(path string) []string {
+	var out []string
+	for _, part := range strings.Split(path, ".") {
+		runes := []rune(part)
+		start := 0
+		for i := 1; i < len(runes); i++ {
+			upper := unicode.IsUpper(runes[i])
+			lowerBefore := !unicode.IsUpper(runes[i-1])
+			lowerAfter := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if upper && (lowerBefore || lowerAfter) {
+				out = append(out, strings.ToLower(string(runes[start:i])))
+				start = i
+			}
+		}
+		out = append(out, strings.ToLower(string(runes[start:])))
+	}
+	return out
+}
+
+// EnvName returns the environment variable overriding the field at path
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.Join(words(path), "_"))
+}
+
+// FlagName returns the command line flag overriding the field at path
+func FlagName(path string) string {
+	return strings.Join(words(path), "-")
+}
+
+// EnvOverrides collects the UPGRADE_AGENT_* variables set in the environment
+func EnvOverrides() Overrides {
+	var overrides Overrides
+	for _, f := range fields() {
+		name := EnvName(f.path)
+		if value, ok := os.LookupEnv(name); ok {
+			overrides = append(overrides, Override{Field: f.path, Value: value, Source: "env " + name})
+		}
+	}
+	return overrides
+}
+
+// overrideFlag is a string flag that, for boolean fields, may also be given
+// without a value
+type overrideFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *overrideFlag) String() string     { return f.value }
+func (f *overrideFlag) Set(v string) error { f.value = v; return nil }
+func (f *overrideFlag) IsBoolFlag() bool   { return f.isBool }
+
+// RegisterFlags defines a flag for every config field on fs. The returned
+// function collects the flags given on the command line once fs is parsed.
+func RegisterFlags(fs *flag.FlagSet) func() Overrides {
+	byFlag := map[string]string{}
+	for _, f := range fields() {
+		name := FlagName(f.path)
+		byFlag[name] = f.path
+		fs.Var(&overrideFlag{isBool: f.typ.Kind() == reflect.Bool}, name,
+			fmt.Sprintf("Override %s of the config file (env %s)", f.path, EnvName(f.path)))
+	}
+
+	return func() Overrides {
+		var overrides Overrides
+		fs.Visit(func(fl *flag.Flag) {
+			if path, ok := byFlag[fl.Name]; ok {
+				overrides = append(overrides, Override{Field: path, Value: fl.Value.String(), Source: "flag --" + fl.Name})
+			}
+		})
+		return overrides
+	}
+}
+
+// Apply sets the overridden fields of cfg
+func (o Overrides) Apply(cfg Config) (Config, error) {
+	byPath := map[string]field{}
+	for _, f := range fields() {
+		byPath[f.path] = f
+	}
+
+	v := reflect.ValueOf(&cfg).Elem()
+	for _, override := range o {
+		f, ok := byPath[override.Field]
+		if !ok {
+			return Config{}, fmt.Errorf("%s: unknown config field %s", override.Source, override.Field)
+		}
+		if err := setField(v.FieldByIndex(f.index), override.Value); err != nil {
+			return Config{}, fmt.Errorf("%s: invalid %s: %w", override.Source, override.Field, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Sources maps each overridden field to where its value came from
+func (o Overrides) Sources() map[string]string {
+	sources := map[string]string{}
+	for _, override := range o {
+		sources[override.Field] = override.Source
+	}
+	return sources
+}
+
+// setField parses value into a field of one of the types used by Config
+func setField(v reflect.Value, value string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		v.SetInt(int64(n))
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// Describe renders every field of the config on one line for logging, with
+// secrets redacted and the source of overridden values noted
+func (c Config) Describe(overrides Overrides) string {
+	sources := overrides.Sources()
+	v := reflect.ValueOf(c.Redacted())
+
+	var parts []string
+	for _, f := range fields() {
+		part := f.path + "=" + formatValue(v.FieldByIndex(f.index).Interface())
+		if source, ok := sources[f.path]; ok {
+			part += " (" + source + ")"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Redacted returns the config with credentials hidden, for printing
+func (c Config) Redacted() Config {
+	c.FirmwareSource = firmwaresource.Redact(c.FirmwareSource)
+	return c
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the config schema version this agent understands. A
+// config without a version is taken to be of the current version.
+const CurrentVersion = 1
+
+// Timeouts bounds the steps of an upgrade. Values are YAML durations such as
+// "30s" or "5m".
+type Timeouts struct {
+	RPC           time.Duration `yaml:"rpc" json:"rpc"`                     // Each short RPC: System.Time, OS.Verify, OS.Activate and System.Reboot
+	Update        time.Duration `yaml:"update" json:"update"`               // The firmware update RPC for a local image
+	RemoteUpdate  time.Duration `yaml:"remoteUpdate" json:"remoteUpdate"`   // The firmware update RPC when the server downloads the image first
+	Stabilization time.Duration `yaml:"stabilization" json:"stabilization"` // Wait after a reboot before the running version is checked
+}
+
+// DefaultTimeouts are used for timeouts the config leaves out
+var DefaultTimeouts = Timeouts{
+	RPC:           30 * time.Second,
+	Update:        5 * time.Minute,
+	RemoteUpdate:  30 * time.Minute,
+	Stabilization: 60 * time.Second,
+}
+
+// MarshalJSON writes the timeouts as duration strings, as in the YAML config
+func (t Timeouts) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		RPC           string `json:"rpc"`
+		Update        string `json:"update"`
+		RemoteUpdate  string `json:"remoteUpdate"`
+		Stabilization string `json:"stabilization"`
+	}{t.RPC.String(), t.Update.String(), t.RemoteUpdate.String(), t.Stabilization.String()})
+}
+
+// UnmarshalJSON reads timeouts as duration strings or, as journaled by
+// earlier agents, as nanoseconds
+func (t *Timeouts) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for name, dst := range map[string]*time.Duration{
+		"rpc":           &t.RPC,
+		"update":        &t.Update,
+		"remoteUpdate":  &t.RemoteUpdate,
+		"stabilization": &t.Stabilization,
+	} {
+		switch v := raw[name].(type) {
+		case nil:
+		case float64:
+			*dst = time.Duration(v)
+		case string:
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid timeouts.%s: %w", name, err)
+			}
+			*dst = d
+		default:
+			return fmt.Errorf("invalid timeouts.%s: %v", name, v)
+		}
+	}
+	return nil
+}
+
+// WithDefaults returns the config with defaults filled in for every optional
+// field left empty
+func (c Config) WithDefaults() Config {
+	if c.Version == 0 {
+		c.Version = CurrentVersion
+	}
+	if c.VersionMatch == "" {
+		c.VersionMatch = "exact"
+	}
+	if c.Timeouts.RPC == 0 {
+		c.Timeouts.RPC = DefaultTimeouts.RPC
+	}
+	if c.Timeouts.Update == 0 {
+		c.Timeouts.Update = DefaultTimeouts.Update
+	}
+	if c.Timeouts.RemoteUpdate == 0 {
+		c.Timeouts.RemoteUpdate = DefaultTimeouts.RemoteUpdate
+	}
+	if c.Timeouts.Stabilization == 0 {
+		c.Timeouts.Stabilization = DefaultTimeouts.Stabilization
+	}
+	return c
+}
+
+// Load reads the config file at path, see Parse
+func Load(path string, overrides Overrides) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return Parse(data, overrides)
+}
+
+// Parse decodes a YAML config, applies the overrides, fills in defaults and
+// validates the result. Unknown fields and values of the wrong type are
+// errors rather than being ignored.
+func Parse(data []byte, overrides Overrides) (Config, error) {
+	var cfg Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	cfg, err := overrides.Apply(cfg)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg = cfg.WithDefaults()
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// UnmarshalJSON decodes a config journaled with an upgrade. Journals written
+// before updateMlnxCpldFw became a boolean hold it as a string.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type plain Config
+	var raw struct {
+		plain
+		UpdateMlnxCpldFw any `json:"updateMlnxCpldFw"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*c = Config(raw.plain)
+	switch v := raw.UpdateMlnxCpldFw.(type) {
+	case nil:
+	case bool:
+		c.UpdateMlnxCpldFw = v
+	case string:
+		c.UpdateMlnxCpldFw = v == "true"
+	default:
+		return fmt.Errorf("updateMlnxCpldFw must be a boolean, got %v", v)
+	}
+	return nil
+}
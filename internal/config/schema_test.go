@@ -0,0 +1,106 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+		check   func(t *testing.T, cfg Config)
+	}{
+		{
+			name: "defaults",
+			yaml: validConfig,
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Version != CurrentVersion || cfg.VersionMatch != "exact" || cfg.Timeouts != DefaultTimeouts {
+					t.Errorf("config = %+v, want the defaults filled in", cfg)
+				}
+			},
+		},
+		{
+			name: "typed fields",
+			yaml: validConfig + `
+version: 1
+updateMlnxCpldFw: true
+timeouts:
+  rpc: 10s
+  stabilization: 2m
+`,
+			check: func(t *testing.T, cfg Config) {
+				want := Timeouts{RPC: 10 * time.Second, Update: DefaultTimeouts.Update, RemoteUpdate: DefaultTimeouts.RemoteUpdate, Stabilization: 2 * time.Minute}
+				if !cfg.UpdateMlnxCpldFw || cfg.Timeouts != want {
+					t.Errorf("config = %+v, want the CPLD update and timeouts %+v", cfg, want)
+				}
+			},
+		},
+		{
+			name:    "unknown field",
+			yaml:    validConfig + "logLevl: debug\n",
+			wantErr: "field logLevl not found",
+		},
+		{
+			name:    "string for a boolean",
+			yaml:    validConfig + "updateMlnxCpldFw: maybe\n",
+			wantErr: "failed to parse config file",
+		},
+		{
+			name:    "duration without a unit",
+			yaml:    validConfig + "timeouts:\n  rpc: 30\n",
+			wantErr: "failed to parse config file",
+		},
+		{
+			name:    "newer schema",
+			yaml:    validConfig + "version: 2\n",
+			wantErr: "unsupported config version 2",
+		},
+		{
+			name:    "empty",
+			yaml:    "",
+			wantErr: "grpcTarget is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(tt.yaml), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	cfg, err := Parse([]byte(validConfig+"updateMlnxCpldFw: true\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"rpc":"30s"`) {
+		t.Errorf("journaled config %s, want timeouts as durations", data)
+	}
+	var got Config
+	if err := json.Unmarshal(data, &got); err != nil || got != cfg {
+		t.Errorf("json round trip = %+v, %v, want %+v", got, err, cfg)
+	}
+
+	// Journals of earlier agents hold the CPLD flag as a string
+	if err := json.Unmarshal([]byte(`{"updateMlnxCpldFw": "true"}`), &got); err != nil || !got.UpdateMlnxCpldFw {
+		t.Errorf("journaled string flag = %v, %v, want true", got.UpdateMlnxCpldFw, err)
+	}
+}
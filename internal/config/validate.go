@@ -0,0 +1,140 @@
+package config
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"upgrade-agent/internal/firmwaresource"
+	"upgrade-agent/internal/logging"
+)
+
+// Validate checks that the configuration can drive an upgrade. All problems
+// are reported together.
+func (c Config) Validate() error {
+	var problems []string
+	addf := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Version != CurrentVersion {
+		addf("unsupported config version %d, this agent understands version %d", c.Version, CurrentVersion)
+	}
+
+	if c.GrpcTarget == "" {
+		addf("grpcTarget is required")
+	} else if _, port, err := net.SplitHostPort(c.GrpcTarget); err != nil || port == "" {
+		addf("grpcTarget %q is not host:port", c.GrpcTarget)
+	}
+	if c.TargetVersion == "" {
+		addf("targetVersion is required")
+	}
+	if c.FirmwareSource == "" {
+		addf("firmwareSource is required")
+	}
+	if c.FirmwareSHA256 != "" {
+		if sum, err := hex.DecodeString(c.FirmwareSHA256); err != nil || len(sum) != 32 {
+			addf("firmwareSha256 %q is not a hex SHA-256", c.FirmwareSHA256)
+		}
+	}
+	switch c.VersionMatch {
+	case "", "exact", "prefix", "contains":
+	case "regex":
+		if _, err := regexp.Compile(c.TargetVersion); err != nil {
+			addf("targetVersion is not a valid regex for versionMatch regex: %v", err)
+		}
+	default:
+		addf("versionMatch must be exact, prefix, contains or regex, got %q", c.VersionMatch)
+	}
+
+	switch strings.ToLower(c.RebootMethod) {
+	case "", "cold", "warm", "fast":
+	default:
+		addf("rebootMethod must be cold, warm or fast, got %q", c.RebootMethod)
+	}
+	if c.UpdateMlnxCpldFw && c.EffectiveRebootMethod() != "cold" {
+		addf("rebootMethod %s cannot complete a CPLD update, which needs a cold reboot", c.RebootMethod)
+	}
+
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		addf("logLevel: %v", err)
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		addf("tlsCertFile and tlsKeyFile must be set together")
+	}
+
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"rpc", c.Timeouts.RPC},
+		{"update", c.Timeouts.Update},
+		{"remoteUpdate", c.Timeouts.RemoteUpdate},
+		{"stabilization", c.Timeouts.Stabilization},
+	} {
+		if t.d <= 0 {
+			addf("timeouts.%s must be positive, got %v", t.name, t.d)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Change is a configuration field whose value changed
+type Change struct {
+	// Field is the YAML name of the field
+	Field    string
+	Old, New any
+}
+
+// Redacted returns the change with credentials hidden, for printing
+func (c Change) Redacted() Change {
+	if c.Field == "firmwareSource" {
+		c.Old = firmwaresource.Redact(c.Old.(string))
+		c.New = firmwaresource.Redact(c.New.(string))
+	}
+	return c
+}
+
+// String renders the change for logging
+func (c Change) String() string {
+	c = c.Redacted()
+	return fmt.Sprintf("%s: %s -> %s", c.Field, formatValue(c.Old), formatValue(c.New))
+}
+
+// formatValue quotes strings so empty values stay visible
+func formatValue(v any) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(v)
+}
+
+// Diff lists the fields that differ between old and new, in declaration order
+func Diff(old, new Config) []Change {
+	var changes []Change
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		a, b := oldValue.Field(i).Interface(), newValue.Field(i).Interface()
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		changes = append(changes, Change{Field: name, Old: a, New: b})
+	}
+	return changes
+}
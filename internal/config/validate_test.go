@@ -0,0 +1,133 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	old := Config{GrpcTarget: "switch:8080", TargetVersion: "1.0", Timeouts: DefaultTimeouts}.WithDefaults()
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []Change
+	}{
+		{
+			name:   "unchanged",
+			change: func(c *Config) {},
+		},
+		{
+			name: "fields in declaration order",
+			change: func(c *Config) {
+				c.TargetVersion = "2.0"
+				c.GrpcTarget = "switch:9090"
+			},
+			want: []Change{
+				{Field: "grpcTarget", Old: "switch:8080", New: "switch:9090"},
+				{Field: "targetVersion", Old: "1.0", New: "2.0"},
+			},
+		},
+		{
+			name:   "nested timeouts",
+			change: func(c *Config) { c.Timeouts.RPC = time.Second },
+			want: []Change{{Field: "timeouts", Old: DefaultTimeouts,
+				New: Timeouts{RPC: time.Second, Update: DefaultTimeouts.Update, RemoteUpdate: DefaultTimeouts.RemoteUpdate, Stabilization: DefaultTimeouts.Stabilization}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			new := old
+			tt.change(&new)
+			if got := Diff(old, new); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{GrpcTarget: "switch:8080", FirmwareSource: "/host/images/sonic.bin", TargetVersion: "SONiC.1.0"}.WithDefaults()
+
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr []string
+	}{
+		{name: "valid", change: func(c *Config) {}},
+		{
+			name: "missing fields reported together",
+			change: func(c *Config) {
+				c.GrpcTarget, c.TargetVersion, c.FirmwareSource = "", "", ""
+			},
+			wantErr: []string{"grpcTarget is required", "targetVersion is required", "firmwareSource is required"},
+		},
+		{
+			name:    "target without port",
+			change:  func(c *Config) { c.GrpcTarget = "switch" },
+			wantErr: []string{`grpcTarget "switch" is not host:port`},
+		},
+		{
+			name:    "short SHA-256",
+			change:  func(c *Config) { c.FirmwareSHA256 = "abcd" },
+			wantErr: []string{"is not a hex SHA-256"},
+		},
+		{
+			name:    "unknown version match",
+			change:  func(c *Config) { c.VersionMatch = "fuzzy" },
+			wantErr: []string{"versionMatch must be"},
+		},
+		{
+			name: "invalid regex",
+			change: func(c *Config) {
+				c.VersionMatch, c.TargetVersion = "regex", "SONiC.(1"
+			},
+			wantErr: []string{"not a valid regex"},
+		},
+		{
+			name: "CPLD update with a warm reboot",
+			change: func(c *Config) {
+				c.UpdateMlnxCpldFw, c.RebootMethod = true, "warm"
+			},
+			wantErr: []string{"needs a cold reboot"},
+		},
+		{
+			name:    "unknown log level",
+			change:  func(c *Config) { c.LogLevel = "loud" },
+			wantErr: []string{"logLevel"},
+		},
+		{
+			name:    "certificate without key",
+			change:  func(c *Config) { c.TLSCertFile = "/etc/tls/agent.crt" },
+			wantErr: []string{"must be set together"},
+		},
+		{
+			name:    "negative timeout",
+			change:  func(c *Config) { c.Timeouts.Update = -time.Second },
+			wantErr: []string{"timeouts.update must be positive"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.change(&cfg)
+			err := cfg.Validate()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() succeeded, want %q", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+// Package executor runs the commands through which the server acts on the
+// host: the firmware installer, sonic-installer and the reboot commands. The
+// server picks one implementation and hands it to every service, so where
+// and how host commands run is decided in a single place.
+package executor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DefaultHostRoot is where the host filesystem is mounted inside the server
+// container
+const DefaultHostRoot = "/host"
+
+// Command is a command to run on the host
+type Command struct {
+	// Name is the program to run, looked up in PATH if it is not a path
+	Name string
+	// Args are the arguments following Name
+	Args []string
+	// Env holds extra KEY=value variables for the command
+	Env []string
+}
+
+// String renders the command for logging
+func (c Command) String() string {
+	parts := append(append([]string{}, c.Env...), c.Name)
+	return strings.Join(append(parts, c.Args...), " ")
+}
+
+// Executor runs host commands
+type Executor interface {
+	// Name identifies the implementation in logs, as accepted by New
+	Name() string
+	// Run executes cmd and calls onLine, if not nil, with every line it
+	// writes to stdout or stderr. It returns the exit code of the command,
+	// -1 if it was killed, or an error if it could not be run at all.
+	Run(ctx context.Context, cmd Command, onLine func(line string)) (int, error)
+	// Start launches cmd without waiting for it, for commands such as reboot
+	// that take the server down with them. wait blocks until the command
+	// exits and returns like Run; the caller must call it to release the
+	// command, and it never returns if the command takes the server down.
+	Start(cmd Command) (wait func() (int, error), err error)
+	// HostPath translates a path as seen by the server into the path the
+	// command sees
+	HostPath(path string) string
+}
+
+// New creates the executor with the given name: "nsenter" and "systemd" run
+// commands in the host namespaces, the first directly and the second as a
+// transient systemd unit; "local" runs them in the server's own namespaces
+// and "fake" only records them. hostRoot is where the host filesystem is
+// mounted (DefaultHostRoot if empty).
+func New(name, hostRoot string) (Executor, error) {
+	if hostRoot == "" {
+		hostRoot = DefaultHostRoot
+	}
+	switch name {
+	case "nsenter":
+		return NewNsenter(hostRoot), nil
+	case "systemd":
+		return NewSystemd(hostRoot), nil
+	case "local":
+		return Local{}, nil
+	case "fake":
+		return NewRecorder(), nil
+	default:
+		return nil, fmt.Errorf("unknown executor %q, expected nsenter, systemd, local or fake", name)
+	}
+}
+
+// ExitError is returned by Output when the command exits non-zero
+type ExitError struct {
+	Command  Command
+	ExitCode int
+	// Output is the last output of the command, usually the error message
+	Output string
+}
+
+// Error implements error
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s failed with exit code %d: %s", e.Command.Name, e.ExitCode, e.Output)
+}
+
+// Output runs cmd and returns its output, failing with an *ExitError if it
+// does not exit with 0
+func Output(ctx context.Context, e Executor, cmd Command) (string, error) {
+	var lines []string
+	exitCode, err := e.Run(ctx, cmd, func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s: %w", cmd.Name, err)
+	}
+	if exitCode != 0 {
+		tail := lines
+		if len(tail) > 5 {
+			tail = tail[len(tail)-5:]
+		}
+		return "", &ExitError{Command: cmd, ExitCode: exitCode, Output: strings.Join(tail, "\n")}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// stripHostRoot maps a path under the host filesystem mount to the host path.
+// Paths outside the mount are returned unchanged, they are expected to be
+// mounted at the same place on the host.
+func stripHostRoot(hostRoot, path string) string {
+	if rest, ok := strings.CutPrefix(path, hostRoot); ok && (rest == "" || strings.HasPrefix(rest, "/")) {
+		if rest == "" {
+			return "/"
+		}
+		return rest
+	}
+	return path
+}
@@ -0,0 +1,11 @@
+package executor
+
+import "testing"
+
+func TestCommandString(t *testing.T) {
+	cmd := Command{Name: "sonic-installer", Args: []string{"install", "-y", "/tmp/sonic.bin"}, Env: []string{"UPDATE_MLNX_CPLD_FW=1"}}
+	want := "UPDATE_MLNX_CPLD_FW=1 sonic-installer install -y /tmp/sonic.bin"
+	if got := cmd.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+
+	"upgrade-agent/internal/logging"
+)
+
+// maxLineSize bounds a line of command output. The rest of the output after a
+// longer line is discarded.
+const maxLineSize = 1024 * 1024
+
+// Local runs commands in the server's own namespaces using os/exec
+type Local struct{}
+
+// Name implements Executor
+func (Local) Name() string {
+	return "local"
+}
+
+// Run implements Executor
+func (Local) Run(ctx context.Context, c Command, onLine func(line string)) (int, error) {
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	cmd.Env = append(os.Environ(), c.Env...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return -1, fmt.Errorf("failed to open stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return -1, fmt.Errorf("failed to open stderr pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+
+	// Both pipes feed the same callback, so serialize the calls
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	scan := func(r io.Reader) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+		for scanner.Scan() {
+			if onLine == nil {
+				continue
+			}
+			mu.Lock()
+			onLine(scanner.Text())
+			mu.Unlock()
+		}
+		if err := scanner.Err(); err != nil {
+			// Keep reading so the command is not blocked on a full pipe
+			slog.Warn("Dropping the rest of the command output", "command", c.String(), logging.Err(err))
+			io.Copy(io.Discard, r)
+		}
+	}
+	wg.Add(2)
+	go scan(stdout)
+	go scan(stderr)
+
+	// All reads must complete before calling Wait
+	wg.Wait()
+	return exitCode(cmd.Wait())
+}
+
+// Start implements Executor
+func (Local) Start(c Command) (func() (int, error), error) {
+	cmd := exec.Command(c.Name, c.Args...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return func() (int, error) {
+		return exitCode(cmd.Wait())
+	}, nil
+}
+
+// exitCode turns the result of waiting for a command into its exit code,
+// -1 if it was killed by a signal
+func exitCode(err error) (int, error) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// HostPath implements Executor. Local commands see the server's filesystem.
+func (Local) HostPath(path string) string {
+	return path
+}
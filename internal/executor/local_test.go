@@ -0,0 +1,114 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLocalRun(t *testing.T) {
+	tests := []struct {
+		name         string
+		cmd          Command
+		wantExitCode int
+		wantErr      error
+		// wantLines must all be among the lines passed to onLine
+		wantLines []string
+		// wantLineCount is the number of lines expected, if set
+		wantLineCount int
+	}{
+		{
+			name:          "stdout and stderr",
+			cmd:           Command{Name: "sh", Args: []string{"-c", "echo out; echo err >&2"}},
+			wantLines:     []string{"out", "err"},
+			wantLineCount: 2,
+		},
+		{
+			name:      "environment",
+			cmd:       Command{Name: "sh", Args: []string{"-c", "echo $UPDATE_MLNX_CPLD_FW"}, Env: []string{"UPDATE_MLNX_CPLD_FW=1"}},
+			wantLines: []string{"1"},
+		},
+		{
+			name:         "exit code",
+			cmd:          Command{Name: "sh", Args: []string{"-c", "echo failing; exit 3"}},
+			wantExitCode: 3,
+			wantLines:    []string{"failing"},
+		},
+		{
+			name:         "killed",
+			cmd:          Command{Name: "sh", Args: []string{"-c", "kill -9 $$"}},
+			wantExitCode: -1,
+		},
+		{
+			name:         "not found",
+			cmd:          Command{Name: "no-such-command-upgrade-agent"},
+			wantExitCode: -1,
+			wantErr:      exec.ErrNotFound,
+		},
+		{
+			// The line is longer than maxLineSize, so it and what follows
+			// is dropped, but the command must still run to completion
+			name:          "overlong line",
+			cmd:           Command{Name: "sh", Args: []string{"-c", "echo before; head -c 2000000 /dev/zero | tr '\\0' x; echo; echo after; exit 4"}},
+			wantExitCode:  4,
+			wantLines:     []string{"before"},
+			wantLineCount: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var lines []string
+			exitCode, err := Local{}.Run(ctx, tt.cmd, func(line string) {
+				lines = append(lines, line)
+			})
+			if ctx.Err() != nil {
+				t.Fatalf("Run() did not return before the deadline")
+			}
+			if exitCode != tt.wantExitCode || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Run() = %d, %v, want %d, %v", exitCode, err, tt.wantExitCode, tt.wantErr)
+			}
+			for _, want := range tt.wantLines {
+				if !slices.Contains(lines, want) {
+					t.Errorf("lines = %q, want %q among them", lines, want)
+				}
+			}
+			if tt.wantLineCount != 0 && len(lines) != tt.wantLineCount {
+				t.Errorf("got %d lines, want %d", len(lines), tt.wantLineCount)
+			}
+		})
+	}
+}
+
+func TestLocalRunCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	exitCode, err := Local{}.Run(ctx, Command{Name: "sleep", Args: []string{"30"}}, nil)
+	if exitCode != -1 || err != nil {
+		t.Errorf("Run() = %d, %v, want -1 for a killed command", exitCode, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Run() took %v after its context was cancelled", elapsed)
+	}
+}
+
+func TestLocalStart(t *testing.T) {
+	wait, err := Local{}.Start(Command{Name: "sh", Args: []string{"-c", "exit 5"}})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if exitCode, err := wait(); exitCode != 5 || err != nil {
+		t.Errorf("wait() = %d, %v, want 5", exitCode, err)
+	}
+
+	if _, err := (Local{}).Start(Command{Name: "no-such-command-upgrade-agent"}); !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("Start() of a missing command error = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,48 @@
+package executor
+
+import (
+	"context"
+)
+
+// nsenterArgs enter the namespaces of the host's init process
+var nsenterArgs = []string{"--target", "1", "--mount", "--uts", "--ipc", "--net", "--pid"}
+
+// Nsenter runs commands in the host namespaces with nsenter. The server
+// container needs the host PID namespace and the privileges to enter it.
+type Nsenter struct {
+	local    Local
+	hostRoot string
+}
+
+// NewNsenter creates an Nsenter executor. hostRoot is where the host
+// filesystem is mounted in the container.
+func NewNsenter(hostRoot string) *Nsenter {
+	return &Nsenter{hostRoot: hostRoot}
+}
+
+// Name implements Executor
+func (n *Nsenter) Name() string {
+	return "nsenter"
+}
+
+// Run implements Executor
+func (n *Nsenter) Run(ctx context.Context, cmd Command, onLine func(line string)) (int, error) {
+	return n.local.Run(ctx, n.wrap(cmd), onLine)
+}
+
+// Start implements Executor
+func (n *Nsenter) Start(cmd Command) (func() (int, error), error) {
+	return n.local.Start(n.wrap(cmd))
+}
+
+// HostPath implements Executor
+func (n *Nsenter) HostPath(path string) string {
+	return stripHostRoot(n.hostRoot, path)
+}
+
+// wrap turns cmd into the nsenter command running it. nsenter passes the
+// environment on, so Env needs no special handling.
+func (n *Nsenter) wrap(cmd Command) Command {
+	args := append(append(append([]string{}, nsenterArgs...), cmd.Name), cmd.Args...)
+	return Command{Name: "nsenter", Args: args, Env: cmd.Env}
+}
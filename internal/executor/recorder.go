@@ -0,0 +1,100 @@
+package executor
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Result is the canned outcome of a command run by a Recorder
+type Result struct {
+	// Output is reported line by line
+	Output []string
+	// ExitCode is returned by Run, and by the wait function of Start
+	ExitCode int
+	// Err is returned by Run and Start instead of running the command
+	Err error
+}
+
+// Recorder is an Executor that runs nothing. It records every command and
+// answers with canned results, for tests and for running the server where
+// the host must not be touched.
+type Recorder struct {
+	lock     sync.Mutex
+	commands []Command
+	results  map[string]Result
+}
+
+// NewRecorder creates a Recorder on which every command succeeds without
+// output
+func NewRecorder() *Recorder {
+	return &Recorder{results: make(map[string]Result)}
+}
+
+// SetResult makes commands answer with result. key is either the command name
+// or the name followed by the leading arguments, e.g. "sonic-installer list".
+func (r *Recorder) SetResult(key string, result Result) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.results[key] = result
+}
+
+// Commands returns the commands run or started so far
+func (r *Recorder) Commands() []Command {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Command{}, r.commands...)
+}
+
+// Name implements Executor
+func (r *Recorder) Name() string {
+	return "fake"
+}
+
+// Run implements Executor
+func (r *Recorder) Run(ctx context.Context, cmd Command, onLine func(line string)) (int, error) {
+	result := r.record(cmd)
+	if result.Err != nil {
+		return -1, result.Err
+	}
+	if onLine != nil {
+		for _, line := range result.Output {
+			onLine(line)
+		}
+	}
+	return result.ExitCode, nil
+}
+
+// Start implements Executor
+func (r *Recorder) Start(cmd Command) (func() (int, error), error) {
+	result := r.record(cmd)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return func() (int, error) {
+		return result.ExitCode, nil
+	}, nil
+}
+
+// HostPath implements Executor
+func (r *Recorder) HostPath(path string) string {
+	return path
+}
+
+// record stores cmd and looks up its result, preferring the longest key
+func (r *Recorder) record(cmd Command) Result {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	slog.Info("Fake executor: recorded command", "command", cmd.String())
+	r.commands = append(r.commands, cmd)
+
+	words := append([]string{cmd.Name}, cmd.Args...)
+	for n := len(words); n > 0; n-- {
+		if result, ok := r.results[strings.Join(words[:n], " ")]; ok {
+			return result
+		}
+	}
+	return Result{}
+}
@@ -0,0 +1,49 @@
+package executor
+
+import (
+	"context"
+
+	"upgrade-agent/internal/systemdutils"
+)
+
+// Systemd runs commands on the host as transient systemd units, so they are
+// supervised and logged by the host's systemd and survive a restart of the
+// server container. The server needs access to the host's system bus.
+type Systemd struct {
+	hostRoot string
+}
+
+// NewSystemd creates a Systemd executor. hostRoot is where the host
+// filesystem is mounted in the container.
+func NewSystemd(hostRoot string) *Systemd {
+	return &Systemd{hostRoot: hostRoot}
+}
+
+// Name implements Executor
+func (s *Systemd) Name() string {
+	return "systemd"
+}
+
+// Run implements Executor. Output is read from the unit's journal as it is
+// written.
+func (s *Systemd) Run(ctx context.Context, cmd Command, onLine func(line string)) (int, error) {
+	return systemdutils.RunCommandStreaming(ctx, s.argv(cmd), onLine)
+}
+
+// Start implements Executor
+func (s *Systemd) Start(cmd Command) (func() (int, error), error) {
+	return systemdutils.StartCommand(s.argv(cmd))
+}
+
+// HostPath implements Executor
+func (s *Systemd) HostPath(path string) string {
+	return stripHostRoot(s.hostRoot, path)
+}
+
+// argv builds the ExecStart line. systemd wants an absolute executable and
+// has no PATH lookup of its own, so the command goes through env, which also
+// sets the extra variables.
+func (s *Systemd) argv(cmd Command) []string {
+	argv := append([]string{"/usr/bin/env"}, cmd.Env...)
+	return append(append(argv, cmd.Name), cmd.Args...)
+}
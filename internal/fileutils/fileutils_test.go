@@ -0,0 +1,54 @@
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing is the content of the file before the write, if any
+		existing string
+		// subdir is created by the write
+		subdir string
+	}{
+		{name: "new file"},
+		{name: "replace", existing: "old state"},
+		{name: "missing directory", subdir: "sonic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), tt.subdir)
+			path := filepath.Join(dir, "state.json")
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := WriteAtomic(path, []byte(`{"phase": "done"}`)); err != nil {
+				t.Fatalf("WriteAtomic() error = %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil || string(data) != `{"phase": "done"}` {
+				t.Errorf("file holds %q, %v, want the new content", data, err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("directory holds %d files, want the written file only", len(entries))
+			}
+		})
+	}
+}
+
+func TestWriteAtomicFails(t *testing.T) {
+	// A file where the directory should be makes every step fail
+	parent := filepath.Join(t.TempDir(), "not-a-directory")
+	if err := os.WriteFile(parent, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAtomic(filepath.Join(parent, "state.json"), []byte("{}")); err == nil {
+		t.Error("WriteAtomic() under a file succeeded, want an error")
+	}
+}
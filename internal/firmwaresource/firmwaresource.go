@@ -0,0 +1,32 @@
+// Package firmwaresource handles firmware sources given as http(s) URLs,
+// which may carry credentials that must not reach logs or status lines
+package firmwaresource
+
+import (
+	"net/url"
+	"strings"
+)
+
+// IsURL reports whether the firmware source is an http(s) URL to download
+// rather than a local path
+func IsURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// Redact returns source with the userinfo and query string of a URL removed,
+// for logs and status lines. Local paths are returned unchanged.
+func Redact(source string) string {
+	if !IsURL(source) {
+		return source
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return "REDACTED"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
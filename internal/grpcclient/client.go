@@ -2,20 +2,45 @@ package grpcclient
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"os"
+	"strings"
 	"time"
 
 	gnoisonic "upgrade-agent/gnoi_sonic"
+	"upgrade-agent/internal/logging"
 
 	ospb "github.com/openconfig/gnoi/os"
 	syspb "github.com/openconfig/gnoi/system"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 )
 
+// Metadata keys carrying the image digests on OS.Install, matching the ones
+// osservice checks
+const (
+	imageSHA256Metadata    = "image-sha256"
+	imageMD5Metadata       = "image-md5"
+	imageSignatureMetadata = "image-signature"
+)
+
+// signatureSuffix names the detached signature next to an image
+const signatureSuffix = ".sig"
+
+// installChunkSize is the size of each TransferContent message
+const installChunkSize = 64 * 1024
+
 // Client wraps the gRPC connection and SonicUpgradeService client.
 type Client struct {
 	conn          *grpc.ClientConn
@@ -24,16 +49,28 @@ type Client struct {
 	osClient      ospb.OSClient
 }
 
-// NewClient creates a new gRPC client for the SonicUpgradeService.
-func NewClient(target string) (*Client, error) {
-	log.Printf("Creating new gRPC client with target: %q", target)
+// NewClient creates a new gRPC client for the SonicUpgradeService. The
+// connection uses TLS with tlsConfig, or plaintext if it is nil. When
+// tokenFile is set, its content is sent as bearer token with every RPC.
+func NewClient(target string, tlsConfig *tls.Config, tokenFile string) (*Client, error) {
+	slog.Info("Creating gRPC client", "target", target, "tls", tlsConfig != nil)
 	if target == "" {
 		return nil, fmt.Errorf("empty gRPC target specified")
 	}
 
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
 	// Use the recommended gRPC connection options with NewClient
 	opts := []grpc.DialOption{
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithChainUnaryInterceptor(upgradeIDUnaryInterceptor),
+		grpc.WithChainStreamInterceptor(upgradeIDStreamInterceptor),
+	}
+	if tokenFile != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenFileCredentials{path: tokenFile}))
 	}
 
 	conn, err := grpc.NewClient(target, opts...)
@@ -53,13 +90,60 @@ func NewClient(target string) (*Client, error) {
 	}, nil
 }
 
+// tokenFileCredentials sends the token in a file as bearer token. The file
+// is read on every RPC so a rotated token is picked up.
+type tokenFileCredentials struct {
+	path string
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials
+func (t tokenFileCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auth token: %w", err)
+	}
+	return map[string]string{"authorization": "Bearer " + strings.TrimSpace(string(data))}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials. The
+// server warns about tokens over plaintext instead, to keep testing simple.
+func (t tokenFileCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// withUpgradeID attaches the upgrade ID of ctx, if any, as metadata so the
+// server can log the RPC under the same ID as the agent
+func withUpgradeID(ctx context.Context) context.Context {
+	if id := logging.UpgradeID(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, logging.UpgradeIDMetadata, id)
+	}
+	return ctx
+}
+
+// upgradeIDUnaryInterceptor sends the upgrade ID with unary RPCs
+func upgradeIDUnaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(withUpgradeID(ctx), method, req, reply, cc, opts...)
+}
+
+// upgradeIDStreamInterceptor sends the upgrade ID with streaming RPCs
+func upgradeIDStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(withUpgradeID(ctx), desc, cc, method, opts...)
+}
+
 // Close closes the gRPC connection.
 func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
+// rpcLogger returns the logger of ctx for an RPC
+func rpcLogger(ctx context.Context, rpc string) *slog.Logger {
+	return logging.FromContext(ctx).With(logging.KeyRPC, rpc)
+}
+
 // UpdateFirmware starts a firmware update and streams status/log lines back.
-func (c *Client) UpdateFirmware(ctx context.Context, params *gnoisonic.FirmwareUpdateParams) error {
+// Each log line is also passed to progress, if it is not nil.
+func (c *Client) UpdateFirmware(ctx context.Context, params *gnoisonic.FirmwareUpdateParams, progress func(line string)) error {
+	logger := rpcLogger(ctx, "SonicUpgradeService.UpdateFirmware")
 	stream, err := c.client.UpdateFirmware(ctx)
 	if err != nil {
 		return err
@@ -86,28 +170,66 @@ func (c *Client) UpdateFirmware(ctx context.Context, params *gnoisonic.FirmwareU
 		if err != nil {
 			return err
 		}
-		log.Printf("[FW Update] %s (state=%s, exit_code=%d)", resp.GetLogLine(), resp.GetState().String(), resp.GetExitCode())
+		logger.Info("Firmware update output", "line", resp.GetLogLine(), "state", resp.GetState().String(), "exit_code", resp.GetExitCode())
+		if progress != nil && resp.GetLogLine() != "" {
+			progress(resp.GetLogLine())
+		}
+		if resp.GetState() == gnoisonic.UpdateFirmwareStatus_FAILED {
+			return fmt.Errorf("firmware update failed with exit code %d: %s", resp.GetExitCode(), resp.GetLogLine())
+		}
 	}
 	return nil
 }
 
+// ListImages returns the SONiC images installed on the switch
+func (c *Client) ListImages(ctx context.Context) ([]*gnoisonic.ImageInfo, error) {
+	logger := rpcLogger(ctx, "SonicUpgradeService.ListImages")
+	logger.Debug("Listing installed images")
+	resp, err := c.client.ListImages(ctx, &gnoisonic.ListImagesRequest{})
+	if err != nil {
+		logger.Warn("Failed to list images", logging.Err(err))
+		return nil, err
+	}
+
+	for _, image := range resp.GetImages() {
+		logger.Info("Installed image", "version", image.GetVersion(), "current", image.GetCurrent(),
+			"next_boot", image.GetNextBoot(), "size_bytes", image.GetSizeBytes())
+	}
+	return resp.GetImages(), nil
+}
+
+// RemoveImage removes an installed image that is neither running nor set as
+// next boot, and returns the number of bytes reclaimed
+func (c *Client) RemoveImage(ctx context.Context, version string) (uint64, error) {
+	logger := rpcLogger(ctx, "SonicUpgradeService.RemoveImage").With("version", version)
+	logger.Debug("Removing image")
+	resp, err := c.client.RemoveImage(ctx, &gnoisonic.RemoveImageRequest{Version: version})
+	if err != nil {
+		logger.Warn("Failed to remove image", logging.Err(err))
+		return 0, err
+	}
+
+	logger.Info("Removed image", "reclaimed_bytes", resp.GetReclaimedBytes())
+	return resp.GetReclaimedBytes(), nil
+}
+
 // GetSystemTime retrieves the current time from gNOI System service
 func (c *Client) GetSystemTime(ctx context.Context) (*syspb.TimeResponse, error) {
 	if c.systemClient == nil {
 		return nil, fmt.Errorf("system client not initialized")
 	}
 
-	log.Println("Requesting system time via gNOI.System.Time")
+	logger := rpcLogger(ctx, "System.Time")
+	logger.Debug("Requesting system time")
 	timeResp, err := c.systemClient.Time(ctx, &syspb.TimeRequest{})
 	if err != nil {
-		log.Printf("Failed to get system time: %v", err)
+		logger.Warn("Failed to get system time", logging.Err(err))
 		return nil, err
 	}
 
 	// The time is in nanoseconds since epoch
 	nanos := int64(timeResp.GetTime())
-	systemTime := time.Unix(nanos/1e9, nanos%1e9)
-	log.Printf("System time response: time=%v", systemTime)
+	logger.Debug("System time response", "time", time.Unix(nanos/1e9, nanos%1e9))
 	return timeResp, nil
 }
 
@@ -117,36 +239,253 @@ func (c *Client) GetOSVersion(ctx context.Context) (*ospb.VerifyResponse, error)
 		return nil, fmt.Errorf("OS client not initialized")
 	}
 
-	log.Println("Requesting OS version via gNOI.OS.Verify")
+	logger := rpcLogger(ctx, "OS.Verify")
+	logger.Debug("Requesting OS version")
 	verifyResp, err := c.osClient.Verify(ctx, &ospb.VerifyRequest{})
 	if err != nil {
-		log.Printf("Failed to get OS version: %v", err)
+		logger.Warn("Failed to get OS version", logging.Err(err))
 		return nil, err
 	}
 
-	log.Printf("OS version response: version=%v", verifyResp.GetVersion())
+	logger.Debug("OS version response", "version", verifyResp.GetVersion())
 	return verifyResp, nil
 }
 
-// Reboot initiates a system reboot via gNOI System service
-func (c *Client) Reboot(ctx context.Context) error {
+// InstallOS transfers the image at imagePath to the server via gNOI OS.Install
+// and returns once the server has validated it as the given version. The
+// image digests, and the detached signature in imagePath+".sig" if there is
+// one, are attached as metadata so the server can check integrity.
+func (c *Client) InstallOS(ctx context.Context, imagePath, version string) (*ospb.Validated, error) {
+	if c.osClient == nil {
+		return nil, fmt.Errorf("OS client not initialized")
+	}
+
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat image: %w", err)
+	}
+
+	sha := sha256.New()
+	sum := md5.New()
+	if _, err := io.Copy(io.MultiWriter(sha, sum), f); err != nil {
+		return nil, fmt.Errorf("failed to hash image: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind image: %w", err)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		imageSHA256Metadata, hex.EncodeToString(sha.Sum(nil)),
+		imageMD5Metadata, hex.EncodeToString(sum.Sum(nil)))
+
+	sig, err := os.ReadFile(imagePath + signatureSuffix)
+	switch {
+	case err == nil:
+		if _, decodeErr := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); decodeErr != nil {
+			// Binary signatures cannot be sent as text metadata as they are
+			sig = []byte(base64.StdEncoding.EncodeToString(sig))
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, imageSignatureMetadata, strings.TrimSpace(string(sig)))
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("failed to read image signature: %w", err)
+	}
+
+	logger := rpcLogger(ctx, "OS.Install").With("version", version)
+	logger.Info("Installing OS image", "path", imagePath, "size_bytes", info.Size())
+	stream, err := c.osClient.Install(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stream.Send(&ospb.InstallRequest{
+		Request: &ospb.InstallRequest_TransferRequest{
+			TransferRequest: &ospb.TransferRequest{
+				Version:     version,
+				PackageSize: uint64(info.Size()),
+			},
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	// The server either asks for the image or already has it
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	switch r := resp.GetResponse().(type) {
+	case *ospb.InstallResponse_Validated:
+		logger.Info("OS image already present on server", "description", r.Validated.GetDescription())
+		return r.Validated, nil
+	case *ospb.InstallResponse_InstallError:
+		return nil, installError(r.InstallError)
+	case *ospb.InstallResponse_TransferReady:
+	default:
+		return nil, fmt.Errorf("unexpected install response %T", r)
+	}
+
+	// Receive progress while sending, so the server never blocks on a full
+	// response window and errors surface as soon as they happen
+	type result struct {
+		validated *ospb.Validated
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				if err == io.EOF {
+					err = fmt.Errorf("install stream closed without validation")
+				}
+				done <- result{err: err}
+				return
+			}
+			switch r := resp.GetResponse().(type) {
+			case *ospb.InstallResponse_TransferProgress:
+				logger.Debug("OS image transfer progress", "bytes_received", r.TransferProgress.GetBytesReceived(), "size_bytes", info.Size())
+			case *ospb.InstallResponse_Validated:
+				done <- result{validated: r.Validated}
+				return
+			case *ospb.InstallResponse_InstallError:
+				done <- result{err: installError(r.InstallError)}
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, installChunkSize)
+	for {
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&ospb.InstallRequest{
+				Request: &ospb.InstallRequest_TransferContent{TransferContent: buf[:n]},
+			}); err != nil {
+				// The real reason is delivered on the receive side
+				break
+			}
+		}
+		if readErr == io.EOF {
+			if err := stream.Send(&ospb.InstallRequest{
+				Request: &ospb.InstallRequest_TransferEnd{TransferEnd: &ospb.TransferEnd{}},
+			}); err != nil {
+				break
+			}
+			stream.CloseSend()
+			break
+		}
+		if readErr != nil {
+			stream.CloseSend()
+			return nil, fmt.Errorf("failed to read image: %w", readErr)
+		}
+	}
+
+	res := <-done
+	if res.err != nil {
+		logger.Warn("Failed to install OS image", logging.Err(res.err))
+		return nil, res.err
+	}
+
+	logger.Info("OS image validated by server", "description", res.validated.GetDescription())
+	return res.validated, nil
+}
+
+// installError converts an InstallError response into an error
+func installError(e *ospb.InstallError) error {
+	return fmt.Errorf("install failed: %s: %s", e.GetType(), e.GetDetail())
+}
+
+// ActivateOS sets the given OS version as the next-boot image via gNOI OS
+// service. When noReboot is false the server reboots into it immediately.
+func (c *Client) ActivateOS(ctx context.Context, version string, noReboot bool) (*ospb.ActivateResponse, error) {
+	if c.osClient == nil {
+		return nil, fmt.Errorf("OS client not initialized")
+	}
+
+	logger := rpcLogger(ctx, "OS.Activate").With("version", version)
+	logger.Info("Activating OS version", "no_reboot", noReboot)
+	resp, err := c.osClient.Activate(ctx, &ospb.ActivateRequest{
+		Version:  version,
+		NoReboot: noReboot,
+	})
+	if err != nil {
+		logger.Warn("Failed to activate OS version", logging.Err(err))
+		return nil, err
+	}
+
+	if activateErr := resp.GetActivateError(); activateErr != nil {
+		return resp, fmt.Errorf("activate failed: %s: %s", activateErr.GetType(), activateErr.GetDetail())
+	}
+
+	logger.Info("OS version activated")
+	return resp, nil
+}
+
+// rebootMethods maps the reboot method names used in the agent config to gNOI
+// methods. SONiC's fast-reboot has no gNOI method of its own and is requested
+// as NSF.
+var rebootMethods = map[string]syspb.RebootMethod{
+	"cold":      syspb.RebootMethod_COLD,
+	"warm":      syspb.RebootMethod_WARM,
+	"fast":      syspb.RebootMethod_NSF,
+	"powerdown": syspb.RebootMethod_POWERDOWN,
+}
+
+// ParseRebootMethod returns the gNOI reboot method for a config name: cold,
+// warm, fast or powerdown
+func ParseRebootMethod(name string) (syspb.RebootMethod, error) {
+	method, ok := rebootMethods[strings.ToLower(name)]
+	if !ok {
+		return syspb.RebootMethod_UNKNOWN, fmt.Errorf("unknown reboot method %q, expected cold, warm, fast or powerdown", name)
+	}
+	return method, nil
+}
+
+// Reboot initiates a system reboot with the given method via gNOI System service
+func (c *Client) Reboot(ctx context.Context, method syspb.RebootMethod) error {
 	if c.systemClient == nil {
 		return fmt.Errorf("system client not initialized")
 	}
 
-	log.Println("Initiating system COLD reboot via gNOI.System.Reboot")
+	logger := rpcLogger(ctx, "System.Reboot").With("method", method.String())
+	logger.Info("Requesting reboot")
 	_, err := c.systemClient.Reboot(ctx, &syspb.RebootRequest{
-		Method: syspb.RebootMethod_COLD,
-		Force:  true,
+		Method:  method,
+		// Cold reboots are forced as they always were; warm and fast reboots
+		// keep their pre-checks
+		Force:   method == syspb.RebootMethod_COLD,
 		Message: "Rebooting to complete SONiC firmware update",
 	})
 
 	if err != nil {
-		log.Printf("Failed to initiate reboot: %v", err)
+		logger.Warn("Failed to request reboot", logging.Err(err))
+		return err
+	}
+
+	logger.Info("Reboot request sent")
+	return nil
+}
+
+// CancelReboot aborts a reboot scheduled with a delay via gNOI System service
+func (c *Client) CancelReboot(ctx context.Context, message string) error {
+	if c.systemClient == nil {
+		return fmt.Errorf("system client not initialized")
+	}
+
+	logger := rpcLogger(ctx, "System.CancelReboot")
+	logger.Info("Cancelling scheduled reboot", "message", message)
+	if _, err := c.systemClient.CancelReboot(ctx, &syspb.CancelRebootRequest{Message: message}); err != nil {
+		logger.Warn("Failed to cancel reboot", logging.Err(err))
 		return err
 	}
 
-	log.Println("Reboot request successfully sent")
+	logger.Info("Scheduled reboot cancelled")
 	return nil
 }
 
@@ -156,13 +495,15 @@ func (c *Client) GetRebootStatus(ctx context.Context) (*syspb.RebootStatusRespon
 		return nil, fmt.Errorf("system client not initialized")
 	}
 
-	log.Println("Checking reboot status via gNOI.System.RebootStatus")
+	logger := rpcLogger(ctx, "System.RebootStatus")
+	logger.Debug("Checking reboot status")
 	resp, err := c.systemClient.RebootStatus(ctx, &syspb.RebootStatusRequest{})
 	if err != nil {
-		log.Printf("Failed to get reboot status: %v", err)
+		logger.Warn("Failed to get reboot status", logging.Err(err))
 		return nil, err
 	}
 
-	log.Printf("Reboot status: active=%v", resp.GetActive())
+	logger.Info("Reboot status", "active", resp.GetActive(), "wait", time.Duration(resp.GetWait()),
+		"count", resp.GetCount(), "reason", resp.GetReason())
 	return resp, nil
 }
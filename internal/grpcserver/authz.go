@@ -0,0 +1,319 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"upgrade-agent/internal/logging"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// AuthzPolicy is the authorization policy file. Like a gNSI authz policy it
+// lists deny and allow rules matching callers to RPC paths, except that
+// rules grant named roles instead of listing paths themselves:
+//
+//	{
+//	  "name": "upgrade-server",
+//	  "roles": {
+//	    "reader":   {"paths": ["/gnoi.system.System/Time", "/gnoi.os.OS/Verify"]},
+//	    "operator": {"paths": ["/gnoi.system.System/*", "/gnoi.os.OS/*"]}
+//	  },
+//	  "allow_rules": [
+//	    {"name": "agents", "source": {"principals": ["upgrade-agent"]}, "roles": ["operator"]},
+//	    {"name": "monitoring", "source": {"tokens": ["sha256:<hex>"]}, "roles": ["reader"]}
+//	  ]
+//	}
+//
+// A call is denied if a deny rule matches, allowed if an allow rule grants a
+// role covering its path, and denied otherwise.
+type AuthzPolicy struct {
+	Name       string               `json:"name"`
+	Roles      map[string]AuthzRole `json:"roles"`
+	AllowRules []AuthzRule          `json:"allow_rules"`
+	DenyRules  []AuthzRule          `json:"deny_rules"`
+}
+
+// AuthzRole is a set of RPC paths. A path is a full method name such as
+// "/gnoi.system.System/Reboot", a service wildcard such as
+// "/gnoi.system.System/*", or "*" for every RPC.
+type AuthzRole struct {
+	Paths []string `json:"paths"`
+}
+
+// AuthzRule matches callers and grants them roles. Deny rules use Paths
+// directly instead of roles.
+type AuthzRule struct {
+	Name   string      `json:"name"`
+	Source AuthzSource `json:"source"`
+	Roles  []string    `json:"roles,omitempty"`
+	Paths  []string    `json:"paths,omitempty"`
+}
+
+// AuthzSource identifies callers. A caller matches if it presents a verified
+// client certificate with one of Principals as URI SAN, DNS SAN or subject
+// CN ("*" for any verified certificate), or one of Tokens as bearer token in
+// the authorization metadata. Tokens may be given as "sha256:<hex>" to keep
+// them out of the policy file. An empty source matches every caller.
+type AuthzSource struct {
+	Principals []string `json:"principals,omitempty"`
+	Tokens     []string `json:"tokens,omitempty"`
+}
+
+// caller is what is known about the client of an RPC
+type caller struct {
+	principals []string
+	token      string
+}
+
+// String describes the caller for the authorization log
+func (c caller) String() string {
+	parts := []string{}
+	if len(c.principals) > 0 {
+		parts = append(parts, "principals="+strings.Join(c.principals, ","))
+	}
+	if c.token != "" {
+		sum := sha256.Sum256([]byte(c.token))
+		parts = append(parts, "token=sha256:"+hex.EncodeToString(sum[:4]))
+	}
+	if len(parts) == 0 {
+		return "anonymous"
+	}
+	return strings.Join(parts, " ")
+}
+
+// LoadAuthzPolicy reads and validates a policy file
+func LoadAuthzPolicy(path string) (*AuthzPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authz policy: %w", err)
+	}
+	var policy AuthzPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse authz policy %s: %w", path, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid authz policy %s: %w", path, err)
+	}
+	return &policy, nil
+}
+
+// validate checks that every rule is usable
+func (p *AuthzPolicy) validate() error {
+	for _, rule := range p.AllowRules {
+		if rule.Name == "" {
+			return fmt.Errorf("allow rule without a name")
+		}
+		if len(rule.Roles) == 0 {
+			return fmt.Errorf("allow rule %q grants no roles", rule.Name)
+		}
+		for _, role := range rule.Roles {
+			if _, ok := p.Roles[role]; !ok {
+				return fmt.Errorf("allow rule %q grants unknown role %q", rule.Name, role)
+			}
+		}
+	}
+	for _, rule := range p.DenyRules {
+		if rule.Name == "" {
+			return fmt.Errorf("deny rule without a name")
+		}
+		if len(rule.Paths) == 0 {
+			return fmt.Errorf("deny rule %q lists no paths", rule.Name)
+		}
+	}
+	return nil
+}
+
+// usesTokens reports whether any rule matches bearer tokens
+func (p *AuthzPolicy) usesTokens() bool {
+	for _, rules := range [][]AuthzRule{p.AllowRules, p.DenyRules} {
+		for _, rule := range rules {
+			if len(rule.Source.Tokens) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorize returns the rule and role that decided the call, and whether it
+// is allowed
+func (p *AuthzPolicy) authorize(c caller, method string) (rule, role string, allowed bool) {
+	for _, r := range p.DenyRules {
+		if r.Source.matches(c) && matchesAnyPath(r.Paths, method) {
+			return r.Name, "", false
+		}
+	}
+	for _, r := range p.AllowRules {
+		if !r.Source.matches(c) {
+			continue
+		}
+		for _, name := range r.Roles {
+			if matchesAnyPath(p.Roles[name].Paths, method) {
+				return r.Name, name, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// matches reports whether the caller is identified by the source
+func (s AuthzSource) matches(c caller) bool {
+	if len(s.Principals) == 0 && len(s.Tokens) == 0 {
+		return true
+	}
+	for _, want := range s.Principals {
+		for _, have := range c.principals {
+			if want == "*" || want == have {
+				return true
+			}
+		}
+	}
+	if c.token != "" {
+		for _, want := range s.Tokens {
+			if tokenMatches(want, c.token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenMatches compares a presented token against a policy entry in constant time
+func tokenMatches(want, token string) bool {
+	if hexSum, ok := strings.CutPrefix(want, "sha256:"); ok {
+		sum := sha256.Sum256([]byte(token))
+		return subtle.ConstantTimeCompare([]byte(strings.ToLower(hexSum)), []byte(hex.EncodeToString(sum[:]))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(token)) == 1
+}
+
+// matchesAnyPath reports whether method is covered by one of the paths
+func matchesAnyPath(paths []string, method string) bool {
+	for _, path := range paths {
+		if path == "*" || path == method {
+			return true
+		}
+		if service, ok := strings.CutSuffix(path, "/*"); ok && strings.HasPrefix(method, service+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// callerFromContext collects the verified certificate identities and the
+// bearer token of the RPC
+func callerFromContext(ctx context.Context) caller {
+	var c caller
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			cert := info.State.VerifiedChains[0][0]
+			for _, uri := range cert.URIs {
+				c.principals = append(c.principals, uri.String())
+			}
+			c.principals = append(c.principals, cert.DNSNames...)
+			if cert.Subject.CommonName != "" {
+				c.principals = append(c.principals, cert.Subject.CommonName)
+			}
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, value := range md.Get("authorization") {
+			if token, ok := strings.CutPrefix(value, "Bearer "); ok {
+				c.token = strings.TrimSpace(token)
+				break
+			}
+		}
+	}
+	return c
+}
+
+// authorizer enforces the policy file at path, reloading it when it changes
+type authorizer struct {
+	path    string
+	lock    sync.Mutex
+	policy  *AuthzPolicy
+	modTime time.Time
+}
+
+// newAuthorizer loads the policy file, failing if it is invalid
+func newAuthorizer(path string) (*authorizer, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authz policy: %w", err)
+	}
+	policy, err := LoadAuthzPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Loaded authz policy", "policy", policy.Name, "path", path,
+		"allow_rules", len(policy.AllowRules), "deny_rules", len(policy.DenyRules))
+	return &authorizer{path: path, policy: policy, modTime: info.ModTime()}, nil
+}
+
+// current returns the policy, reloading it first if the file changed. An
+// invalid new policy is logged and the previous one stays in force.
+func (a *authorizer) current() *AuthzPolicy {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	info, err := os.Stat(a.path)
+	if err != nil || info.ModTime().Equal(a.modTime) {
+		return a.policy
+	}
+	policy, err := LoadAuthzPolicy(a.path)
+	if err != nil {
+		slog.Error("Failed to reload authz policy, keeping the current one", "policy", a.policy.Name, "path", a.path, logging.Err(err))
+		a.modTime = info.ModTime()
+		return a.policy
+	}
+	slog.Info("Reloaded authz policy", "policy", policy.Name, "path", a.path)
+	a.policy, a.modTime = policy, info.ModTime()
+	return a.policy
+}
+
+// check authorizes one call and logs the decision
+func (a *authorizer) check(ctx context.Context, method string) error {
+	c := callerFromContext(ctx)
+	logger := logging.FromContext(ctx).With("caller", c.String())
+	rule, role, allowed := a.current().authorize(c, method)
+	if !allowed {
+		if rule == "" {
+			rule = "default"
+		}
+		logger.Warn("Authz denied RPC", "rule", rule)
+		return status.Errorf(codes.PermissionDenied, "%s is not authorized to call %s", c, method)
+	}
+	logger.Info("Authz allowed RPC", "rule", rule, "role", role)
+	return nil
+}
+
+// unaryInterceptor authorizes unary RPCs
+func (a *authorizer) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := a.check(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamInterceptor authorizes streaming RPCs
+func (a *authorizer) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := a.check(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
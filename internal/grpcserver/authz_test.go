@@ -0,0 +1,176 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const testPolicy = `{
+  "name": "upgrade-server",
+  "roles": {
+    "reader":   {"paths": ["/gnoi.system.System/Time", "/gnoi.os.OS/Verify"]},
+    "operator": {"paths": ["/gnoi.system.System/*", "/gnoi.os.OS/*"]}
+  },
+  "allow_rules": [
+    {"name": "agents", "source": {"principals": ["upgrade-agent"]}, "roles": ["operator"]},
+    {"name": "monitoring", "source": {"tokens": ["sha256:%s", "plain-token"]}, "roles": ["reader"]}
+  ],
+  "deny_rules": [
+    {"name": "no-reboot", "source": {"principals": ["lab-agent"]}, "paths": ["/gnoi.system.System/Reboot"]}
+  ]
+}`
+
+// writePolicy writes a policy file with a modification time that differs
+// from any earlier write
+func writePolicy(t *testing.T, path, policy string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPolicyFile writes testPolicy, accepting "monitor-token" by its hash
+func testPolicyFile(t *testing.T) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte("monitor-token"))
+	path := filepath.Join(t.TempDir(), "authz.json")
+	writePolicy(t, path, fmt.Sprintf(testPolicy, hex.EncodeToString(sum[:])), time.Now())
+	return path
+}
+
+// callerContext returns the context of an RPC from a client with a verified
+// certificate for commonName, if set, and a bearer token, if set
+func callerContext(commonName, token string) context.Context {
+	ctx := context.Background()
+	if commonName != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+		}})
+	}
+	if token != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+	}
+	return ctx
+}
+
+func TestAuthorizerCheck(t *testing.T) {
+	a, err := newAuthorizer(testPolicyFile(t))
+	if err != nil {
+		t.Fatalf("newAuthorizer() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		commonName string
+		token      string
+		method     string
+		wantErr    bool
+	}{
+		{"principal with service wildcard", "upgrade-agent", "", "/gnoi.system.System/Reboot", false},
+		{"principal outside its roles", "upgrade-agent", "", "/gnoi.file.File/Put", true},
+		{"deny rule", "lab-agent", "", "/gnoi.system.System/Reboot", true},
+		{"hashed token", "", "monitor-token", "/gnoi.os.OS/Verify", false},
+		{"plain token", "", "plain-token", "/gnoi.system.System/Time", false},
+		{"token outside its role", "", "monitor-token", "/gnoi.system.System/Reboot", true},
+		{"unknown token", "", "guessed-token", "/gnoi.os.OS/Verify", true},
+		{"unknown principal", "someone", "", "/gnoi.os.OS/Verify", true},
+		{"anonymous", "", "", "/gnoi.system.System/Time", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.check(callerContext(tt.commonName, tt.token), tt.method)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("check() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && status.Code(err) != codes.PermissionDenied {
+				t.Errorf("check() code = %v, want PermissionDenied", status.Code(err))
+			}
+		})
+	}
+}
+
+func TestAuthorizerInterceptors(t *testing.T) {
+	a, err := newAuthorizer(testPolicyFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	handler := func(ctx context.Context, req any) (any, error) {
+		called = true
+		return req, nil
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/gnoi.system.System/Reboot"}
+	if _, err := a.unaryInterceptor(callerContext("", "monitor-token"), nil, info, handler); err == nil || called {
+		t.Errorf("unaryInterceptor() error = %v, handler called %v, want denied before the handler", err, called)
+	}
+	if _, err := a.unaryInterceptor(callerContext("upgrade-agent", ""), nil, info, handler); err != nil || !called {
+		t.Errorf("unaryInterceptor() error = %v, handler called %v, want the handler called", err, called)
+	}
+}
+
+func TestAuthorizerReload(t *testing.T) {
+	path := testPolicyFile(t)
+	a, err := newAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := callerContext("upgrade-agent", "")
+
+	// An invalid policy keeps the current one in force
+	writePolicy(t, path, `{"allow_rules": [{"name": "agents", "roles": ["missing"]}]}`, time.Now().Add(time.Minute))
+	if err := a.check(ctx, "/gnoi.os.OS/Install"); err != nil {
+		t.Errorf("check() after an invalid policy error = %v, want the previous policy kept", err)
+	}
+
+	writePolicy(t, path, `{"name": "locked-down"}`, time.Now().Add(2*time.Minute))
+	if err := a.check(ctx, "/gnoi.os.OS/Install"); err == nil {
+		t.Errorf("check() after the policy was replaced succeeded, want denied")
+	}
+}
+
+func TestLoadAuthzPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+	}{
+		{"not JSON", `{"name": `},
+		{"allow rule without a name", `{"roles": {"r": {"paths": ["*"]}}, "allow_rules": [{"roles": ["r"]}]}`},
+		{"allow rule without roles", `{"allow_rules": [{"name": "agents"}]}`},
+		{"unknown role", `{"allow_rules": [{"name": "agents", "roles": ["admin"]}]}`},
+		{"deny rule without a name", `{"deny_rules": [{"paths": ["*"]}]}`},
+		{"deny rule without paths", `{"deny_rules": [{"name": "everyone"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "authz.json")
+			writePolicy(t, path, tt.policy, time.Now())
+			if _, err := LoadAuthzPolicy(path); err == nil {
+				t.Errorf("LoadAuthzPolicy() succeeded, want an error")
+			}
+		})
+	}
+	if _, err := LoadAuthzPolicy(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("LoadAuthzPolicy() of a missing file succeeded, want an error")
+	}
+}
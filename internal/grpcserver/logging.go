@@ -0,0 +1,101 @@
+package grpcserver
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"upgrade-agent/internal/logging"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// An upgrade ID taken from a client is copied into every log line of the
+// RPC, so it is limited to a short plain token
+const (
+	maxUpgradeIDLength = 64
+	upgradeIDChars     = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_."
+)
+
+// incomingUpgradeID returns the upgrade ID the agent sent with an RPC, or ""
+// if there is none or it is not a plain token
+func incomingUpgradeID(ctx context.Context) string {
+	values := metadata.ValueFromIncomingContext(ctx, logging.UpgradeIDMetadata)
+	if len(values) == 0 {
+		return ""
+	}
+	id := values[0]
+	if id == "" || len(id) > maxUpgradeIDLength || strings.TrimLeft(id, upgradeIDChars) != "" {
+		return ""
+	}
+	return id
+}
+
+// rpcContext tags ctx with the RPC name and the upgrade ID sent by the
+// client for the handler and its logs, and returns the tagged logger too
+func rpcContext(ctx context.Context, fullMethod string) (context.Context, *slog.Logger) {
+	logger := slog.Default().With(logging.KeyRPC, logging.RPCName(fullMethod))
+	if id := incomingUpgradeID(ctx); id != "" {
+		logger = logger.With(logging.KeyUpgradeID, id)
+		ctx = logging.WithUpgradeID(ctx, id)
+	}
+	return logging.WithLogger(ctx, logger), logger
+}
+
+// echoUpgradeID returns the upgrade ID in the response header, so the caller
+// sees which upgrade the server logged the RPC under
+func echoUpgradeID(ctx context.Context, logger *slog.Logger, setHeader func(metadata.MD) error) {
+	id := logging.UpgradeID(ctx)
+	if id == "" {
+		return
+	}
+	if err := setHeader(metadata.Pairs(logging.UpgradeIDMetadata, id)); err != nil {
+		logger.Debug("Failed to echo the upgrade ID", logging.Err(err))
+	}
+}
+
+// logRPC logs how an RPC ended: failures as warnings, the rest at debug level
+func logRPC(logger *slog.Logger, start time.Time, err error) {
+	duration := time.Since(start)
+	if err != nil {
+		logger.Warn("RPC failed", "code", status.Code(err).String(), "duration", duration, logging.Err(err))
+		return
+	}
+	logger.Debug("RPC finished", "duration", duration)
+}
+
+// loggingUnaryInterceptor hands unary handlers a logger for the RPC in their
+// context, see logging.FromContext, and echoes the upgrade ID
+func loggingUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, logger := rpcContext(ctx, info.FullMethod)
+	echoUpgradeID(ctx, logger, func(md metadata.MD) error { return grpc.SetHeader(ctx, md) })
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logRPC(logger, start, err)
+	return resp, err
+}
+
+// loggingStreamInterceptor hands streaming handlers a logger for the RPC in
+// the context of their stream, and echoes the upgrade ID
+func loggingStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, logger := rpcContext(ss.Context(), info.FullMethod)
+	echoUpgradeID(ctx, logger, ss.SetHeader)
+	start := time.Now()
+	err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	logRPC(logger, start, err)
+	return err
+}
+
+// contextStream is a server stream with a replaced context
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the replaced context
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,43 @@
+package grpcserver
+
+import (
+	"context"
+	"time"
+
+	"upgrade-agent/internal/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// RPC metrics, labelled with the full method name such as
+// /gnoi.system.System/Reboot
+var (
+	grpcRequests = metrics.NewCounter("upgrade_server_grpc_requests_total",
+		"RPCs handled, by method and status code", "method", "code")
+	grpcDuration = metrics.NewHistogram("upgrade_server_grpc_request_duration_seconds",
+		"Time taken to handle RPCs, by method", metrics.DurationBuckets, "method")
+)
+
+// observeRPC records a finished RPC
+func observeRPC(method string, start time.Time, err error) {
+	grpcRequests.Inc(method, status.Code(err).String())
+	grpcDuration.Observe(time.Since(start).Seconds(), method)
+}
+
+// metricsUnaryInterceptor measures unary RPCs. It runs before authorization,
+// so denied calls are counted too.
+func metricsUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+// metricsStreamInterceptor measures streaming RPCs until the stream ends
+func metricsStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeRPC(info.FullMethod, start, err)
+	return err
+}
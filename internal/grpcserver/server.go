@@ -2,20 +2,28 @@
 package grpcserver
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	gnoisonic "upgrade-agent/gnoi_sonic"
+	"upgrade-agent/internal/bootloader"
+	"upgrade-agent/internal/executor"
+	"upgrade-agent/internal/logging"
 	"upgrade-agent/internal/osservice"
+	"upgrade-agent/internal/signature"
 	"upgrade-agent/internal/sonicservice"
 	"upgrade-agent/internal/systemservice"
+	"upgrade-agent/internal/tlsconfig"
 
 	gnoios "github.com/openconfig/gnoi/os"
 	"github.com/openconfig/gnoi/system"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
 )
 
@@ -28,17 +36,122 @@ type Server struct {
 	listener        net.Listener
 }
 
+// Options configures the server and the services it hosts
+type Options struct {
+	// Port is the TCP port to listen on
+	Port string
+	// FakeReboot makes System.Reboot log instead of rebooting the host
+	FakeReboot bool
+	// RebootStateFile persists the reboot counter and the last reboot
+	RebootStateFile string
+	// Executor selects how host commands are run: "nsenter", "systemd",
+	// "local" or "fake", see executor.New
+	Executor string
+	// InstallerCommand overrides the command used to install firmware images
+	InstallerCommand []string
+	// DownloadDir is where firmware fetched from a URL is staged
+	DownloadDir string
+	// ImageDir is where OS.Install stages transferred images
+	ImageDir string
+	// Bootloader selects the backend OS.Activate and the image inventory use:
+	// "sonic-installer" or "file"
+	Bootloader string
+	// BootloaderFile is the state file of the "file" bootloader
+	BootloaderFile string
+	// TrustedKeys is a PEM file or directory of public keys that firmware
+	// signatures are verified against
+	TrustedKeys string
+	// RequireSignature rejects firmware without a valid signature
+	RequireSignature bool
+	// TLSCertFile and TLSKeyFile enable TLS with the given certificate
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile enables mutual TLS: clients must present a certificate
+	// signed by one of the CAs in this bundle
+	TLSClientCAFile string
+	// AuthzPolicy is the authorization policy file, see AuthzPolicy. Every
+	// caller may call every RPC if it is empty.
+	AuthzPolicy string
+}
+
 // NewServer creates a new instance of Server
-func NewServer(port string, fakeReboot bool) (*Server, error) {
-	lis, err := net.Listen("tcp", "0.0.0.0:"+port)
+func NewServer(opts Options) (*Server, error) {
+	lis, err := net.Listen("tcp", "0.0.0.0:"+opts.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	hostExecutor, err := executor.New(opts.Executor, "")
 	if err != nil {
+		lis.Close()
 		return nil, err
 	}
+	slog.Info("Host commands run through an executor", "executor", hostExecutor.Name())
+
+	bl, err := bootloader.New(opts.Bootloader, opts.BootloaderFile, hostExecutor)
+	if err != nil {
+		lis.Close()
+		return nil, err
+	}
+
+	policy := signature.Policy{Required: opts.RequireSignature}
+	if opts.TrustedKeys != "" {
+		if policy.Verifier, err = signature.LoadVerifier(opts.TrustedKeys); err != nil {
+			lis.Close()
+			return nil, err
+		}
+	} else if opts.RequireSignature {
+		lis.Close()
+		return nil, fmt.Errorf("requiring firmware signatures needs trusted keys")
+	}
+
+	// Give every RPC a logger and measure it, including those authorization
+	// rejects
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(loggingUnaryInterceptor, metricsUnaryInterceptor),
+		grpc.ChainStreamInterceptor(loggingStreamInterceptor, metricsStreamInterceptor),
+	}
+	if opts.TLSCertFile != "" || opts.TLSKeyFile != "" {
+		tlsConfig, err := tlsconfig.NewServerConfig(tlsconfig.Files{
+			CertFile: opts.TLSCertFile,
+			KeyFile:  opts.TLSKeyFile,
+			CAFile:   opts.TLSClientCAFile,
+		})
+		if err != nil {
+			lis.Close()
+			return nil, err
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		slog.Info("TLS enabled", "client_certificates_required", opts.TLSClientCAFile != "")
+	} else if opts.TLSClientCAFile != "" {
+		lis.Close()
+		return nil, fmt.Errorf("verifying client certificates requires a server certificate")
+	} else {
+		slog.Warn("TLS is disabled, RPCs are served in plaintext")
+	}
+
+	if opts.AuthzPolicy != "" {
+		authz, err := newAuthorizer(opts.AuthzPolicy)
+		if err != nil {
+			lis.Close()
+			return nil, err
+		}
+		if authz.policy.usesTokens() && opts.TLSCertFile == "" {
+			slog.Warn("Authz policy matches bearer tokens but TLS is disabled, tokens are sent in plaintext")
+		}
+		serverOpts = append(serverOpts,
+			grpc.ChainUnaryInterceptor(authz.unaryInterceptor),
+			grpc.ChainStreamInterceptor(authz.streamInterceptor))
+	} else {
+		slog.Warn("No authz policy configured, every caller may call every RPC")
+	}
 
-	grpcServer := grpc.NewServer()
-	sonicSvc := sonicservice.NewService()
-	systemSvc := systemservice.NewService(fakeReboot)
-	osSvc := osservice.NewOSService()
+	grpcServer := grpc.NewServer(serverOpts...)
+	// Both services change the images through bl and share its lock
+	imageLock := &sync.Mutex{}
+	sonicSvc := sonicservice.NewService(opts.InstallerCommand, opts.DownloadDir, hostExecutor, bl, imageLock, policy)
+	systemSvc := systemservice.NewService(opts.FakeReboot, opts.RebootStateFile, hostExecutor)
+	osSvc := osservice.NewOSService(opts.ImageDir, bl, imageLock, systemSvc, policy)
 
 	// Register services
 	gnoisonic.RegisterSonicUpgradeServiceServer(grpcServer, sonicSvc)
@@ -59,14 +172,14 @@ func NewServer(port string, fakeReboot bool) (*Server, error) {
 
 // Start begins serving gRPC requests
 func (s *Server) Start() error {
-	log.Printf("Server listening at %v", s.listener.Addr())
+	slog.Info("Server listening", "addr", s.listener.Addr().String())
 	return s.grpcServer.Serve(s.listener)
 }
 
 // Stop gracefully stops the server
 func (s *Server) Stop() {
 	s.grpcServer.GracefulStop()
-	log.Println("Server stopped gracefully")
+	slog.Info("Server stopped gracefully")
 }
 
 // RunUntilSignaled runs the server until it receives a termination signal
@@ -74,7 +187,7 @@ func (s *Server) RunUntilSignaled() {
 	// Start server in a goroutine
 	go func() {
 		if err := s.Start(); err != nil {
-			log.Fatalf("Failed to serve: %v", err)
+			logging.Fatal("Failed to serve", logging.Err(err))
 		}
 	}()
 
@@ -83,6 +196,6 @@ func (s *Server) RunUntilSignaled() {
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-sigCh
 
-	log.Printf("Received signal %v, shutting down...", sig)
+	slog.Info("Received signal, shutting down", "signal", sig.String())
 	s.Stop()
 }
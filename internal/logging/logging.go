@@ -0,0 +1,135 @@
+// Package logging sets up the structured, leveled logger shared by the agent
+// and the server, and carries request and upgrade scoped loggers in contexts
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Attribute keys shared by the agent and the server, so one upgrade can be
+// followed across both
+const (
+	KeyUpgradeID     = "upgrade_id"
+	KeyTargetVersion = "target_version"
+	KeyPhase         = "phase"
+	KeyRPC           = "rpc"
+	KeyError         = "error"
+)
+
+// UpgradeIDMetadata is the gRPC metadata key carrying the upgrade ID from the
+// agent to the server, which echoes it in its response header
+const UpgradeIDMetadata = "x-upgrade-id"
+
+// level is the minimum level logged; it can change while running
+var level slog.LevelVar
+
+// Setup installs the default logger writing to w in format, "text" or
+// "json", at levelName, see ParseLevel. Empty values mean text and info. Code
+// still using the log package logs through it at info level.
+func Setup(w io.Writer, levelName, format string) error {
+	if err := SetLevel(levelName); err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: &level}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("log format must be text or json, got %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// ParseLevel parses debug, info, warn or error. "verbose" is accepted as
+// debug and "warning" as warn; empty means info.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug", "verbose":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("log level must be debug, info, warn or error, got %q", name)
+}
+
+// SetLevel changes the minimum level logged
+func SetLevel(name string) error {
+	l, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// Level returns the minimum level logged
+func Level() slog.Level {
+	return level.Level()
+}
+
+// RPCName shortens a full gRPC method name such as
+// "/gnoi.system.System/Reboot" to "System.Reboot", the form used for the
+// rpc attribute on both sides of a call
+func RPCName(fullMethod string) string {
+	service, method, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return fullMethod
+	}
+	if i := strings.LastIndex(service, "."); i >= 0 {
+		service = service[i+1:]
+	}
+	return service + "." + method
+}
+
+// Err is the attribute of an error
+func Err(err error) slog.Attr {
+	return slog.Any(KeyError, err)
+}
+
+// Fatal logs msg at error level and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type contextKey struct{}
+
+type upgradeIDKey struct{}
+
+// WithLogger returns a context carrying logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// WithUpgradeID returns a context carrying the ID of the upgrade it works on
+func WithUpgradeID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, upgradeIDKey{}, id)
+}
+
+// UpgradeID returns the upgrade ID carried by ctx, or "" if there is none
+func UpgradeID(ctx context.Context) string {
+	id, _ := ctx.Value(upgradeIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,269 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format. It covers the small subset of the
+// Prometheus client the agent and the server need, without the dependency:
+// client_golang and its own dependencies are not part of the module set the
+// binaries are built from, and a handful of labelled counters, gauges and
+// histograms do not justify adding them. Anything beyond that subset, such as
+// summaries or process metrics, should move to client_golang instead.
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"upgrade-agent/internal/logging"
+)
+
+// DurationBuckets are histogram buckets in seconds for steps taking between
+// milliseconds and half an hour
+var DurationBuckets = []float64{0.005, 0.025, 0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1800}
+
+// registry holds every metric created by this package
+var registry struct {
+	lock     sync.Mutex
+	families []*family
+}
+
+// family is a metric with all of its label combinations
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+// series is the value of a family for one combination of label values
+type series struct {
+	labelValues []string
+	value       float64
+	// counts holds the observations per bucket of a histogram, not cumulative
+	counts []uint64
+	count  uint64
+}
+
+// register adds a family to the registry. Metrics are created once at
+// package initialization, so a duplicate name is a programming error.
+func register(name, help, kind string, buckets []float64, labels []string) *family {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	for _, f := range registry.families {
+		if f.name == name {
+			panic("metrics: duplicate metric " + name)
+		}
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	// A metric without labels is exported as zero before it is first set
+	if len(labels) == 0 {
+		f.get(nil)
+	}
+	registry.families = append(registry.families, f)
+	return f
+}
+
+// get returns the series for the label values, creating it on first use.
+// Called with f.lock held, except during registration.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter is a value that only goes up, such as a number of requests
+type Counter struct{ f *family }
+
+// NewCounter creates a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{register(name, help, "counter", nil, labels)}
+}
+
+// Inc adds one to the counter for the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter for the label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.f.lock.Lock()
+	defer c.f.lock.Unlock()
+	c.f.get(labelValues).value += v
+}
+
+// Gauge is a value that goes up and down, such as work in progress
+type Gauge struct{ f *family }
+
+// NewGauge creates a gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{register(name, help, "gauge", nil, labels)}
+}
+
+// Set sets the gauge for the label values
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.lock.Lock()
+	defer g.f.lock.Unlock()
+	g.f.get(labelValues).value = v
+}
+
+// Histogram counts observations, such as durations, into buckets
+type Histogram struct{ f *family }
+
+// NewHistogram creates a histogram with the given upper bucket bounds, in
+// increasing order, and label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{register(name, help, "histogram", buckets, labels)}
+}
+
+// Observe records v for the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.lock.Lock()
+	defer h.f.lock.Unlock()
+	s := h.f.get(labelValues)
+	s.value += v
+	s.count++
+	if i := sort.SearchFloat64s(h.f.buckets, v); i < len(h.f.buckets) {
+		s.counts[i]++
+	}
+}
+
+// Write writes every metric in the Prometheus text exposition format
+func Write(w io.Writer) error {
+	registry.lock.Lock()
+	families := append([]*family{}, registry.families...)
+	registry.lock.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// write renders the family with its series sorted by label values
+func (f *family) write(b *strings.Builder) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, f.labelPairs(s, ""), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelPairs(s, formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelPairs(s, "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, f.labelPairs(s, ""), formatValue(s.value))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, f.labelPairs(s, ""), s.count)
+	}
+}
+
+// labelPairs renders the labels of a series, with the le label of a
+// histogram bucket if le is set
+func (f *family) labelPairs(s *series, le string) string {
+	var pairs []string
+	for i, name := range f.labels {
+		pairs = append(pairs, name+`="`+escapeLabel(s.labelValues[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeHelp escapes a help text as the text format requires
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// escapeLabel escapes a label value as the text format requires
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// formatValue renders a sample value
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves the metrics to Prometheus
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := Write(w); err != nil {
+			slog.Debug("Failed to write metrics", logging.Err(err))
+		}
+	})
+}
+
+// Serve serves the metrics under /metrics on addr in the background
+func Serve(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics on %s: %w", addr, err)
+	}
+	slog.Info("Serving metrics", "addr", listener.Addr().String(), "path", "/metrics")
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server stopped", logging.Err(err))
+		}
+	}()
+	return server, nil
+}
@@ -0,0 +1,129 @@
+package osservice
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	gnoios "github.com/openconfig/gnoi/os"
+	"github.com/openconfig/gnoi/system"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"upgrade-agent/internal/logging"
+)
+
+// Activate implements the gNOI OS.Activate RPC. The requested version must be
+// installed, or staged by OS.Install in which case it is installed first. It
+// becomes the next-boot image and, unless no_reboot is set, the system is
+// rebooted into it.
+func (s *OSService) Activate(ctx context.Context, req *gnoios.ActivateRequest) (*gnoios.ActivateResponse, error) {
+	version := req.GetVersion()
+	logger := logging.FromContext(ctx).With("version", version)
+	logger.Info("Received activate request", "no_reboot", req.GetNoReboot())
+
+	if req.GetStandbySupervisor() {
+		return activateError(gnoios.ActivateError_UNSPECIFIED, "no standby supervisor on this system"), nil
+	}
+	if version == "" {
+		return activateError(gnoios.ActivateError_NON_EXISTENT_VERSION, "no version specified"), nil
+	}
+	if s.bootloader == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no bootloader configured")
+	}
+
+	image, errResp, err := s.activateImage(ctx, version)
+	if err != nil || errResp != nil {
+		return errResp, err
+	}
+	logger.Info("Next boot image set", "image", image)
+
+	if !req.GetNoReboot() {
+		if s.rebooter == nil {
+			return nil, status.Error(codes.FailedPrecondition, "next boot image set but no rebooter configured")
+		}
+		if _, err := s.rebooter.Reboot(ctx, &system.RebootRequest{
+			Method:  system.RebootMethod_COLD,
+			Message: "Rebooting to activate " + image,
+		}); err != nil {
+			return nil, status.Errorf(codes.Internal, "next boot image set but reboot failed: %v", err)
+		}
+	}
+
+	return &gnoios.ActivateResponse{
+		Response: &gnoios.ActivateResponse_ActivateOk{ActivateOk: &gnoios.ActivateOK{}},
+	}, nil
+}
+
+// activateImage makes version the next-boot image, installing it first if it
+// is only staged. The image lock is held throughout so the image cannot be
+// removed, nor next boot changed, in between.
+func (s *OSService) activateImage(ctx context.Context, version string) (string, *gnoios.ActivateResponse, error) {
+	s.imageLock.Lock()
+	defer s.imageLock.Unlock()
+
+	image, err := s.findOrInstallImage(ctx, version)
+	if err != nil {
+		return "", nil, status.Errorf(codes.Internal, "failed to look up version %s: %v", version, err)
+	}
+	if image == "" {
+		logging.FromContext(ctx).Warn("Version is not installed", "version", version)
+		return "", activateError(gnoios.ActivateError_NON_EXISTENT_VERSION,
+			fmt.Sprintf("version %s is not installed", version)), nil
+	}
+
+	if err := s.bootloader.SetNextBoot(image); err != nil {
+		return "", nil, status.Errorf(codes.Internal, "failed to set next boot image: %v", err)
+	}
+	return image, nil, nil
+}
+
+// findOrInstallImage returns the installed image name for version, installing
+// a staged image first if needed. It returns an empty name if the version is
+// neither installed nor staged.
+func (s *OSService) findOrInstallImage(ctx context.Context, version string) (string, error) {
+	images, err := s.bootloader.ListImages()
+	if err != nil {
+		return "", err
+	}
+	if image, ok := images.FindImage(version); ok {
+		return image, nil
+	}
+
+	// Hold the install lock so OS.Install cannot replace the staged image
+	// while it is being installed
+	s.installLock.Lock()
+	defer s.installLock.Unlock()
+
+	stagedPath := s.imagePath(version)
+	if _, err := os.Stat(stagedPath); err != nil {
+		return "", nil
+	}
+
+	logging.FromContext(ctx).Info("Installing staged image", "version", version, "path", stagedPath)
+	if err := s.bootloader.InstallImage(version, stagedPath); err != nil {
+		return "", err
+	}
+
+	images, err = s.bootloader.ListImages()
+	if err != nil {
+		return "", err
+	}
+	image, ok := images.FindImage(version)
+	if !ok {
+		return "", fmt.Errorf("version %s still missing after installing %s", version, stagedPath)
+	}
+	return image, nil
+}
+
+// activateError builds an ActivateError response
+func activateError(errType gnoios.ActivateError_Type, detail string) *gnoios.ActivateResponse {
+	return &gnoios.ActivateResponse{
+		Response: &gnoios.ActivateResponse_ActivateError{
+			ActivateError: &gnoios.ActivateError{
+				Type:   errType,
+				Detail: detail,
+			},
+		},
+	}
+}
@@ -0,0 +1,162 @@
+package osservice
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	gnoios "github.com/openconfig/gnoi/os"
+	"github.com/openconfig/gnoi/system"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"upgrade-agent/internal/bootloader"
+	"upgrade-agent/internal/signature"
+)
+
+// fakeRebooter records reboot requests and fails them with err
+type fakeRebooter struct {
+	requests []*system.RebootRequest
+	err      error
+}
+
+func (f *fakeRebooter) Reboot(ctx context.Context, req *system.RebootRequest) (*system.RebootResponse, error) {
+	f.requests = append(f.requests, req)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &system.RebootResponse{}, nil
+}
+
+// newFileBootloader creates a FileBootloader running 1.0 with 2.0 also
+// installed
+func newFileBootloader(t *testing.T) *bootloader.FileBootloader {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bootloader.json")
+	state := `{"current": "SONiC-OS-1.0", "next": "SONiC-OS-1.0", "available": ["SONiC-OS-1.0", "SONiC-OS-2.0"]}`
+	if err := os.WriteFile(path, []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return bootloader.NewFileBootloader(path)
+}
+
+func TestActivate(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       *gnoios.ActivateRequest
+		rebootErr error
+		// staged is a version staged by OS.Install beforehand
+		staged string
+		// wantError is the ActivateError type expected, UNSPECIFIED for
+		// ActivateOK unless wantStandbyError is set
+		wantError        gnoios.ActivateError_Type
+		wantStandbyError bool
+		wantCode         codes.Code
+		wantNext         string
+		wantReboot       bool
+		wantAvailable    string
+	}{
+		{
+			name:       "installed version",
+			req:        &gnoios.ActivateRequest{Version: "2.0"},
+			wantNext:   "SONiC-OS-2.0",
+			wantReboot: true,
+		},
+		{
+			name:     "prefixed version",
+			req:      &gnoios.ActivateRequest{Version: "SONiC.2.0", NoReboot: true},
+			wantNext: "SONiC-OS-2.0",
+		},
+		{
+			name:     "no reboot",
+			req:      &gnoios.ActivateRequest{Version: "2.0", NoReboot: true},
+			wantNext: "SONiC-OS-2.0",
+		},
+		{
+			name:          "staged version",
+			req:           &gnoios.ActivateRequest{Version: "3.0"},
+			staged:        "3.0",
+			wantNext:      "SONiC-OS-3.0",
+			wantReboot:    true,
+			wantAvailable: "SONiC-OS-3.0",
+		},
+		{
+			name:      "unknown version",
+			req:       &gnoios.ActivateRequest{Version: "4.0"},
+			wantError: gnoios.ActivateError_NON_EXISTENT_VERSION,
+			wantNext:  "SONiC-OS-1.0",
+		},
+		{
+			name:      "no version",
+			req:       &gnoios.ActivateRequest{},
+			wantError: gnoios.ActivateError_NON_EXISTENT_VERSION,
+			wantNext:  "SONiC-OS-1.0",
+		},
+		{
+			name:             "standby supervisor",
+			req:              &gnoios.ActivateRequest{Version: "2.0", StandbySupervisor: true},
+			wantStandbyError: true,
+			wantNext:         "SONiC-OS-1.0",
+		},
+		{
+			name:       "reboot fails",
+			req:        &gnoios.ActivateRequest{Version: "2.0"},
+			rebootErr:  errors.New("reboot already scheduled"),
+			wantCode:   codes.Internal,
+			wantNext:   "SONiC-OS-2.0",
+			wantReboot: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imageDir := t.TempDir()
+			bl := newFileBootloader(t)
+			rebooter := &fakeRebooter{err: tt.rebootErr}
+			s := NewOSService(imageDir, bl, nil, rebooter, signature.Policy{})
+			if tt.staged != "" {
+				if err := os.WriteFile(s.imagePath(tt.staged), []byte(sonicImage(tt.staged)), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			resp, err := s.Activate(context.Background(), tt.req)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("Activate() error = %v, want code %v", err, tt.wantCode)
+			}
+			if err == nil {
+				activateErr := resp.GetActivateError()
+				switch {
+				case tt.wantStandbyError:
+					if activateErr == nil {
+						t.Errorf("Activate() = %v, want ActivateError", resp)
+					}
+				case tt.wantError != gnoios.ActivateError_UNSPECIFIED:
+					if activateErr.GetType() != tt.wantError {
+						t.Errorf("Activate() = %v, want ActivateError %v", resp, tt.wantError)
+					}
+				case resp.GetActivateOk() == nil:
+					t.Errorf("Activate() = %v, want ActivateOK", resp)
+				}
+			}
+
+			images, err := bl.ListImages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if images.Next != tt.wantNext {
+				t.Errorf("next boot = %s, want %s", images.Next, tt.wantNext)
+			}
+			if tt.wantAvailable != "" && !slices.Contains(images.Available, tt.wantAvailable) {
+				t.Errorf("available images = %v, want %s among them", images.Available, tt.wantAvailable)
+			}
+			if gotReboot := len(rebooter.requests) > 0; gotReboot != tt.wantReboot {
+				t.Errorf("reboot requested = %v, want %v", gotReboot, tt.wantReboot)
+			} else if gotReboot && rebooter.requests[0].GetMethod() != system.RebootMethod_COLD {
+				t.Errorf("reboot method = %v, want COLD", rebooter.requests[0].GetMethod())
+			}
+		})
+	}
+}
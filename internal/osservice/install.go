@@ -0,0 +1,360 @@
+package osservice
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	gnoios "github.com/openconfig/gnoi/os"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"upgrade-agent/internal/bootloader"
+	"upgrade-agent/internal/logging"
+)
+
+// Metadata keys a client may set on the Install stream to have the
+// transferred image checked against the expected hex digests, and the
+// base64 detached signature of the image
+const (
+	MetadataImageSHA256    = "image-sha256"
+	MetadataImageMD5       = "image-md5"
+	MetadataImageSignature = "image-signature"
+)
+
+// DefaultImageDir is where transferred images are staged
+const DefaultImageDir = "/var/lib/upgrade-server/images"
+
+// imageSuffix is appended to the version to name a staged image
+const imageSuffix = ".bin"
+
+// progressInterval is how many bytes are received between TransferProgress messages
+const progressInterval = 8 << 20
+
+// imageVersionPattern finds the version embedded in a SONiC installer image.
+// This is the same line sonic-installer greps for in binary_version.
+var imageVersionPattern = regexp.MustCompile(`^image_version="([^"]+)"`)
+
+// Install implements the gNOI OS.Install RPC. The image is streamed into the
+// staging directory, checked for size, integrity and version, and kept there
+// as <version>.bin for OS.Activate.
+func (s *OSService) Install(stream gnoios.OS_InstallServer) error {
+	logger := logging.FromContext(stream.Context())
+
+	req, err := stream.Recv()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to receive request: %v", err)
+	}
+	transferReq := req.GetTransferRequest()
+	if transferReq == nil {
+		return status.Error(codes.InvalidArgument, "first message must be a TransferRequest")
+	}
+
+	version := transferReq.GetVersion()
+	logger = logger.With("version", version)
+	logger.Info("Received install request", "size_bytes", transferReq.GetPackageSize(),
+		"standby_supervisor", transferReq.GetStandbySupervisor())
+
+	if version == "" || strings.ContainsAny(version, `/\`) || strings.HasPrefix(version, ".") {
+		return sendInstallError(stream, gnoios.InstallError_PARSE_FAIL,
+			fmt.Sprintf("invalid version %q", version))
+	}
+	if transferReq.GetStandbySupervisor() {
+		return sendInstallError(stream, gnoios.InstallError_UNSPECIFIED,
+			"no standby supervisor on this system")
+	}
+
+	// Only one transfer may write to the staging directory at a time. The
+	// lock is released before the final response so a client that starts the
+	// next install right after it does not see INSTALL_IN_PROGRESS.
+	if !s.installLock.TryLock() {
+		return sendInstallError(stream, gnoios.InstallError_INSTALL_IN_PROGRESS,
+			"another OS.Install is in progress")
+	}
+	resp, err := s.transferImage(stream, transferReq)
+	s.installLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if installErr := resp.GetInstallError(); installErr != nil {
+		logger.Warn("Install failed", "type", installErr.GetType().String(), "detail", installErr.GetDetail())
+	} else {
+		logger.Info("Install validated", "description", resp.GetValidated().GetDescription())
+	}
+
+	if err := stream.Send(resp); err != nil {
+		return status.Errorf(codes.Internal, "failed to send install response: %v", err)
+	}
+	return nil
+}
+
+// transferImage receives and validates the image announced by transferReq and
+// returns the final Validated or InstallError response to send
+func (s *OSService) transferImage(stream gnoios.OS_InstallServer, transferReq *gnoios.TransferRequest) (*gnoios.InstallResponse, error) {
+	version := transferReq.GetVersion()
+	logger := logging.FromContext(stream.Context()).With("version", version)
+
+	// Nothing to transfer if the version is already running or staged
+	if running, err := getOSVersionFromCmdline(); err == nil && versionsEqual(running, version) {
+		logger.Info("Version is already running, skipping transfer")
+		return validatedResponse(version, "already running")
+	}
+	imagePath := s.imagePath(version)
+	if _, err := os.Stat(imagePath); err == nil {
+		logger.Info("Version is already staged, skipping transfer", "path", imagePath)
+		return validatedResponse(version, "already staged")
+	}
+
+	if err := os.MkdirAll(s.imageDir, 0755); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create image directory: %v", err)
+	}
+
+	if size := transferReq.GetPackageSize(); size > 0 {
+		if free, err := freeSpace(s.imageDir); err == nil && size > free {
+			return installErrorResponse(gnoios.InstallError_TOO_LARGE,
+				fmt.Sprintf("image of %d bytes does not fit in %d free bytes", size, free))
+		}
+	}
+
+	expectedSHA256, expectedMD5 := expectedDigests(stream)
+	imageSignature := signatureMetadata(stream)
+
+	tmp, err := os.CreateTemp(s.imageDir, version+imageSuffix+".partial-*")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create staging file: %v", err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+	defer tmp.Close()
+
+	if err := stream.Send(&gnoios.InstallResponse{
+		Response: &gnoios.InstallResponse_TransferReady{TransferReady: &gnoios.TransferReady{}},
+	}); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to send TransferReady: %v", err)
+	}
+
+	sha := sha256.New()
+	sum := md5.New()
+	w := io.MultiWriter(tmp, sha, sum)
+	var received, lastProgress uint64
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil, status.Error(codes.Aborted, "stream closed before TransferEnd")
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Aborted, "failed to receive image: %v", err)
+		}
+
+		if req.GetTransferEnd() != nil {
+			break
+		}
+
+		content := req.GetTransferContent()
+		if content == nil {
+			return nil, status.Error(codes.InvalidArgument, "expected TransferContent or TransferEnd")
+		}
+
+		received += uint64(len(content))
+		if size := transferReq.GetPackageSize(); size > 0 && received > size {
+			return installErrorResponse(gnoios.InstallError_TOO_LARGE,
+				fmt.Sprintf("received more than the announced %d bytes", size))
+		}
+		if _, err := w.Write(content); err != nil {
+			if isNoSpace(err) {
+				return installErrorResponse(gnoios.InstallError_TOO_LARGE,
+					fmt.Sprintf("out of space after %d bytes: %v", received, err))
+			}
+			return nil, status.Errorf(codes.Internal, "failed to write image: %v", err)
+		}
+
+		if received-lastProgress >= progressInterval {
+			lastProgress = received
+			if err := stream.Send(&gnoios.InstallResponse{
+				Response: &gnoios.InstallResponse_TransferProgress{
+					TransferProgress: &gnoios.TransferProgress{BytesReceived: received},
+				},
+			}); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to send TransferProgress: %v", err)
+			}
+		}
+	}
+
+	logger.Info("Image transfer complete", "bytes", received)
+
+	if err := tmp.Sync(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to sync image: %v", err)
+	}
+
+	if size := transferReq.GetPackageSize(); size > 0 && received != size {
+		return installErrorResponse(gnoios.InstallError_INTEGRITY_FAIL,
+			fmt.Sprintf("received %d bytes, expected %d", received, size))
+	}
+	if err := checkDigest("SHA-256", sha, expectedSHA256); err != nil {
+		return installErrorResponse(gnoios.InstallError_INTEGRITY_FAIL, err.Error())
+	}
+	if err := checkDigest("MD5", sum, expectedMD5); err != nil {
+		return installErrorResponse(gnoios.InstallError_INTEGRITY_FAIL, err.Error())
+	}
+	if s.policy.Enabled() {
+		if _, err := s.policy.Check(sha.Sum(nil), imageSignature); err != nil {
+			return installErrorResponse(gnoios.InstallError_INTEGRITY_FAIL, err.Error())
+		}
+	}
+
+	imageVersion, err := readImageVersion(tmpName)
+	if err != nil {
+		return installErrorResponse(gnoios.InstallError_PARSE_FAIL, err.Error())
+	}
+	if !versionsEqual(imageVersion, version) {
+		return installErrorResponse(gnoios.InstallError_INCOMPATIBLE,
+			fmt.Sprintf("image contains version %s, not %s", imageVersion, version))
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to close image: %v", err)
+	}
+	if err := os.Rename(tmpName, imagePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to stage image: %v", err)
+	}
+
+	logger.Info("Image staged", "path", imagePath, "sha256", hex.EncodeToString(sha.Sum(nil)))
+	return validatedResponse(version, "staged at "+imagePath)
+}
+
+// imagePath returns where the image for version is staged
+func (s *OSService) imagePath(version string) string {
+	return filepath.Join(s.imageDir, bootloader.TrimVersionPrefix(version)+imageSuffix)
+}
+
+// sendInstallError reports an InstallError and ends the RPC
+func sendInstallError(stream gnoios.OS_InstallServer, errType gnoios.InstallError_Type, detail string) error {
+	logging.FromContext(stream.Context()).Warn("Install rejected", "type", errType.String(), "detail", detail)
+	resp, _ := installErrorResponse(errType, detail)
+	if err := stream.Send(resp); err != nil {
+		return status.Errorf(codes.Internal, "failed to send InstallError: %v", err)
+	}
+	return nil
+}
+
+// installErrorResponse builds an InstallError response
+func installErrorResponse(errType gnoios.InstallError_Type, detail string) (*gnoios.InstallResponse, error) {
+	return &gnoios.InstallResponse{
+		Response: &gnoios.InstallResponse_InstallError{
+			InstallError: &gnoios.InstallError{Type: errType, Detail: detail},
+		},
+	}, nil
+}
+
+// validatedResponse builds a Validated response
+func validatedResponse(version, description string) (*gnoios.InstallResponse, error) {
+	return &gnoios.InstallResponse{
+		Response: &gnoios.InstallResponse_Validated{
+			Validated: &gnoios.Validated{Version: version, Description: description},
+		},
+	}, nil
+}
+
+// expectedDigests returns the hex digests the client attached as metadata
+func expectedDigests(stream gnoios.OS_InstallServer) (sha256Hex, md5Hex string) {
+	md, ok := metadata.FromIncomingContext(stream.Context())
+	if !ok {
+		return "", ""
+	}
+	if v := md.Get(MetadataImageSHA256); len(v) > 0 {
+		sha256Hex = strings.ToLower(v[0])
+	}
+	if v := md.Get(MetadataImageMD5); len(v) > 0 {
+		md5Hex = strings.ToLower(v[0])
+	}
+	return sha256Hex, md5Hex
+}
+
+// signatureMetadata returns the signature the client attached as metadata,
+// nil if there is none
+func signatureMetadata(stream gnoios.OS_InstallServer) []byte {
+	md, ok := metadata.FromIncomingContext(stream.Context())
+	if !ok {
+		return nil
+	}
+	if v := md.Get(MetadataImageSignature); len(v) > 0 && v[0] != "" {
+		return []byte(v[0])
+	}
+	return nil
+}
+
+// checkDigest compares a computed digest against the expected hex value, if any
+func checkDigest(name string, h hash.Hash, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != expected {
+		return fmt.Errorf("%s mismatch: got %s, expected %s", name, actual, expected)
+	}
+	return nil
+}
+
+// readImageVersion extracts the image_version embedded in a SONiC installer
+func readImageVersion(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The installer is a shell script with a binary payload, so lines can be
+	// arbitrarily long; only look at their beginning
+	reader := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if m := imageVersionPattern.FindSubmatch(bytes.TrimLeft(line, " \t")); m != nil {
+			return string(m[1]), nil
+		}
+		if err == bufio.ErrBufferFull {
+			// Skip the rest of an overlong line
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+		}
+		if err == io.EOF {
+			return "", fmt.Errorf("no image_version found, not a SONiC image")
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read image: %w", err)
+		}
+	}
+}
+
+// freeSpace returns the number of bytes available in the filesystem at path
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// isNoSpace reports whether err was caused by a full filesystem
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// versionsEqual compares two SONiC versions ignoring the prefixes that
+// osservice ("SONiC.") and sonic-installer ("SONiC-OS-") put in front
+func versionsEqual(a, b string) bool {
+	return bootloader.TrimVersionPrefix(a) == bootloader.TrimVersionPrefix(b)
+}
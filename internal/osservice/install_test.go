@@ -0,0 +1,225 @@
+package osservice
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gnoios "github.com/openconfig/gnoi/os"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"upgrade-agent/internal/signature"
+)
+
+// fakeInstallStream is the server side of an OS.Install call that sends reqs
+// in order and records the responses
+type fakeInstallStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	reqs []*gnoios.InstallRequest
+	sent []*gnoios.InstallResponse
+}
+
+func (f *fakeInstallStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeInstallStream) Recv() (*gnoios.InstallRequest, error) {
+	if len(f.reqs) == 0 {
+		return nil, io.EOF
+	}
+	req := f.reqs[0]
+	f.reqs = f.reqs[1:]
+	return req, nil
+}
+
+func (f *fakeInstallStream) Send(resp *gnoios.InstallResponse) error {
+	f.sent = append(f.sent, resp)
+	return nil
+}
+
+// transferRequests builds the requests transferring image in two chunks
+func transferRequests(version string, size uint64, image string) []*gnoios.InstallRequest {
+	half := len(image) / 2
+	return []*gnoios.InstallRequest{
+		{Request: &gnoios.InstallRequest_TransferRequest{
+			TransferRequest: &gnoios.TransferRequest{Version: version, PackageSize: size},
+		}},
+		{Request: &gnoios.InstallRequest_TransferContent{TransferContent: []byte(image[:half])}},
+		{Request: &gnoios.InstallRequest_TransferContent{TransferContent: []byte(image[half:])}},
+		{Request: &gnoios.InstallRequest_TransferEnd{TransferEnd: &gnoios.TransferEnd{}}},
+	}
+}
+
+// sonicImage returns the beginning of a SONiC installer for version
+func sonicImage(version string) string {
+	return "#!/bin/sh\nimage_version=\"" + version + "\"\n" + strings.Repeat("payload", 1000)
+}
+
+func TestInstall(t *testing.T) {
+	const version = "202311.1"
+	image := sonicImage(version)
+	sha := sha256.Sum256([]byte(image))
+	sum := md5.Sum([]byte(image))
+
+	tests := []struct {
+		name     string
+		version  string
+		size     uint64
+		image    string
+		metadata map[string]string
+		// staged is an image already staged for version
+		staged string
+		// wantError is the InstallError type expected, UNSPECIFIED for a
+		// Validated response
+		wantError    gnoios.InstallError_Type
+		wantTransfer bool
+	}{
+		{
+			name:         "staged",
+			size:         uint64(len(image)),
+			image:        image,
+			wantTransfer: true,
+		},
+		{
+			name:  "digests match",
+			image: image,
+			metadata: map[string]string{
+				MetadataImageSHA256: strings.ToUpper(hex.EncodeToString(sha[:])),
+				MetadataImageMD5:    hex.EncodeToString(sum[:]),
+			},
+			wantTransfer: true,
+		},
+		{
+			name:         "SHA-256 mismatch",
+			image:        image,
+			metadata:     map[string]string{MetadataImageSHA256: strings.Repeat("0", 64)},
+			wantError:    gnoios.InstallError_INTEGRITY_FAIL,
+			wantTransfer: true,
+		},
+		{
+			name:         "MD5 mismatch",
+			image:        image,
+			metadata:     map[string]string{MetadataImageMD5: strings.Repeat("0", 32)},
+			wantError:    gnoios.InstallError_INTEGRITY_FAIL,
+			wantTransfer: true,
+		},
+		{
+			name:         "fewer bytes than announced",
+			size:         uint64(len(image)) + 1,
+			image:        image,
+			wantError:    gnoios.InstallError_INTEGRITY_FAIL,
+			wantTransfer: true,
+		},
+		{
+			name:         "more bytes than announced",
+			size:         uint64(len(image)) - 1,
+			image:        image,
+			wantError:    gnoios.InstallError_TOO_LARGE,
+			wantTransfer: true,
+		},
+		{
+			name:         "other version",
+			image:        sonicImage("202311.2"),
+			wantError:    gnoios.InstallError_INCOMPATIBLE,
+			wantTransfer: true,
+		},
+		{
+			name:         "not a SONiC image",
+			image:        "just some bytes\n",
+			wantError:    gnoios.InstallError_PARSE_FAIL,
+			wantTransfer: true,
+		},
+		{
+			name:      "invalid version",
+			version:   "../" + version,
+			image:     image,
+			wantError: gnoios.InstallError_PARSE_FAIL,
+		},
+		{
+			name:   "already staged",
+			image:  image,
+			staged: "staged before",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imageDir := t.TempDir()
+			s := NewOSService(imageDir, nil, nil, nil, signature.Policy{})
+			v := version
+			if tt.version != "" {
+				v = tt.version
+			}
+			stagedPath := filepath.Join(imageDir, version+imageSuffix)
+			if tt.staged != "" {
+				if err := os.WriteFile(stagedPath, []byte(tt.staged), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stream := &fakeInstallStream{
+				ctx:  metadata.NewIncomingContext(context.Background(), metadata.New(tt.metadata)),
+				reqs: transferRequests(v, tt.size, tt.image),
+			}
+			if err := s.Install(stream); err != nil {
+				t.Fatalf("Install() error = %v", err)
+			}
+			if len(stream.sent) == 0 {
+				t.Fatal("Install() sent no response")
+			}
+
+			gotTransfer := stream.sent[0].GetTransferReady() != nil
+			if gotTransfer != tt.wantTransfer {
+				t.Errorf("TransferReady sent = %v, want %v", gotTransfer, tt.wantTransfer)
+			}
+			last := stream.sent[len(stream.sent)-1]
+			if tt.wantError != gnoios.InstallError_UNSPECIFIED {
+				if got := last.GetInstallError().GetType(); got != tt.wantError {
+					t.Errorf("final response = %v, want InstallError %v", last, tt.wantError)
+				}
+			} else if last.GetValidated().GetVersion() != v {
+				t.Errorf("final response = %v, want Validated for %s", last, v)
+			}
+
+			data, err := os.ReadFile(stagedPath)
+			switch {
+			case tt.staged != "":
+				if string(data) != tt.staged {
+					t.Errorf("staged image was replaced")
+				}
+			case tt.wantError == gnoios.InstallError_UNSPECIFIED:
+				if string(data) != tt.image {
+					t.Errorf("staged image differs from the transferred one: %v", err)
+				}
+			case err == nil:
+				t.Errorf("rejected image was staged")
+			}
+			if entries, _ := os.ReadDir(imageDir); len(entries) > 1 {
+				t.Errorf("image directory holds %d files, want the staged image at most", len(entries))
+			}
+		})
+	}
+}
+
+func TestInstallInterrupted(t *testing.T) {
+	imageDir := t.TempDir()
+	s := NewOSService(imageDir, nil, nil, nil, signature.Policy{})
+	reqs := transferRequests("202311.1", 0, sonicImage("202311.1"))
+
+	stream := &fakeInstallStream{ctx: context.Background(), reqs: reqs[:2]}
+	if err := s.Install(stream); status.Code(err) != codes.Aborted {
+		t.Errorf("Install() error = %v, want Aborted", err)
+	}
+	if entries, _ := os.ReadDir(imageDir); len(entries) != 0 {
+		t.Errorf("interrupted transfer left %d files behind", len(entries))
+	}
+}
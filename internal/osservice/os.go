@@ -4,31 +4,66 @@ package osservice
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"regexp"
+	"sync"
 
 	gnoios "github.com/openconfig/gnoi/os"
+	"github.com/openconfig/gnoi/system"
+
+	"upgrade-agent/internal/bootloader"
+	"upgrade-agent/internal/logging"
+	"upgrade-agent/internal/signature"
 )
 
+// Rebooter reboots the system once a new image is activated. It is
+// implemented by systemservice.Service.
+type Rebooter interface {
+	Reboot(ctx context.Context, req *system.RebootRequest) (*system.RebootResponse, error)
+}
+
 // OSService implements the gNOI OS service
 type OSService struct {
 	gnoios.UnimplementedOSServer
+	imageDir    string
+	installLock sync.Mutex
+	bootloader  bootloader.Bootloader
+	imageLock   *sync.Mutex
+	rebooter    Rebooter
+	policy      signature.Policy
 }
 
-// NewOSService creates a new OS service instance
-func NewOSService() *OSService {
-	return &OSService{}
+// NewOSService creates a new OS service instance that stages images
+// transferred by OS.Install in imageDir (DefaultImageDir if empty), and
+// switches images with bl and rebooter on OS.Activate, holding imageLock
+// while it changes them (a lock of its own if nil). policy decides which
+// transferred images are accepted based on their signature.
+func NewOSService(imageDir string, bl bootloader.Bootloader, imageLock *sync.Mutex, rebooter Rebooter,
+	policy signature.Policy) *OSService {
+	if imageDir == "" {
+		imageDir = DefaultImageDir
+	}
+	if imageLock == nil {
+		imageLock = &sync.Mutex{}
+	}
+	return &OSService{
+		imageDir:   imageDir,
+		bootloader: bl,
+		imageLock:  imageLock,
+		rebooter:   rebooter,
+		policy:     policy,
+	}
 }
 
 // Verify implements the gNOI OS.Verify RPC to return the current running OS version
 func (s *OSService) Verify(ctx context.Context, req *gnoios.VerifyRequest) (*gnoios.VerifyResponse, error) {
-	log.Println("Received OS.Verify request")
+	logger := logging.FromContext(ctx)
 
 	// Get OS version from /proc/cmdline
 	version, err := getOSVersionFromCmdline()
 	if err != nil {
-		log.Printf("Warning: Failed to get SONiC OS version: %v", err)
+		logger.Warn("Failed to get SONiC OS version", logging.Err(err))
 		// Use a default unknown version if extraction fails
 		version = "unknown"
 
@@ -39,30 +74,28 @@ func (s *OSService) Verify(ctx context.Context, req *gnoios.VerifyRequest) (*gno
 		procExists, _ := fileExists("/proc")
 		procCmdlineExists, _ := fileExists("/proc/cmdline")
 
-		log.Printf("Diagnostic info for mounting: /host exists: %v, /host/proc exists: %v, /host/proc/cmdline exists: %v",
-			hostExists, hostProcExists, hostProcCmdlineExists)
-		log.Printf("Diagnostic info for proc: /proc exists: %v, /proc/cmdline exists: %v",
-			procExists, procCmdlineExists)
+		logger.Warn("Diagnostic info for mounting", "host_exists", hostExists, "host_proc_exists", hostProcExists,
+			"host_proc_cmdline_exists", hostProcCmdlineExists, "proc_exists", procExists, "proc_cmdline_exists", procCmdlineExists)
 
 		// Try to directly read content of proc/cmdline for debugging
 		if hostProcCmdlineExists {
 			content, readErr := os.ReadFile("/host/proc/cmdline")
 			if readErr == nil {
-				log.Printf("Content of /host/proc/cmdline: %s", string(content))
+				logger.Warn("Content of /host/proc/cmdline", "cmdline", string(content))
 			} else {
-				log.Printf("Error reading /host/proc/cmdline: %v", readErr)
+				logger.Warn("Error reading /host/proc/cmdline", logging.Err(readErr))
 			}
 		} else if procCmdlineExists {
 			content, readErr := os.ReadFile("/proc/cmdline")
 			if readErr == nil {
-				log.Printf("Content of /proc/cmdline: %s", string(content))
+				logger.Warn("Content of /proc/cmdline", "cmdline", string(content))
 			} else {
-				log.Printf("Error reading /proc/cmdline: %v", readErr)
+				logger.Warn("Error reading /proc/cmdline", logging.Err(readErr))
 			}
 		}
 	}
 
-	log.Printf("Responding with SONiC OS version: %v", version)
+	logger.Info("Responding with SONiC OS version", "version", version)
 
 	// Create a StandbyState to indicate this is not a dual supervisor system
 	standbyState := &gnoios.StandbyState{
@@ -127,7 +160,7 @@ func getVersionFromProcCmdline() (string, error) {
 		return "", fmt.Errorf("failed to read cmdline from any path: %v", err)
 	}
 
-	log.Printf("Successfully read cmdline from %s", readPath)
+	slog.Debug("Read kernel command line", "path", readPath)
 	cmdline := string(content)
 
 	// Look for SONiC image pattern like /image-internal-202311.125362094-44bd097e78/ or /image-master.858213-545f73f0a/
@@ -138,29 +171,10 @@ func getVersionFromProcCmdline() (string, error) {
 	if len(matches) > 2 {
 		// Format output as: SONiC.internal-202311.125362094-44bd097e78 or SONiC.master.858213-545f73f0a
 		sonicVersion := "SONiC." + matches[1] + "-" + matches[2]
-		log.Printf("Extracted SONiC version from image path: %s", sonicVersion)
+		slog.Debug("Extracted SONiC version from image path", "version", sonicVersion)
 		return sonicVersion, nil
 	}
 
 	// If not found, return an error instead of a placeholder message
 	return "", fmt.Errorf("SONiC version pattern not found in cmdline")
 }
-
-// Install is a placeholder for the OS Install RPC
-func (s *OSService) Install(stream gnoios.OS_InstallServer) error {
-	log.Println("Received OS.Install request, but not implemented")
-	return nil
-}
-
-// Activate is a placeholder for the OS Activate RPC
-func (s *OSService) Activate(ctx context.Context, req *gnoios.ActivateRequest) (*gnoios.ActivateResponse, error) {
-	log.Println("Received OS.Activate request, but not implemented")
-	return &gnoios.ActivateResponse{
-		Response: &gnoios.ActivateResponse_ActivateError{
-			ActivateError: &gnoios.ActivateError{
-				Type: gnoios.ActivateError_UNSPECIFIED,
-				Detail: "OS.Activate not implemented",
-			},
-		},
-	}, nil
-}
@@ -0,0 +1,187 @@
+// Package signature verifies detached firmware image signatures against a
+// set of trusted public keys
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SuffixDetached is appended to an image path or URL to find its signature
+const SuffixDetached = ".sig"
+
+var (
+	// ErrMissing is returned when an image has no signature but one is required
+	ErrMissing = errors.New("signature missing")
+	// ErrInvalid is returned when no trusted key verifies the signature
+	ErrInvalid = errors.New("signature invalid")
+)
+
+// trustedKey is a public key and where it was loaded from
+type trustedKey struct {
+	name string
+	key  crypto.PublicKey
+}
+
+// Verifier checks signatures against the trusted keys. Signatures are made
+// over the SHA-256 digest of the image, which is what
+// `openssl dgst -sha256 -sign key.pem` produces for RSA and ECDSA keys; for
+// Ed25519 keys the 32-byte digest itself is the signed message.
+type Verifier struct {
+	keys []trustedKey
+}
+
+// LoadVerifier reads the PEM encoded public keys at path, which is either a
+// single file holding one or more keys or a directory of .pem files
+func LoadVerifier(path string) (*Verifier, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted keys: %w", err)
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.pem"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list trusted keys: %w", err)
+		}
+		sort.Strings(files)
+	}
+
+	v := &Verifier{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trusted key %s: %w", file, err)
+		}
+		keys, err := parseKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trusted key %s: %w", file, err)
+		}
+		for i, key := range keys {
+			name := filepath.Base(file)
+			if len(keys) > 1 {
+				name = fmt.Sprintf("%s#%d", name, i+1)
+			}
+			v.keys = append(v.keys, trustedKey{name: name, key: key})
+		}
+	}
+
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("no trusted keys found in %s", path)
+	}
+	slog.Info("Loaded trusted firmware signing keys", "count", len(v.keys), "path", path)
+	return v, nil
+}
+
+// parseKeys decodes every PUBLIC KEY block in data
+func parseKeys(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+	}
+	return keys, nil
+}
+
+// Verify checks sig over the SHA-256 digest of an image and returns the name
+// of the key that verified it
+func (v *Verifier) Verify(digest, sig []byte) (string, error) {
+	sig = decode(sig)
+	for _, k := range v.keys {
+		if verifyKey(k.key, digest, sig) {
+			return k.name, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no trusted key matches", ErrInvalid)
+}
+
+// verifyKey reports whether sig is a valid signature of digest by key
+func verifyKey(key crypto.PublicKey, digest, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil {
+			return true
+		}
+		return rsa.VerifyPSS(k, crypto.SHA256, digest, sig, nil) == nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest, sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, digest, sig)
+	}
+	return false
+}
+
+// decode accepts a raw binary signature or its base64 text form
+func decode(sig []byte) []byte {
+	text := bytes.TrimSpace(sig)
+	if decoded, err := base64.StdEncoding.DecodeString(string(text)); err == nil && len(decoded) > 0 {
+		return decoded
+	}
+	return sig
+}
+
+// Policy decides what happens to images depending on their signature
+type Policy struct {
+	// Verifier holds the trusted keys, nil if none are configured
+	Verifier *Verifier
+	// Required rejects images without a valid signature. Without it a
+	// missing signature is only logged, but a present one must still verify.
+	Required bool
+}
+
+// Enabled reports whether images need to be checked at all
+func (p Policy) Enabled() bool {
+	return p.Required || p.Verifier != nil
+}
+
+// Check applies the policy to an image with the given SHA-256 digest. sig is
+// nil when the image has no signature. The name of the key that verified the
+// signature is returned, or "" when an unsigned image is let through.
+func (p Policy) Check(digest, sig []byte) (string, error) {
+	if sig == nil {
+		if p.Required {
+			return "", ErrMissing
+		}
+		slog.Info("Image is not signed, continuing since signatures are not required")
+		return "", nil
+	}
+	if p.Verifier == nil {
+		return "", fmt.Errorf("%w: no trusted keys configured", ErrInvalid)
+	}
+
+	name, err := p.Verifier.Verify(digest, sig)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("Image signature verified", "key", name)
+	return name, nil
+}
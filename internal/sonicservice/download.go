@@ -0,0 +1,296 @@
+package sonicservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"upgrade-agent/internal/firmwaresource"
+	"upgrade-agent/internal/logging"
+)
+
+// DefaultDownloadDir is where firmware fetched from a URL is staged until
+// it is installed
+const DefaultDownloadDir = "/var/lib/upgrade-server/downloads"
+
+const (
+	// downloadAttempts bounds how many times a download is resumed after the
+	// connection fails
+	downloadAttempts = 5
+	// downloadProgressInterval is how many bytes are fetched between progress
+	// lines when the server does not announce the size
+	downloadProgressInterval = 64 << 20
+)
+
+// downloadRetryInterval is the base delay between attempts, multiplied by the
+// attempt number. Tests shorten it.
+var downloadRetryInterval = 2 * time.Second
+
+// httpClient is used for firmware downloads. There is no overall timeout
+// since images are large; stalled connections are caught by the header
+// timeout and by the caller's context.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	},
+}
+
+// download tracks a firmware download across resumed attempts
+type download struct {
+	url string
+	// displayURL is url without credentials, for logs and progress lines
+	displayURL string
+	file       *os.File
+	sha        hash.Hash
+	received   int64
+	// total is the full image size, -1 until a response announces it
+	total        int64
+	lastProgress int64
+	progress     func(string)
+}
+
+// downloadFirmware fetches the firmware at rawURL into the download
+// directory and returns the path and hex SHA-256 of the staged file. A
+// connection that fails part way is resumed with a range request. progress
+// is called with human-readable status lines. The staged file is removed if
+// the download fails; on success the caller owns it.
+func (s *Service) downloadFirmware(ctx context.Context, rawURL string, progress func(string)) (string, string, error) {
+	displayURL := firmwaresource.Redact(rawURL)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid firmware URL %q", displayURL)
+	}
+
+	if err := os.MkdirAll(s.downloadDir, 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create download directory: %w", err)
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "firmware.bin"
+	}
+	file, err := os.CreateTemp(s.downloadDir, name+".download-*")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create download file: %w", err)
+	}
+
+	d := &download{url: rawURL, displayURL: displayURL, file: file, sha: sha256.New(), total: -1, progress: progress}
+	err = d.run(ctx)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close download file: %w", closeErr)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", "", err
+	}
+
+	logging.FromContext(ctx).Info("Downloaded firmware", "url", displayURL, "path", file.Name(), "bytes", d.received)
+	return file.Name(), hex.EncodeToString(d.sha.Sum(nil)), nil
+}
+
+// run fetches the whole image, retrying within the attempt budget
+func (d *download) run(ctx context.Context) error {
+	var lastErr error
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		if attempt > 1 {
+			delay := time.Duration(attempt-1) * downloadRetryInterval
+			d.progress(fmt.Sprintf("Download interrupted at %d bytes (%v), retrying in %v (attempt %d/%d)",
+				d.received, lastErr, delay, attempt, downloadAttempts))
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("download of %s cancelled: %w", d.displayURL, ctx.Err())
+			case <-time.After(delay):
+			}
+		}
+
+		done, err := d.fetch(ctx)
+		if err == nil {
+			if err := d.file.Sync(); err != nil {
+				return fmt.Errorf("failed to sync download file: %w", err)
+			}
+			return nil
+		}
+		if done || ctx.Err() != nil {
+			return err
+		}
+		logging.FromContext(ctx).Warn("Download attempt failed", "attempt", attempt,
+			"max_attempts", downloadAttempts, "url", d.displayURL, logging.Err(err))
+		lastErr = err
+	}
+	return fmt.Errorf("download of %s failed after %d attempts: %w", d.displayURL, downloadAttempts, lastErr)
+}
+
+// fetch performs a single request, resuming from what was already received.
+// done is true when the error is not worth retrying.
+func (d *download) fetch(ctx context.Context) (done bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return true, fmt.Errorf("invalid firmware URL %q", d.displayURL)
+	}
+	if d.received > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.received))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, redactURLError(err, d.displayURL)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && d.received > 0:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != d.received {
+			// Not the range that was asked for, start over on the next attempt
+			err := fmt.Errorf("unexpected Content-Range %q for resume at %d",
+				resp.Header.Get("Content-Range"), d.received)
+			if restartErr := d.restart(); restartErr != nil {
+				return true, restartErr
+			}
+			return false, err
+		}
+		d.total = total
+		d.progress(fmt.Sprintf("Resuming download at %d bytes", d.received))
+	case resp.StatusCode == http.StatusOK:
+		if d.received > 0 {
+			// The server ignored the range request
+			logging.FromContext(ctx).Info("Server does not support range requests, restarting download", "url", d.displayURL)
+			if err := d.restart(); err != nil {
+				return true, err
+			}
+		}
+		d.total = resp.ContentLength
+		if d.total >= 0 {
+			d.progress(fmt.Sprintf("Downloading %s (%d bytes)", d.displayURL, d.total))
+		} else {
+			d.progress(fmt.Sprintf("Downloading %s", d.displayURL))
+		}
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return false, fmt.Errorf("server returned %s", resp.Status)
+	default:
+		return true, fmt.Errorf("failed to download %s: server returned %s", d.displayURL, resp.Status)
+	}
+
+	buf := make([]byte, 256*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := d.file.Write(buf[:n]); err != nil {
+				return true, fmt.Errorf("failed to write download file: %w", err)
+			}
+			d.sha.Write(buf[:n])
+			d.received += int64(n)
+			d.reportProgress()
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return false, redactURLError(readErr, d.displayURL)
+		}
+	}
+
+	if d.total >= 0 && d.received != d.total {
+		return false, fmt.Errorf("received %d of %d bytes", d.received, d.total)
+	}
+	d.progress(fmt.Sprintf("Download complete: %d bytes", d.received))
+	return true, nil
+}
+
+// redactURLError replaces the URL in an HTTP client error, which carries the
+// query string, with displayURL
+func redactURLError(err error, displayURL string) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		redacted := *urlErr
+		redacted.URL = displayURL
+		return &redacted
+	}
+	return err
+}
+
+// restart discards what was received so far
+func (d *download) restart() error {
+	if err := d.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate download file: %w", err)
+	}
+	if _, err := d.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind download file: %w", err)
+	}
+	d.sha.Reset()
+	d.received = 0
+	d.lastProgress = 0
+	return nil
+}
+
+// reportProgress emits a progress line every 10% of a known size, or every
+// downloadProgressInterval bytes otherwise
+func (d *download) reportProgress() {
+	if d.total > 0 {
+		step := d.total / 10
+		if step > 0 && d.received-d.lastProgress >= step && d.received < d.total {
+			d.lastProgress = d.received
+			d.progress(fmt.Sprintf("Downloaded %d of %d bytes (%d%%)", d.received, d.total, d.received*100/d.total))
+		}
+		return
+	}
+	if d.received-d.lastProgress >= downloadProgressInterval {
+		d.lastProgress = d.received
+		d.progress(fmt.Sprintf("Downloaded %d bytes", d.received))
+	}
+}
+
+// parseContentRange parses a "bytes start-end/total" header. total is -1
+// when the server reports it as unknown.
+func parseContentRange(header string) (start, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported Content-Range %q", header)
+	}
+	rangePart, totalPart, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	startPart, _, ok := strings.Cut(rangePart, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	if start, err = strconv.ParseInt(startPart, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	if totalPart == "*" {
+		return start, -1, nil
+	}
+	if total, err = strconv.ParseInt(totalPart, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	return start, total, nil
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,332 @@
+package sonicservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gnoisonic "upgrade-agent/gnoi_sonic"
+	"upgrade-agent/internal/executor"
+)
+
+// testImage is served by the test HTTP servers, large enough to be cut
+// in the middle
+var testImage = strings.Repeat("SONiC image payload\n", 4096)
+
+// shortRetries makes download retries immediate for the rest of the test
+func shortRetries(t *testing.T) {
+	interval := downloadRetryInterval
+	downloadRetryInterval = time.Millisecond
+	t.Cleanup(func() { downloadRetryInterval = interval })
+}
+
+// imageServer serves testImage, letting respond handle the nth request
+// (starting at 1) first. respond returns false to fall through to a
+// complete 200 response.
+type imageServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []*http.Request
+}
+
+func newImageServer(t *testing.T, respond func(n int, w http.ResponseWriter, r *http.Request) bool) *imageServer {
+	s := &imageServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.requests = append(s.requests, r)
+		n := len(s.requests)
+		s.lock.Unlock()
+		if respond != nil && respond(n, w, r) {
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(testImage)))
+		w.Write([]byte(testImage))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// requestCount returns how many requests the server received
+func (s *imageServer) requestCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.requests)
+}
+
+// cutOff announces the whole image but sends only its first half before
+// dropping the connection
+func cutOff(w http.ResponseWriter) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(testImage)))
+	w.Write([]byte(testImage[:len(testImage)/2]))
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+// serveRange answers a range request for the rest of the image
+func serveRange(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-"))
+	if err != nil {
+		http.Error(w, "bad range", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(testImage)-1, len(testImage)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(testImage)-start))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write([]byte(testImage[start:]))
+}
+
+func TestDownloadFirmware(t *testing.T) {
+	shortRetries(t)
+	sum := sha256.Sum256([]byte(testImage))
+	wantSHA256 := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name         string
+		respond      func(n int, w http.ResponseWriter, r *http.Request) bool
+		wantErr      string
+		wantRequests int
+		// wantRange is the Range header of the second request, if any
+		wantRange string
+	}{
+		{
+			name:         "complete",
+			wantRequests: 1,
+		},
+		{
+			name: "resumed",
+			respond: func(n int, w http.ResponseWriter, r *http.Request) bool {
+				if n == 1 {
+					cutOff(w)
+				}
+				serveRange(w, r)
+				return true
+			},
+			wantRequests: 2,
+			wantRange:    fmt.Sprintf("bytes=%d-", len(testImage)/2),
+		},
+		{
+			name: "range ignored",
+			respond: func(n int, w http.ResponseWriter, r *http.Request) bool {
+				if n == 1 {
+					cutOff(w)
+				}
+				return false
+			},
+			wantRequests: 2,
+			wantRange:    fmt.Sprintf("bytes=%d-", len(testImage)/2),
+		},
+		{
+			name: "unexpected range restarts",
+			respond: func(n int, w http.ResponseWriter, r *http.Request) bool {
+				switch n {
+				case 1:
+					cutOff(w)
+				case 2:
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(testImage)-1, len(testImage)))
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write([]byte(testImage))
+					return true
+				}
+				return false
+			},
+			wantRequests: 3,
+			wantRange:    fmt.Sprintf("bytes=%d-", len(testImage)/2),
+		},
+		{
+			name: "server error retried",
+			respond: func(n int, w http.ResponseWriter, r *http.Request) bool {
+				if n < 3 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return true
+				}
+				return false
+			},
+			wantRequests: 3,
+		},
+		{
+			name: "not found",
+			respond: func(n int, w http.ResponseWriter, r *http.Request) bool {
+				http.NotFound(w, r)
+				return true
+			},
+			wantErr:      "404 Not Found",
+			wantRequests: 1,
+		},
+		{
+			name: "attempts exhausted",
+			respond: func(n int, w http.ResponseWriter, r *http.Request) bool {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return true
+			},
+			wantErr:      fmt.Sprintf("failed after %d attempts", downloadAttempts),
+			wantRequests: downloadAttempts,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newImageServer(t, tt.respond)
+			s := newTestService(t, executor.NewRecorder())
+
+			path, gotSHA256, err := s.downloadFirmware(context.Background(), server.URL+"/sonic.bin", func(string) {})
+			if n := server.requestCount(); n != tt.wantRequests {
+				t.Errorf("server got %d requests, want %d", n, tt.wantRequests)
+			}
+			if tt.wantRange != "" {
+				if got := server.requests[1].Header.Get("Range"); got != tt.wantRange {
+					t.Errorf("second request Range = %q, want %q", got, tt.wantRange)
+				}
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("downloadFirmware() error = %v, want %q", err, tt.wantErr)
+				}
+				if entries, _ := os.ReadDir(s.downloadDir); len(entries) != 0 {
+					t.Errorf("failed download left %d files behind", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("downloadFirmware() error = %v", err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != testImage {
+				t.Errorf("downloaded %d bytes that differ from the %d byte image", len(data), len(testImage))
+			}
+			if gotSHA256 != wantSHA256 {
+				t.Errorf("SHA-256 = %s, want %s", gotSHA256, wantSHA256)
+			}
+		})
+	}
+}
+
+func TestUpdateFirmwareDownloadChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte(testImage))
+	tests := []struct {
+		name         string
+		expected     string
+		wantState    gnoisonic.UpdateFirmwareStatus_State
+		wantExitCode int32
+	}{
+		{
+			name:      "match",
+			expected:  strings.ToUpper(hex.EncodeToString(sum[:])),
+			wantState: gnoisonic.UpdateFirmwareStatus_SUCCEEDED,
+		},
+		{
+			name:         "mismatch",
+			expected:     strings.Repeat("0", 64),
+			wantState:    gnoisonic.UpdateFirmwareStatus_FAILED,
+			wantExitCode: ExitCodeChecksumMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newImageServer(t, nil)
+			rec := executor.NewRecorder()
+			s := newTestService(t, rec)
+
+			last, _ := runUpdate(t, s, &gnoisonic.FirmwareUpdateParams{
+				FirmwareSource: server.URL + "/sonic.bin",
+				ExpectedSha256: tt.expected,
+			})
+			if last.GetState() != tt.wantState || last.GetExitCode() != tt.wantExitCode {
+				t.Errorf("final status = %v %d, want %v %d", last.GetState(), last.GetExitCode(), tt.wantState, tt.wantExitCode)
+			}
+			installed := len(rec.Commands()) > 0
+			if want := tt.wantState == gnoisonic.UpdateFirmwareStatus_SUCCEEDED; installed != want {
+				t.Errorf("installer ran = %v, want %v", installed, want)
+			}
+			if entries, _ := os.ReadDir(s.downloadDir); len(entries) != 0 {
+				t.Errorf("download left %d files behind", len(entries))
+			}
+		})
+	}
+}
+
+func TestUpdateFirmwareRedactsURL(t *testing.T) {
+	shortRetries(t)
+	tests := []struct {
+		name    string
+		respond func(n int, w http.ResponseWriter, r *http.Request) bool
+	}{
+		{name: "success"},
+		{
+			name: "retried",
+			respond: func(n int, w http.ResponseWriter, r *http.Request) bool {
+				if n == 1 {
+					cutOff(w)
+				}
+				return false
+			},
+		},
+		{
+			name: "failure",
+			respond: func(n int, w http.ResponseWriter, r *http.Request) bool {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return true
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newImageServer(t, tt.respond)
+			u, err := url.Parse(server.URL + "/sonic.bin?token=query-secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			u.User = url.UserPassword("admin", "password-secret")
+
+			_, stream := runUpdate(t, newTestService(t, executor.NewRecorder()),
+				&gnoisonic.FirmwareUpdateParams{FirmwareSource: u.String()})
+			for _, line := range stream.lines() {
+				if strings.Contains(line, "secret") {
+					t.Errorf("status line leaks credentials: %q", line)
+				}
+			}
+			if got := server.requests[0].URL.Query().Get("token"); got != "query-secret" {
+				t.Errorf("server got token %q, want the one in the source", got)
+			}
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header    string
+		wantStart int64
+		wantTotal int64
+		wantErr   bool
+	}{
+		{header: "bytes 100-199/200", wantStart: 100, wantTotal: 200},
+		{header: "bytes 0-99/*", wantStart: 0, wantTotal: -1},
+		{header: "items 0-99/100", wantErr: true},
+		{header: "bytes 0-99", wantErr: true},
+		{header: "bytes x-99/100", wantErr: true},
+		{header: "bytes 0-99/many", wantErr: true},
+		{header: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		start, total, err := parseContentRange(tt.header)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseContentRange(%q) error = %v, want error %v", tt.header, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (start != tt.wantStart || total != tt.wantTotal) {
+			t.Errorf("parseContentRange(%q) = %d, %d, want %d, %d", tt.header, start, total, tt.wantStart, tt.wantTotal)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package sonicservice
+
+import (
+	"context"
+	"strings"
+
+	gnoisonic "upgrade-agent/gnoi_sonic"
+	"upgrade-agent/internal/logging"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ListImages implements the image inventory RPC
+func (s *Service) ListImages(ctx context.Context, req *gnoisonic.ListImagesRequest) (*gnoisonic.ListImagesResponse, error) {
+	logger := logging.FromContext(ctx)
+	logger.Info("Received ListImages request")
+
+	if s.bootloader == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no bootloader configured")
+	}
+
+	images, err := s.bootloader.ListImages()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list images: %v", err)
+	}
+
+	resp := &gnoisonic.ListImagesResponse{}
+	for _, image := range images.Available {
+		info := &gnoisonic.ImageInfo{
+			Version:  image,
+			Current:  image == images.Current,
+			NextBoot: image == images.Next,
+		}
+		// Details are best effort, the image is listed either way
+		if details, err := s.bootloader.ImageDetails(image); err != nil {
+			logger.Warn("Failed to get image details", "image", image, logging.Err(err))
+		} else {
+			info.SizeBytes = details.SizeBytes
+			if !details.InstalledAt.IsZero() {
+				info.InstallTime = details.InstalledAt.UnixNano()
+			}
+		}
+		resp.Images = append(resp.Images, info)
+	}
+
+	logger.Info("Listed images", "count", len(resp.Images), "current", images.Current, "next", images.Next)
+	return resp, nil
+}
+
+// RemoveImage implements the image removal RPC. The running and next-boot
+// images are refused so the switch always has something to boot.
+func (s *Service) RemoveImage(ctx context.Context, req *gnoisonic.RemoveImageRequest) (*gnoisonic.RemoveImageResponse, error) {
+	version := strings.TrimSpace(req.GetVersion())
+	logger := logging.FromContext(ctx)
+	logger.Info("Received RemoveImage request", "version", version)
+
+	if version == "" {
+		return nil, status.Error(codes.InvalidArgument, "version not specified")
+	}
+	if s.bootloader == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no bootloader configured")
+	}
+
+	s.imageLock.Lock()
+	defer s.imageLock.Unlock()
+
+	images, err := s.bootloader.ListImages()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list images: %v", err)
+	}
+
+	image, ok := images.FindImage(version)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "image %s is not installed", version)
+	}
+	if image == images.Current {
+		return nil, status.Errorf(codes.FailedPrecondition, "image %s is running and cannot be removed", image)
+	}
+	if image == images.Next {
+		return nil, status.Errorf(codes.FailedPrecondition, "image %s is set as next boot and cannot be removed", image)
+	}
+
+	var reclaimed uint64
+	if details, err := s.bootloader.ImageDetails(image); err == nil {
+		reclaimed = details.SizeBytes
+	}
+
+	if err := s.bootloader.RemoveImage(image); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to remove image %s: %v", image, err)
+	}
+
+	logger.Info("Removed image", "image", image, "reclaimed_bytes", reclaimed)
+	return &gnoisonic.RemoveImageResponse{Version: image, ReclaimedBytes: reclaimed}, nil
+}
@@ -0,0 +1,105 @@
+package sonicservice
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"upgrade-agent/internal/firmwaresource"
+	"upgrade-agent/internal/signature"
+)
+
+// maxSignatureSize bounds how much of a detached signature is read
+const maxSignatureSize = 64 * 1024
+
+// checkSignature applies the signature policy to the image at imagePath,
+// using the detached signature published next to source
+func (s *Service) checkSignature(ctx context.Context, source, imagePath, imageSHA256 string) (string, error) {
+	digest, err := hex.DecodeString(imageSHA256)
+	if err != nil {
+		return "", fmt.Errorf("invalid image digest %q: %w", imageSHA256, err)
+	}
+
+	var sig []byte
+	if firmwaresource.IsURL(source) {
+		var sigURL string
+		sigURL, err = signatureURL(source)
+		if err == nil {
+			sig, err = fetchSignature(ctx, sigURL)
+		}
+	} else {
+		sig, err = readSignature(imagePath + signature.SuffixDetached)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return s.signaturePolicy.Check(digest, sig)
+}
+
+// signatureURL returns where the detached signature of the image at source
+// is published. The suffix goes on the path so that the query string, such
+// as a pre-signed URL's, is kept.
+func signatureURL(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid firmware URL %q", firmwaresource.Redact(source))
+	}
+	u.Path += signature.SuffixDetached
+	if u.RawPath != "" {
+		u.RawPath += signature.SuffixDetached
+	}
+	return u.String(), nil
+}
+
+// readSignature reads a detached signature file, returning nil if there is none
+func readSignature(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature %s: %w", path, err)
+	}
+	defer f.Close()
+
+	sig, err := io.ReadAll(io.LimitReader(f, maxSignatureSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature %s: %w", path, err)
+	}
+	return sig, nil
+}
+
+// fetchSignature downloads a detached signature, returning nil if the server
+// does not have one
+func fetchSignature(ctx context.Context, sigURL string) ([]byte, error) {
+	displayURL := firmwaresource.Redact(sigURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sigURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature URL %q", displayURL)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download signature %s: %w", displayURL, redactURLError(err, displayURL))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download signature %s: server returned %s", displayURL, resp.Status)
+	}
+
+	sig, err := io.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download signature %s: %w", displayURL, redactURLError(err, displayURL))
+	}
+	return sig, nil
+}
@@ -2,64 +2,310 @@
 package sonicservice
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	gnoisonic "upgrade-agent/gnoi_sonic"
+	"upgrade-agent/internal/bootloader"
+	"upgrade-agent/internal/executor"
+	"upgrade-agent/internal/firmwaresource"
+	"upgrade-agent/internal/logging"
+	"upgrade-agent/internal/signature"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// Exit codes reported in FAILED statuses when the installer itself did not
+// produce one in range. They stay inside the 126-140 range promised by the
+// proto.
+const (
+	// MinExitCode and MaxExitCode bound the exit codes of FAILED statuses
+	MinExitCode int32 = 126
+	MaxExitCode int32 = 140
+	// ExitCodeCannotExecute means the installer exists but could not be run
+	ExitCodeCannotExecute int32 = 126
+	// ExitCodeNotFound means the installer command could not be found
+	ExitCodeNotFound int32 = 127
+	// ExitCodeInstallerFailed means the installer exited with a code outside
+	// the 126-140 range
+	ExitCodeInstallerFailed int32 = 128
+	// ExitCodeInvalidSource means the firmware source could not be resolved
+	ExitCodeInvalidSource int32 = 130
+	// ExitCodeAborted means the install was interrupted before it finished
+	ExitCodeAborted int32 = 131
+	// ExitCodeDownloadFailed means the firmware could not be downloaded
+	ExitCodeDownloadFailed int32 = 132
+	// ExitCodeChecksumMismatch means the image does not match expected_sha256
+	ExitCodeChecksumMismatch int32 = 133
+	// ExitCodeSignatureInvalid means the image signature is missing or does
+	// not verify against the trusted keys
+	ExitCodeSignatureInvalid int32 = 134
+)
+
+// DefaultInstallerCommand is the command used to install a SONiC image.
+// The resolved firmware path is appended as the last argument.
+var DefaultInstallerCommand = []string{"sonic-installer", "install", "-y"}
+
+// hostRoot is where the host filesystem is mounted inside the server container
+const hostRoot = "/host"
+
 // Service implements the SonicUpgradeService
 type Service struct {
 	gnoisonic.UnimplementedSonicUpgradeServiceServer
+	installerCommand []string
+	downloadDir      string
+	executor         executor.Executor
+	bootloader       bootloader.Bootloader
+	imageLock        *sync.Mutex
+	signaturePolicy  signature.Policy
+
+	// updateLock is held for the whole UpdateFirmware call, including an
+	// installer run that outlives its client
+	updateLock sync.Mutex
 }
 
-// NewService creates a new SonicUpgradeService instance
-func NewService() *Service {
-	return &Service{}
+// NewService creates a new SonicUpgradeService instance. An empty installer
+// command selects DefaultInstallerCommand and an empty download directory
+// DefaultDownloadDir. The installer runs through hostExecutor, locally if it
+// is nil. bl backs the image inventory RPCs, which fail if it is nil.
+// imageLock is held while the installer runs or an image is removed, a lock
+// of its own if nil. policy decides which images are accepted based on their
+// detached signature.
+func NewService(installerCommand []string, downloadDir string, hostExecutor executor.Executor, bl bootloader.Bootloader,
+	imageLock *sync.Mutex, policy signature.Policy) *Service {
+	if len(installerCommand) == 0 {
+		installerCommand = DefaultInstallerCommand
+	}
+	if downloadDir == "" {
+		downloadDir = DefaultDownloadDir
+	}
+	if hostExecutor == nil {
+		hostExecutor = executor.Local{}
+	}
+	if imageLock == nil {
+		imageLock = &sync.Mutex{}
+	}
+	return &Service{
+		installerCommand: installerCommand,
+		downloadDir:      downloadDir,
+		executor:         hostExecutor,
+		bootloader:       bl,
+		imageLock:        imageLock,
+		signaturePolicy:  policy,
+	}
 }
 
 // UpdateFirmware implements the gRPC firmware update service
 func (s *Service) UpdateFirmware(stream gnoisonic.SonicUpgradeService_UpdateFirmwareServer) error {
-	log.Println("Received UpdateFirmware request")
+	logger := logging.FromContext(stream.Context())
+	logger.Info("Received UpdateFirmware request")
+
+	// A cancelled client leaves the installer running; a second one must not
+	// start next to it
+	if !s.updateLock.TryLock() {
+		logger.Warn("Refusing firmware update, another one is in progress")
+		return status.Error(codes.FailedPrecondition, "another firmware update is in progress")
+	}
+	defer s.updateLock.Unlock()
 
 	// Read the request parameters
 	req, err := stream.Recv()
 	if err != nil {
-		log.Printf("Error receiving request: %v", err)
+		logger.Warn("Error receiving request", logging.Err(err))
 		return status.Errorf(codes.Internal, "failed to receive request: %v", err)
 	}
 
 	params := req.GetFirmwareUpdate()
-	log.Printf("Firmware update request: source=%s, updateMlnxCpldFw=%v",
-		params.GetFirmwareSource(), params.GetUpdateMlnxCpldFw())
-
-	// Send a dummy response sequence
-	responses := []struct {
-		logLine  string
-		state    gnoisonic.UpdateFirmwareStatus_State
-		exitCode int32
-	}{
-		{"Starting firmware update...", gnoisonic.UpdateFirmwareStatus_STARTED, 0},
-		{"Checking firmware file...", gnoisonic.UpdateFirmwareStatus_RUNNING, 0},
-		{"Validating firmware signature...", gnoisonic.UpdateFirmwareStatus_RUNNING, 0},
-		{"Preparing update process...", gnoisonic.UpdateFirmwareStatus_RUNNING, 0},
-		{"Applying firmware update...", gnoisonic.UpdateFirmwareStatus_RUNNING, 0},
-		{"Firmware update completed successfully", gnoisonic.UpdateFirmwareStatus_SUCCEEDED, 0},
-	}
-
-	for _, resp := range responses {
+	if params == nil {
+		return status.Error(codes.InvalidArgument, "missing firmware update parameters")
+	}
+	logger.Info("Firmware update request", "source", firmwaresource.Redact(params.GetFirmwareSource()),
+		"update_mlnx_cpld_fw", params.GetUpdateMlnxCpldFw(), "expected_sha256", params.GetExpectedSha256())
+
+	send := func(logLine string, state gnoisonic.UpdateFirmwareStatus_State, exitCode int32) error {
 		if err := stream.Send(&gnoisonic.UpdateFirmwareStatus{
-			LogLine:  resp.logLine,
-			State:    resp.state,
-			ExitCode: resp.exitCode,
+			LogLine:  logLine,
+			State:    state,
+			ExitCode: exitCode,
 		}); err != nil {
-			log.Printf("Error sending response: %v", err)
+			logger.Warn("Error sending response", logging.Err(err))
 			return status.Errorf(codes.Internal, "failed to send response: %v", err)
 		}
+		return nil
+	}
+
+	if err := send("Starting firmware update...", gnoisonic.UpdateFirmwareStatus_STARTED, 0); err != nil {
+		return err
+	}
+
+	var imagePath, imageSHA256 string
+	if source := params.GetFirmwareSource(); firmwaresource.IsURL(source) {
+		// The download follows the client: if it goes away there is nothing
+		// worth finishing yet. Progress lines are best effort.
+		imagePath, imageSHA256, err = s.downloadFirmware(stream.Context(), source, func(line string) {
+			logger.Info("Download progress", "line", line)
+			send(line, gnoisonic.UpdateFirmwareStatus_RUNNING, 0)
+		})
+		if err != nil {
+			logger.Warn("Failed to download firmware", logging.Err(err))
+			return send(err.Error(), gnoisonic.UpdateFirmwareStatus_FAILED, ExitCodeDownloadFailed)
+		}
+		// The download is only needed until the installer has copied it
+		defer os.Remove(imagePath)
+	} else {
+		imagePath, err = resolveFirmwareSource(source)
+		if err != nil {
+			logger.Warn("Failed to resolve firmware source", logging.Err(err))
+			return send(err.Error(), gnoisonic.UpdateFirmwareStatus_FAILED, ExitCodeInvalidSource)
+		}
+	}
+	if err := send("Using firmware image "+imagePath, gnoisonic.UpdateFirmwareStatus_RUNNING, 0); err != nil {
+		return err
+	}
+
+	expected := strings.ToLower(strings.TrimSpace(params.GetExpectedSha256()))
+	if (expected != "" || s.signaturePolicy.Enabled()) && imageSHA256 == "" {
+		if imageSHA256, err = fileSHA256(imagePath); err != nil {
+			logger.Warn("Failed to checksum firmware", logging.Err(err))
+			return send(fmt.Sprintf("Failed to read firmware image: %v", err),
+				gnoisonic.UpdateFirmwareStatus_FAILED, ExitCodeInvalidSource)
+		}
+	}
+
+	if expected != "" {
+		if imageSHA256 != expected {
+			logger.Warn("Firmware checksum mismatch", "sha256", imageSHA256, "expected_sha256", expected)
+			return send(fmt.Sprintf("Firmware SHA-256 mismatch: got %s, expected %s", imageSHA256, expected),
+				gnoisonic.UpdateFirmwareStatus_FAILED, ExitCodeChecksumMismatch)
+		}
+		if err := send("Firmware SHA-256 verified", gnoisonic.UpdateFirmwareStatus_RUNNING, 0); err != nil {
+			return err
+		}
+	}
+
+	if s.signaturePolicy.Enabled() {
+		if err := send("Validating firmware signature...", gnoisonic.UpdateFirmwareStatus_RUNNING, 0); err != nil {
+			return err
+		}
+		keyName, err := s.checkSignature(stream.Context(), params.GetFirmwareSource(), imagePath, imageSHA256)
+		if err != nil {
+			logger.Warn("Firmware signature check failed", logging.Err(err))
+			return send(fmt.Sprintf("Firmware signature check failed: %v", err),
+				gnoisonic.UpdateFirmwareStatus_FAILED, ExitCodeSignatureInvalid)
+		}
+		msg := "Firmware signature verified with key " + keyName
+		if keyName == "" {
+			msg = "Firmware is not signed, continuing since signatures are not required"
+		}
+		if err := send(msg, gnoisonic.UpdateFirmwareStatus_RUNNING, 0); err != nil {
+			return err
+		}
+	}
+
+	// The installer reads UPDATE_MLNX_CPLD_FW to decide whether to also
+	// flash the CPLD, which requires a cold reboot afterwards
+	var env []string
+	if params.GetUpdateMlnxCpldFw() {
+		env = append(env, "UPDATE_MLNX_CPLD_FW=1")
+	}
+
+	// The installer may run in the host namespaces, where the image has
+	// a different path
+	name := s.installerCommand[0]
+	args := append(append([]string{}, s.installerCommand[1:]...), s.executor.HostPath(imagePath))
+	logger.Info("Running installer", "command", name+" "+strings.Join(args, " "))
+
+	// Forward every line of installer output as it is produced. A failed send
+	// means the client went away; the install keeps running regardless since
+	// interrupting sonic-installer half way is worse than finishing it.
+	// The installer adds an image and makes it the next boot, which must not
+	// interleave with OS.Activate or RemoveImage
+	s.imageLock.Lock()
+	defer s.imageLock.Unlock()
+
+	var sendErr error
+	cmd := executor.Command{Name: name, Args: args, Env: env}
+	exitCode, err := s.executor.Run(context.WithoutCancel(stream.Context()), cmd, func(line string) {
+		logger.Debug("Installer output", "line", line)
+		if sendErr != nil {
+			return
+		}
+		sendErr = send(line, gnoisonic.UpdateFirmwareStatus_RUNNING, 0)
+	})
+	if err != nil {
+		logger.Warn("Failed to run installer", logging.Err(err))
+		return send(fmt.Sprintf("Failed to run installer %s: %v", name, err),
+			gnoisonic.UpdateFirmwareStatus_FAILED, startErrorExitCode(err))
+	}
+	if sendErr != nil {
+		return sendErr
 	}
 
-	log.Println("Firmware update request completed")
-	return nil
+	if exitCode != 0 {
+		logger.Warn("Installer failed", "exit_code", exitCode)
+		return send(fmt.Sprintf("Firmware update failed with exit code %d", exitCode),
+			gnoisonic.UpdateFirmwareStatus_FAILED, installerExitCode(exitCode))
+	}
+
+	logger.Info("Firmware update request completed")
+	return send("Firmware update completed successfully", gnoisonic.UpdateFirmwareStatus_SUCCEEDED, 0)
+}
+
+// resolveFirmwareSource turns the firmware_source parameter into a local path
+// to the image. Paths are looked up as given first and then under the host
+// filesystem mount, since the server usually runs in a container.
+func resolveFirmwareSource(source string) (string, error) {
+	if source == "" {
+		return "", fmt.Errorf("firmware source not specified")
+	}
+	if strings.Contains(source, "://") {
+		return "", fmt.Errorf("unsupported firmware source %q: only local paths and http(s) URLs are supported", source)
+	}
+
+	candidates := []string{source}
+	if filepath.IsAbs(source) {
+		candidates = append(candidates, filepath.Join(hostRoot, source))
+	}
+
+	for _, path := range candidates {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			return "", fmt.Errorf("firmware source %s is a directory", path)
+		}
+		return path, nil
+	}
+
+	return "", fmt.Errorf("firmware source %s not found", source)
+}
+
+// installerExitCode maps a non-zero exit code of the installer to the code
+// reported in the FAILED status, keeping it inside the promised range
+func installerExitCode(exitCode int) int32 {
+	switch {
+	case exitCode < 0:
+		// Killed by a signal before it could exit
+		return ExitCodeAborted
+	case exitCode >= int(MinExitCode) && exitCode <= int(MaxExitCode):
+		return int32(exitCode)
+	}
+	return ExitCodeInstallerFailed
+}
+
+// startErrorExitCode maps an error starting the installer to the exit code a
+// shell would have reported for it
+func startErrorExitCode(err error) int32 {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return ExitCodeNotFound
+	}
+	return ExitCodeCannotExecute
 }
@@ -0,0 +1,282 @@
+package sonicservice
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	gnoisonic "upgrade-agent/gnoi_sonic"
+	"upgrade-agent/internal/executor"
+	"upgrade-agent/internal/signature"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeUpdateStream is the server side of an UpdateFirmware call that sends
+// req and records the statuses sent back
+type fakeUpdateStream struct {
+	grpc.ServerStream
+	req  *gnoisonic.UpdateFirmwareRequest
+	sent []*gnoisonic.UpdateFirmwareStatus
+}
+
+func (f *fakeUpdateStream) Context() context.Context {
+	return context.Background()
+}
+
+func (f *fakeUpdateStream) Recv() (*gnoisonic.UpdateFirmwareRequest, error) {
+	if f.req == nil {
+		return nil, io.EOF
+	}
+	req := f.req
+	f.req = nil
+	return req, nil
+}
+
+func (f *fakeUpdateStream) Send(st *gnoisonic.UpdateFirmwareStatus) error {
+	f.sent = append(f.sent, st)
+	return nil
+}
+
+// lines returns the log lines of every status sent
+func (f *fakeUpdateStream) lines() []string {
+	var lines []string
+	for _, st := range f.sent {
+		lines = append(lines, st.GetLogLine())
+	}
+	return lines
+}
+
+// newTestService creates a Service installing through rec and downloading
+// into a temporary directory
+func newTestService(t *testing.T, rec *executor.Recorder) *Service {
+	t.Helper()
+	return NewService(nil, t.TempDir(), rec, nil, nil, signature.Policy{})
+}
+
+// runUpdate calls UpdateFirmware with params and returns the last status sent
+func runUpdate(t *testing.T, s *Service, params *gnoisonic.FirmwareUpdateParams) (*gnoisonic.UpdateFirmwareStatus, *fakeUpdateStream) {
+	t.Helper()
+	stream := &fakeUpdateStream{req: &gnoisonic.UpdateFirmwareRequest{
+		Request: &gnoisonic.UpdateFirmwareRequest_FirmwareUpdate{FirmwareUpdate: params},
+	}}
+	if err := s.UpdateFirmware(stream); err != nil {
+		t.Fatalf("UpdateFirmware() error = %v", err)
+	}
+	if len(stream.sent) == 0 {
+		t.Fatal("UpdateFirmware() sent no status")
+	}
+	return stream.sent[len(stream.sent)-1], stream
+}
+
+// writeImage creates a firmware image in a temporary directory
+func writeImage(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sonic.bin")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestInstallerExitCode(t *testing.T) {
+	tests := []struct {
+		exitCode int
+		want     int32
+	}{
+		{-1, ExitCodeAborted},
+		{1, ExitCodeInstallerFailed},
+		{2, ExitCodeInstallerFailed},
+		{125, ExitCodeInstallerFailed},
+		{126, 126},
+		{133, 133},
+		{140, 140},
+		{141, ExitCodeInstallerFailed},
+		{255, ExitCodeInstallerFailed},
+	}
+	for _, tt := range tests {
+		if got := installerExitCode(tt.exitCode); got != tt.want {
+			t.Errorf("installerExitCode(%d) = %d, want %d", tt.exitCode, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateFirmwareInstallerResult(t *testing.T) {
+	tests := []struct {
+		name         string
+		result       executor.Result
+		wantState    gnoisonic.UpdateFirmwareStatus_State
+		wantExitCode int32
+		wantLine     string
+	}{
+		{
+			name:      "success",
+			result:    executor.Result{Output: []string{"Installing image", "Done"}},
+			wantState: gnoisonic.UpdateFirmwareStatus_SUCCEEDED,
+			wantLine:  "Firmware update completed successfully",
+		},
+		{
+			name:         "exit code in range",
+			result:       executor.Result{ExitCode: 134},
+			wantState:    gnoisonic.UpdateFirmwareStatus_FAILED,
+			wantExitCode: 134,
+			wantLine:     "Firmware update failed with exit code 134",
+		},
+		{
+			name:         "exit code below range",
+			result:       executor.Result{ExitCode: 1},
+			wantState:    gnoisonic.UpdateFirmwareStatus_FAILED,
+			wantExitCode: ExitCodeInstallerFailed,
+			wantLine:     "Firmware update failed with exit code 1",
+		},
+		{
+			name:         "exit code above range",
+			result:       executor.Result{ExitCode: 255},
+			wantState:    gnoisonic.UpdateFirmwareStatus_FAILED,
+			wantExitCode: ExitCodeInstallerFailed,
+			wantLine:     "Firmware update failed with exit code 255",
+		},
+		{
+			name:         "killed",
+			result:       executor.Result{ExitCode: -1},
+			wantState:    gnoisonic.UpdateFirmwareStatus_FAILED,
+			wantExitCode: ExitCodeAborted,
+			wantLine:     "Firmware update failed with exit code -1",
+		},
+		{
+			name:         "not found",
+			result:       executor.Result{Err: exec.ErrNotFound},
+			wantState:    gnoisonic.UpdateFirmwareStatus_FAILED,
+			wantExitCode: ExitCodeNotFound,
+			wantLine:     "Failed to run installer sonic-installer",
+		},
+		{
+			name:         "cannot execute",
+			result:       executor.Result{Err: errors.New("permission denied")},
+			wantState:    gnoisonic.UpdateFirmwareStatus_FAILED,
+			wantExitCode: ExitCodeCannotExecute,
+			wantLine:     "Failed to run installer sonic-installer",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := executor.NewRecorder()
+			rec.SetResult("sonic-installer install", tt.result)
+			image := writeImage(t, "image")
+
+			last, stream := runUpdate(t, newTestService(t, rec), &gnoisonic.FirmwareUpdateParams{FirmwareSource: image})
+			if last.GetState() != tt.wantState || last.GetExitCode() != tt.wantExitCode {
+				t.Errorf("final status = %v %d, want %v %d", last.GetState(), last.GetExitCode(), tt.wantState, tt.wantExitCode)
+			}
+			if !strings.HasPrefix(last.GetLogLine(), tt.wantLine) {
+				t.Errorf("final line = %q, want prefix %q", last.GetLogLine(), tt.wantLine)
+			}
+			for _, line := range tt.result.Output {
+				if !slices.Contains(stream.lines(), line) {
+					t.Errorf("installer output %q not forwarded, got %q", line, stream.lines())
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateFirmwareCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		cpld    bool
+		wantEnv []string
+	}{
+		{name: "without CPLD update"},
+		{name: "with CPLD update", cpld: true, wantEnv: []string{"UPDATE_MLNX_CPLD_FW=1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := executor.NewRecorder()
+			image := writeImage(t, "image")
+
+			runUpdate(t, newTestService(t, rec), &gnoisonic.FirmwareUpdateParams{
+				FirmwareSource:   image,
+				UpdateMlnxCpldFw: tt.cpld,
+			})
+			commands := rec.Commands()
+			if len(commands) != 1 {
+				t.Fatalf("ran %d commands, want 1", len(commands))
+			}
+			want := executor.Command{Name: "sonic-installer", Args: []string{"install", "-y", image}, Env: tt.wantEnv}
+			if got := commands[0]; got.String() != want.String() {
+				t.Errorf("ran %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestUpdateFirmwareRejectedSource(t *testing.T) {
+	image := writeImage(t, "image")
+	tests := []struct {
+		name         string
+		params       *gnoisonic.FirmwareUpdateParams
+		wantExitCode int32
+	}{
+		{
+			name:         "missing source",
+			params:       &gnoisonic.FirmwareUpdateParams{},
+			wantExitCode: ExitCodeInvalidSource,
+		},
+		{
+			name:         "missing file",
+			params:       &gnoisonic.FirmwareUpdateParams{FirmwareSource: image + ".missing"},
+			wantExitCode: ExitCodeInvalidSource,
+		},
+		{
+			name:         "directory",
+			params:       &gnoisonic.FirmwareUpdateParams{FirmwareSource: filepath.Dir(image)},
+			wantExitCode: ExitCodeInvalidSource,
+		},
+		{
+			name:         "unsupported scheme",
+			params:       &gnoisonic.FirmwareUpdateParams{FirmwareSource: "ftp://example.com/sonic.bin"},
+			wantExitCode: ExitCodeInvalidSource,
+		},
+		{
+			name: "checksum mismatch",
+			params: &gnoisonic.FirmwareUpdateParams{
+				FirmwareSource: image,
+				ExpectedSha256: strings.Repeat("0", 64),
+			},
+			wantExitCode: ExitCodeChecksumMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := executor.NewRecorder()
+
+			last, _ := runUpdate(t, newTestService(t, rec), tt.params)
+			if last.GetState() != gnoisonic.UpdateFirmwareStatus_FAILED || last.GetExitCode() != tt.wantExitCode {
+				t.Errorf("final status = %v %d, want FAILED %d", last.GetState(), last.GetExitCode(), tt.wantExitCode)
+			}
+			if commands := rec.Commands(); len(commands) != 0 {
+				t.Errorf("installer ran: %q", commands)
+			}
+		})
+	}
+}
+
+func TestUpdateFirmwareInProgress(t *testing.T) {
+	s := newTestService(t, executor.NewRecorder())
+	s.updateLock.Lock()
+	defer s.updateLock.Unlock()
+
+	stream := &fakeUpdateStream{}
+	err := s.UpdateFirmware(stream)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("UpdateFirmware() during another update error = %v, want FailedPrecondition", err)
+	}
+}
@@ -0,0 +1,119 @@
+// Package statusapi serves what the agent is doing as JSON over HTTP, for
+// fleet tooling and Kubernetes probes on the same node
+package statusapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"upgrade-agent/internal/agent"
+	"upgrade-agent/internal/logging"
+	"upgrade-agent/internal/metrics"
+)
+
+// DefaultAddr only listens locally; the agent runs with host networking
+const DefaultAddr = "127.0.0.1:8090"
+
+// Source provides the reported state, implemented by agent.Agent
+type Source interface {
+	Status() (agent.Status, error)
+	History() ([]agent.HistoryEntry, error)
+}
+
+// Server is the status HTTP server:
+//
+//	GET /status   current config, last seen version, running and queued job,
+//	              journaled phase and last error, firmware update output
+//	GET /history  finished upgrades with durations and outcomes, oldest first
+//	GET /healthz  200 while the agent is serving
+//	GET /metrics  the agent metrics in the Prometheus text format
+type Server struct {
+	addr   string
+	source Source
+	server *http.Server
+}
+
+// NewServer creates a status server for source on addr
+func NewServer(addr string, source Source) *Server {
+	s := &Server{addr: addr, source: source}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("GET /history", s.handleHistory)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("GET /metrics", metrics.Handler())
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Start listens on the address and serves in the background
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the status API on %s: %w", s.addr, err)
+	}
+	slog.Info("Status API listening", "addr", listener.Addr().String())
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Status API stopped", logging.Err(err))
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops the server, letting running requests finish until ctx ends
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// handleStatus reports the agent status
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.source.Status()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// handleHistory reports the finished upgrades
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	history, err := s.source.History()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if history == nil {
+		history = []agent.HistoryEntry{}
+	}
+	writeJSON(w, history)
+}
+
+// writeJSON sends v as indented JSON
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		slog.Debug("Failed to write status API response", logging.Err(err))
+	}
+}
+
+// writeError reports a failure to read the agent state
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
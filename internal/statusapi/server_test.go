@@ -0,0 +1,144 @@
+package statusapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"upgrade-agent/internal/agent"
+)
+
+// fakeSource reports fixed status and history, or err
+type fakeSource struct {
+	status  agent.Status
+	history []agent.HistoryEntry
+	err     error
+}
+
+func (f fakeSource) Status() (agent.Status, error) {
+	return f.status, f.err
+}
+
+func (f fakeSource) History() ([]agent.HistoryEntry, error) {
+	return f.history, f.err
+}
+
+func TestServer(t *testing.T) {
+	source := fakeSource{
+		status: agent.Status{
+			LastSeenVersion: "SONiC.1.0",
+			Current:         &agent.JobStatus{ID: 3, Kind: agent.JobUpdate, TargetVersion: "SONiC.2.0"},
+			Progress:        []string{"Installing image"},
+		},
+		history: []agent.HistoryEntry{{TargetVersion: "SONiC.1.0", Phase: agent.PhaseDone, DurationSeconds: 420}},
+	}
+
+	tests := []struct {
+		name     string
+		source   fakeSource
+		path     string
+		wantCode int
+		wantBody []string
+	}{
+		{
+			name:     "status",
+			source:   source,
+			path:     "/status",
+			wantCode: http.StatusOK,
+			wantBody: []string{`"lastSeenVersion": "SONiC.1.0"`, `"kind": "update"`, `"targetVersion": "SONiC.2.0"`, `"Installing image"`},
+		},
+		{
+			name:     "history",
+			source:   source,
+			path:     "/history",
+			wantCode: http.StatusOK,
+			wantBody: []string{`"phase": "done"`, `"durationSeconds": 420`},
+		},
+		{
+			name:     "no history",
+			path:     "/history",
+			wantCode: http.StatusOK,
+			wantBody: []string{"[]"},
+		},
+		{
+			name:     "unreadable journal",
+			source:   fakeSource{err: errors.New("corrupt upgrade state")},
+			path:     "/status",
+			wantCode: http.StatusInternalServerError,
+			wantBody: []string{`{"error":"corrupt upgrade state"}`},
+		},
+		{
+			name:     "health",
+			path:     "/healthz",
+			wantCode: http.StatusOK,
+			wantBody: []string{"ok"},
+		},
+		{
+			name:     "metrics",
+			path:     "/metrics",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "unknown path",
+			path:     "/upgrade",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(NewServer(DefaultAddr, tt.source).server.Handler)
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("GET %s = %d, want %d", tt.path, resp.StatusCode, tt.wantCode)
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(string(body), want) {
+					t.Errorf("GET %s body = %s, want it to contain %s", tt.path, body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestServerRejectsWrites(t *testing.T) {
+	server := httptest.NewServer(NewServer(DefaultAddr, fakeSource{}).server.Handler)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/status", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestStartAndShutdown(t *testing.T) {
+	s := NewServer("127.0.0.1:0", fakeSource{})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+
+	if err := NewServer("127.0.0.1:-1", fakeSource{}).Start(); err == nil {
+		t.Errorf("Start() on an invalid address succeeded, want an error")
+	}
+}
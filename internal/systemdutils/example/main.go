@@ -2,10 +2,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 
 	"upgrade-agent/internal/systemdutils"
 )
@@ -14,6 +16,7 @@ func main() {
 	// Parse command line flags
 	cmdFlag := flag.String("cmd", "", "Command to execute via systemd")
 	scriptFlag := flag.String("script", "", "Script content to execute via systemd")
+	streamFlag := flag.Bool("stream", false, "Print the output of -cmd while it runs; Ctrl-C stops the command")
 	flag.Parse()
 
 	// Ensure at least one flag is provided
@@ -21,9 +24,25 @@ func main() {
 		fmt.Println("Usage:")
 		fmt.Println("  -cmd string    Command to execute via systemd")
 		fmt.Println("  -script string Script content to execute via systemd")
+		fmt.Println("  -stream        Print the output of -cmd while it runs")
 		os.Exit(1)
 	}
 
+	if *streamFlag && *cmdFlag != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		fmt.Printf("Executing command: %s\n", *cmdFlag)
+		exitCode, err := systemdutils.RunCommandStreaming(ctx, []string{"/bin/sh", "-c", *cmdFlag}, func(line string) {
+			fmt.Println(line)
+		})
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		fmt.Printf("Exit code: %d\n", exitCode)
+		return
+	}
+
 	var output string
 	var err error
 
@@ -36,12 +55,12 @@ func main() {
 		output, err = systemdutils.RunScriptAsRoot(*scriptFlag)
 	}
 
+	// Output the result, which is also there when the command failed
+	fmt.Println("Command output:")
+	fmt.Println(output)
+
 	// Handle errors
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
-
-	// Output the result
-	fmt.Println("Command output:")
-	fmt.Println(output)
 }
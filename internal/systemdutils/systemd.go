@@ -2,96 +2,332 @@
 package systemdutils
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+
+	"upgrade-agent/internal/logging"
 )
 
+// ExitError is returned by RunCommandAsRoot when the command exits non-zero
+type ExitError struct {
+	ExitCode int
+}
+
+// Error implements error
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command failed with exit code: %d", e.ExitCode)
+}
+
 // RunCommandAsRoot executes a command as root using systemd transient units
-// It creates a oneshot service unit that executes the command and then starts it
+// It creates a oneshot service unit that executes the command and then starts it.
+// The output is returned even when the command fails, together with an
+// *ExitError carrying the exit code.
 func RunCommandAsRoot(command string) (string, error) {
+	output, exitCode, err := RunCommand(context.Background(), []string{"/bin/sh", "-c", command})
+	if err != nil {
+		return output, err
+	}
+	if exitCode != 0 {
+		return output, &ExitError{ExitCode: exitCode}
+	}
+	return output, nil
+}
+
+// RunCommand executes argv in a oneshot transient unit like
+// RunCommandStreaming and returns the collected output with the exit code
+func RunCommand(ctx context.Context, argv []string) (string, int, error) {
+	var lines []string
+	exitCode, err := RunCommandStreaming(ctx, argv, func(line string) {
+		lines = append(lines, line)
+	})
+	return strings.Join(lines, "\n"), exitCode, err
+}
+
+// RunCommandStreaming executes argv in a oneshot transient unit and waits for
+// it, calling onLine with every line the command logs while it runs. It
+// returns the exit code of the command, or -1 if it was killed or could not
+// be started; the error is only set when the unit could not be run. argv[0]
+// must be an absolute path. Cancelling ctx stops the unit. The unit is
+// removed afterwards in every case.
+func RunCommandStreaming(ctx context.Context, argv []string, onLine func(line string)) (int, error) {
 	// Connect to systemd over D-Bus
-	conn, err := systemdDbus.New()
+	conn, err := systemdDbus.NewWithContext(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to connect to systemd: %w", err)
+		return -1, fmt.Errorf("failed to connect to systemd: %w", err)
 	}
 	defer conn.Close()
 
-	// Generate a unique unit name based on the command
-	unitName := fmt.Sprintf("oneshot-cmd-%d.service", time.Now().UnixNano())
+	unitName := newUnitName()
+
+	// Follow the journal of the unit before it exists, so no line is missed
+	follower, err := followJournal(unitName, onLine)
+	if err != nil {
+		return -1, err
+	}
+	defer follower.stop()
 
 	// Define unit properties
 	properties := []systemdDbus.Property{
 		systemdDbus.PropDescription("Transient service for executing command"),
 		systemdDbus.PropType("oneshot"),
-		systemdDbus.PropExecStart([]string{"/bin/sh", "-c", command}, false),
+		systemdDbus.PropExecStart(argv, false),
 		systemdDbus.PropRemainAfterExit(true),
 	}
 
 	// Start the transient unit
-	ch := make(chan string)
-	_, err = conn.StartTransientUnit(unitName, "replace", properties, ch)
+	ch := make(chan string, 1)
+	_, err = conn.StartTransientUnitContext(ctx, unitName, "replace", properties, ch)
 	if err != nil {
-		return "", fmt.Errorf("failed to start transient unit: %w", err)
+		return -1, fmt.Errorf("failed to start transient unit: %w", err)
 	}
 
-	// Wait for job to complete
-	result := <-ch
-	if result != "done" {
-		return "", fmt.Errorf("failed to run command, job status: %s", result)
+	// Clean up the unit whatever happens: a unit that remains after exit
+	// or failed keeps its name reserved otherwise
+	defer func() {
+		conn.StopUnitContext(context.Background(), unitName, "replace", nil)
+		if err := conn.ResetFailedUnitContext(context.Background(), unitName); err != nil {
+			logging.FromContext(ctx).Warn("Failed to reset unit", "unit", unitName, logging.Err(err))
+		}
+	}()
+
+	// Wait for job to complete. A oneshot job fails when the command exits
+	// non-zero, which is reported through the exit code below.
+	var result string
+	select {
+	case result = <-ch:
+	case <-ctx.Done():
+		stopUnit(conn, unitName)
+		return -1, fmt.Errorf("command interrupted: %w", ctx.Err())
+	}
+	if result != "done" && result != "failed" {
+		return -1, fmt.Errorf("failed to run command, job status: %s", result)
 	}
 
 	// Get unit properties to check for exit status
-	prop, err := conn.GetUnitProperties(unitName)
+	prop, err := conn.GetUnitTypePropertiesContext(context.Background(), unitName, "Service")
 	if err != nil {
-		return "", fmt.Errorf("failed to get unit properties: %w", err)
+		return -1, fmt.Errorf("failed to get unit properties: %w", err)
 	}
 
-	// Get exit code
-	exitCodeVal, ok := prop["ExecMainStatus"]
+	exitCode, ok := mainExitCode(prop, result)
 	if !ok {
-		// If the property doesn't exist, assume success
-		fmt.Println("Warning: ExecMainStatus property not found, assuming success")
-	} else if exitCodeVal != nil {
-		exitCode, ok := exitCodeVal.(int32)
-		if ok && exitCode != 0 {
-			return "", fmt.Errorf("command failed with exit code: %d", exitCode)
+		logging.FromContext(ctx).Warn("ExecMainStatus property not found, assuming success", "unit", unitName)
+	}
+
+	// Deliver what the follower has not seen yet
+	if err := follower.finish(); err != nil {
+		return exitCode, fmt.Errorf("failed to get command output: %w", err)
+	}
+	return exitCode, nil
+}
+
+// How the main process of a unit ended, as reported in ExecMainCode
+const (
+	cldKilled = 2
+	cldDumped = 3
+)
+
+// mainExitCode returns the exit code of the main process of a unit from its
+// Service properties, or -1 if it was killed. result is the result of the
+// job that ran the unit. ok is false if the exit status is missing, in which
+// case success is assumed.
+func mainExitCode(prop map[string]interface{}, result string) (exitCode int, ok bool) {
+	status, ok := prop["ExecMainStatus"].(int32)
+	if !ok {
+		if result == "failed" {
+			return -1, false
 		}
+		return 0, false
+	}
+	// ExecMainStatus holds the signal number when the process was killed
+	if code, _ := prop["ExecMainCode"].(int32); code == cldKilled || code == cldDumped {
+		return -1, true
+	}
+	if status == 0 && result == "failed" {
+		// The executable could not be started at all
+		return -1, true
+	}
+	return int(status), true
+}
+
+// stopUnit stops a unit and waits until its processes are gone
+func stopUnit(conn *systemdDbus.Conn, unitName string) {
+	ch := make(chan string, 1)
+	if _, err := conn.StopUnitContext(context.Background(), unitName, "replace", ch); err != nil {
+		slog.Warn("Failed to stop unit", "unit", unitName, logging.Err(err))
+		return
 	}
+	select {
+	case <-ch:
+	case <-time.After(30 * time.Second):
+		slog.Warn("Unit did not stop within 30s", "unit", unitName)
+	}
+}
 
-	// Get output using journalctl since systemd doesn't store command output directly
-	output, err := getCommandOutput(unitName)
+// StartCommand launches argv in a oneshot transient unit without waiting for
+// it to finish, for commands such as reboot that take the caller down with
+// them. wait blocks until the command exits and returns its exit code like
+// RunCommandStreaming, removing the unit; it must be called to release the
+// connection to systemd. argv[0] must be an absolute path.
+func StartCommand(argv []string) (wait func() (int, error), err error) {
+	conn, err := systemdDbus.New()
 	if err != nil {
-		return "", fmt.Errorf("failed to get command output: %w", err)
+		return nil, fmt.Errorf("failed to connect to systemd: %w", err)
 	}
 
-	// Clean up the unit
-	_, err = conn.StopUnit(unitName, "replace", nil)
+	unitName := newUnitName()
+	properties := []systemdDbus.Property{
+		systemdDbus.PropDescription("Transient service for executing command"),
+		systemdDbus.PropType("oneshot"),
+		systemdDbus.PropExecStart(argv, false),
+		systemdDbus.PropRemainAfterExit(true),
+	}
+	ch := make(chan string, 1)
+	if _, err := conn.StartTransientUnit(unitName, "replace", properties, ch); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start transient unit: %w", err)
+	}
+
+	return func() (int, error) {
+		defer conn.Close()
+		defer func() {
+			conn.StopUnit(unitName, "replace", nil)
+			if err := conn.ResetFailedUnit(unitName); err != nil {
+				slog.Warn("Failed to reset unit", "unit", unitName, logging.Err(err))
+			}
+		}()
+
+		result := <-ch
+		if result != "done" && result != "failed" {
+			return -1, fmt.Errorf("failed to run command, job status: %s", result)
+		}
+		prop, err := conn.GetUnitTypeProperties(unitName, "Service")
+		if err != nil {
+			return -1, fmt.Errorf("failed to get unit properties: %w", err)
+		}
+		exitCode, _ := mainExitCode(prop, result)
+		return exitCode, nil
+	}, nil
+}
+
+// newUnitName generates a unique transient unit name
+func newUnitName() string {
+	return fmt.Sprintf("oneshot-cmd-%d.service", time.Now().UnixNano())
+}
+
+// journalFollower streams the journal entries a unit's processes log
+type journalFollower struct {
+	unitName string
+	onLine   func(string)
+	cmd      *exec.Cmd
+	done     chan struct{}
+	// cursor is the position of the last entry delivered
+	cursor  string
+	stopped sync.Once
+}
+
+// followJournal starts `journalctl -f` for the unit. Only entries logged by
+// the unit's processes match, not systemd's messages about the unit.
+func followJournal(unitName string, onLine func(string)) (*journalFollower, error) {
+	f := &journalFollower{unitName: unitName, onLine: onLine, done: make(chan struct{})}
+	f.cmd = exec.Command("journalctl", "_SYSTEMD_UNIT="+unitName, "--follow", "--lines=all", "--output=json", "--no-pager")
+	stdout, err := f.cmd.StdoutPipe()
 	if err != nil {
-		return "", fmt.Errorf("failed to stop unit: %w", err)
+		return nil, fmt.Errorf("failed to open journal pipe: %w", err)
+	}
+	if err := f.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to follow unit journal: %w", err)
 	}
+	go func() {
+		defer close(f.done)
+		f.deliver(stdout)
+	}()
+	return f, nil
+}
 
-	return output, nil
+// deliver passes every journal entry read from r to onLine
+func (f *journalFollower) deliver(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if cursor, ok := entry["__CURSOR"].(string); ok {
+			f.cursor = cursor
+		}
+		if f.onLine != nil {
+			f.onLine(journalMessage(entry["MESSAGE"]))
+		}
+	}
 }
 
-// getCommandOutput retrieves the command output from the journal for the given unit
-func getCommandOutput(unitName string) (string, error) {
-	// Use journalctl to get the command output
-	cmd := exec.Command("journalctl", "-u", unitName, "--no-pager", "-o", "cat")
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// stop terminates journalctl and waits for the pending lines to be delivered
+func (f *journalFollower) stop() {
+	f.stopped.Do(func() {
+		f.cmd.Process.Kill()
+		<-f.done
+		f.cmd.Wait()
+	})
+}
+
+// finish stops following and delivers the entries journald stored after the
+// last one the follower saw
+func (f *journalFollower) finish() error {
+	f.stop()
 
-	err := cmd.Run()
+	// Have journald write out what it has received from the unit's last
+	// moments. Best effort, it needs root.
+	exec.Command("journalctl", "--sync").Run()
+
+	args := []string{"_SYSTEMD_UNIT=" + f.unitName, "--output=json", "--no-pager"}
+	if f.cursor != "" {
+		args = append(args, "--after-cursor="+f.cursor)
+	}
+	cmd := exec.Command("journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return "", fmt.Errorf("failed to get unit output: %v, stderr: %s", err, stderr.String())
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
 	}
+	f.deliver(stdout)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%v, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
 
-	return stdout.String(), nil
+// journalMessage decodes a MESSAGE field, which journalctl writes as an array
+// of bytes when it is not valid UTF-8
+func journalMessage(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []any:
+		b := make([]byte, 0, len(v))
+		for _, c := range v {
+			if n, ok := c.(float64); ok {
+				b = append(b, byte(n))
+			}
+		}
+		return string(b)
+	}
+	return ""
 }
 
 // RunScriptAsRoot executes a script content as root using systemd transient units
@@ -0,0 +1,84 @@
+package systemdutils
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMainExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		prop     map[string]interface{}
+		result   string
+		wantCode int
+		wantOK   bool
+	}{
+		{"success", map[string]interface{}{"ExecMainStatus": int32(0), "ExecMainCode": int32(1)}, "done", 0, true},
+		{"exit code", map[string]interface{}{"ExecMainStatus": int32(3), "ExecMainCode": int32(1)}, "failed", 3, true},
+		{"killed", map[string]interface{}{"ExecMainStatus": int32(9), "ExecMainCode": int32(cldKilled)}, "failed", -1, true},
+		{"dumped core", map[string]interface{}{"ExecMainStatus": int32(11), "ExecMainCode": int32(cldDumped)}, "failed", -1, true},
+		{"not started", map[string]interface{}{"ExecMainStatus": int32(0)}, "failed", -1, true},
+		{"no status", map[string]interface{}{}, "done", 0, false},
+		{"no status after failure", map[string]interface{}{}, "failed", -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, ok := mainExitCode(tt.prop, tt.result)
+			if code != tt.wantCode || ok != tt.wantOK {
+				t.Errorf("mainExitCode() = %d, %v, want %d, %v", code, ok, tt.wantCode, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestJournalMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"string", "Installing image", "Installing image"},
+		{"bytes", []any{float64('o'), float64('k'), float64(0xff)}, "ok\xff"},
+		{"missing", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := journalMessage(tt.value); got != tt.want {
+				t.Errorf("journalMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	journal := strings.Join([]string{
+		`{"__CURSOR": "s=1", "MESSAGE": "first"}`,
+		`not JSON`,
+		`{"__CURSOR": "s=2", "MESSAGE": [115, 101, 99, 111, 110, 100]}`,
+		`{"__CURSOR": "s=3", "MESSAGE": "` + strings.Repeat("x", 100*1024) + `"}`,
+	}, "\n")
+	var lines []string
+	f := &journalFollower{onLine: func(line string) { lines = append(lines, line) }}
+	f.deliver(strings.NewReader(journal))
+
+	want := []string{"first", "second", strings.Repeat("x", 100*1024)}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("delivered %d lines, want %d: first, second and a long line", len(lines), len(want))
+	}
+	if f.cursor != "s=3" {
+		t.Errorf("cursor = %q, want s=3", f.cursor)
+	}
+}
+
+func TestQuoteCommand(t *testing.T) {
+	script := `echo 'it''s' "$HOME"; exit 0`
+	out, err := exec.Command("/bin/sh", "-c", "printf %s "+quoteCommand(script)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != script {
+		t.Errorf("quoted script = %q, want %q", out, script)
+	}
+}
@@ -0,0 +1,77 @@
+package systemservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"upgrade-agent/internal/fileutils"
+
+	"github.com/openconfig/gnoi/system"
+)
+
+// DefaultRebootStateFile is where the reboot counter and the last reboot are
+// recorded. It must survive reboots, so in a container it has to live on a
+// host mount.
+const DefaultRebootStateFile = "/var/lib/upgrade-server/reboot-state.json"
+
+// rebootState is what is remembered about reboots across restarts
+type rebootState struct {
+	// Count is the number of reboots executed through this service
+	Count uint32 `json:"count"`
+	// LastReason is the message of the last reboot request
+	LastReason string `json:"lastReason,omitempty"`
+	// LastMethod is the method of the last reboot
+	LastMethod system.RebootMethod `json:"lastMethod,omitempty"`
+	// LastRebootAt is when the last reboot was executed
+	LastRebootAt time.Time `json:"lastRebootAt,omitempty"`
+	// LastStatus tells whether the last reboot could be started
+	LastStatus system.RebootStatus_Status `json:"lastStatus,omitempty"`
+	// LastStatusMessage explains a failed reboot
+	LastStatusMessage string `json:"lastStatusMessage,omitempty"`
+}
+
+// loadRebootState reads the state file. A missing file means no reboot has
+// been recorded yet and yields a zero state.
+func loadRebootState(path string) (rebootState, error) {
+	var state rebootState
+	if path == "" {
+		return state, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, fmt.Errorf("failed to read reboot state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse reboot state %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// saveRebootState atomically writes the state file. Nothing is written when
+// no path is configured.
+func saveRebootState(path string, state rebootState) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode reboot state: %w", err)
+	}
+
+	// The state is written right before the host goes down, so it has to
+	// reach the disk whole
+	if err := fileutils.WriteAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to save reboot state: %w", err)
+	}
+
+	slog.Debug("Saved reboot state", "count", state.Count, "reason", state.LastReason)
+	return nil
+}
@@ -3,114 +3,304 @@ package systemservice
 
 import (
 	"context"
-	"log"
-	"os/exec"
+	"fmt"
+	"log/slog"
+	"sync"
 	"time"
 
+	"upgrade-agent/internal/executor"
+	"upgrade-agent/internal/logging"
+	"upgrade-agent/internal/metrics"
+
 	"github.com/openconfig/gnoi/system"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rebootGracePeriod is the minimum time between a Reboot request and the
+// reboot, so the response reaches the client first
+const rebootGracePeriod = 2 * time.Second
+
+// rebootCommands maps the supported reboot methods to the SONiC host command
+// performing them
+var rebootCommands = map[system.RebootMethod]string{
+	system.RebootMethod_COLD:      "reboot",
+	system.RebootMethod_WARM:      "warm-reboot",
+	system.RebootMethod_NSF:       "fast-reboot",
+	system.RebootMethod_POWERDOWN: "poweroff",
+}
+
+// Reboot metrics, by reboot method such as COLD
+var (
+	rebootsExecuted = metrics.NewCounter("upgrade_server_reboots_total",
+		"Reboots executed, including faked ones, by method", "method")
+	rebootFailures = metrics.NewCounter("upgrade_server_reboot_failures_total",
+		"Reboots whose command failed to start or exited with an error, by method", "method")
 )
 
 // Service implements the gNOI System service
 type Service struct {
 	system.UnimplementedSystemServer
 	fakeReboot bool
+	stateFile  string
+	executor   executor.Executor
+
+	lock    sync.Mutex
+	pending *pendingReboot
+	state   rebootState
 }
 
-// NewService creates a new System service instance
-func NewService(fakeReboot bool) *Service {
+// pendingReboot is a reboot that was requested but has not happened yet
+type pendingReboot struct {
+	method      system.RebootMethod
+	command     executor.Command
+	message     string
+	requestedAt time.Time
+	when        time.Time
+	timer       *time.Timer
+	// executing is set once the timer fired; the reboot can no longer be cancelled
+	executing bool
+	// logger is the logger of the Reboot request, used until the reboot happens
+	logger *slog.Logger
+}
+
+// NewService creates a new System service instance. Reboot commands run
+// through hostExecutor, which must reach the host namespaces. The reboot
+// counter and the last reboot are kept in stateFile, or only in memory if it
+// is empty.
+func NewService(fakeReboot bool, stateFile string, hostExecutor executor.Executor) *Service {
+	state, err := loadRebootState(stateFile)
+	if err != nil {
+		slog.Warn("Starting with an empty reboot history", logging.Err(err))
+	}
 	return &Service{
 		fakeReboot: fakeReboot,
+		stateFile:  stateFile,
+		executor:   hostExecutor,
+		state:      state,
 	}
 }
 
 // Time implements the gNOI System.Time RPC
 func (s *Service) Time(ctx context.Context, req *system.TimeRequest) (*system.TimeResponse, error) {
-	log.Println("Received System.Time request")
-
 	// Get the current system time in nanoseconds since epoch
 	now := time.Now()
 	nanos := now.UnixNano()
 
-	log.Printf("Responding with current system time: %v", now)
+	logging.FromContext(ctx).Debug("Responding with current system time", "time", now)
 	return &system.TimeResponse{
 		Time: uint64(nanos),
 	}, nil
 }
 
-// Reboot implements the gNOI System.Reboot RPC
+// Reboot implements the gNOI System.Reboot RPC. The reboot is scheduled after
+// the requested delay and can be aborted with CancelReboot until then.
 func (s *Service) Reboot(ctx context.Context, req *system.RebootRequest) (*system.RebootResponse, error) {
-	log.Printf("Received System.Reboot request with method: %v", req.GetMethod())
+	logger := logging.FromContext(ctx).With("method", req.GetMethod().String())
+	logger.Info("Received reboot request", "delay", time.Duration(req.GetDelay()), "message", req.GetMessage())
 
-	// In a real implementation, we would handle the different reboot methods, delay, etc.
-	// For this proof of concept, we'll just log the request and initiate a reboot
+	command, err := rebootCommand(req)
+	if err != nil {
+		return nil, err
+	}
 
-	// Start a goroutine to perform the reboot after a short delay
-	go func() {
-		log.Println("Scheduling system reboot in 2 seconds...")
-		time.Sleep(2 * time.Second)
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-		// Check if we should fake the reboot
-		if s.fakeReboot {
-			log.Println("FAKE REBOOT MODE: Simulating a system reboot without actually rebooting")
-			return
-		}
+	if s.pending != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "a %v reboot is already scheduled for %s",
+			s.pending.method, s.pending.when.Format(time.RFC3339))
+	}
 
-		log.Println("Executing reboot command on host system")
+	delay := time.Duration(req.GetDelay())
+	if delay < rebootGracePeriod {
+		delay = rebootGracePeriod
+	}
+	now := time.Now()
+	p := &pendingReboot{
+		method:      req.GetMethod(),
+		command:     command,
+		message:     req.GetMessage(),
+		requestedAt: now,
+		when:        now.Add(delay),
+		logger:      logger,
+	}
+	p.timer = time.AfterFunc(delay, func() { s.executeReboot(p) })
+	s.pending = p
 
-		// We've verified we can access the host's namespaces correctly
-		log.Println("Initiating host reboot via nsenter")
+	logger.Info("Scheduled reboot", "delay", delay)
+	return &system.RebootResponse{}, nil
+}
+
+// rebootCommand returns the host command performing the requested reboot
+func rebootCommand(req *system.RebootRequest) (executor.Command, error) {
+	if len(req.GetSubcomponents()) > 0 {
+		return executor.Command{}, status.Error(codes.Unimplemented, "rebooting subcomponents is not supported")
+	}
+	if req.GetMethod() == system.RebootMethod_UNKNOWN {
+		return executor.Command{}, status.Error(codes.InvalidArgument, "reboot method must be set")
+	}
+	name, ok := rebootCommands[req.GetMethod()]
+	if !ok {
+		return executor.Command{}, status.Errorf(codes.Unimplemented, "reboot method %v is not supported", req.GetMethod())
+	}
 
-		// Ensure all log messages are written before the reboot command
-		log.Println("--------- REBOOT COMMAND WILL BE EXECUTED NEXT ---------")
-		// Force flush log buffers by syncing filesystem
-		cmd := exec.Command("sync")
-		cmd.Run()
-		time.Sleep(1 * time.Second)
+	command := executor.Command{Name: name}
+	// warm-reboot and fast-reboot refuse to run when their pre-checks fail
+	// unless forced
+	if req.GetForce() && (req.GetMethod() == system.RebootMethod_WARM || req.GetMethod() == system.RebootMethod_NSF) {
+		command.Args = append(command.Args, "-f")
+	}
+	return command, nil
+}
 
-		// Use the exact command format specified for rebooting the host
-		log.Printf("Executing reboot command: nsenter --target 1 --mount --uts --ipc --net --pid reboot")
+// CancelReboot implements the gNOI System.CancelReboot RPC
+func (s *Service) CancelReboot(ctx context.Context, req *system.CancelRebootRequest) (*system.CancelRebootResponse, error) {
+	logger := logging.FromContext(ctx)
+	logger.Info("Received reboot cancellation", "message", req.GetMessage())
 
-		// Run the command and don't wait for output to avoid being killed mid-execution
-		rebootCmd := exec.Command("nsenter", "--target", "1", "--mount", "--uts", "--ipc", "--net", "--pid", "reboot")
-		err := rebootCmd.Start()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-		if err != nil {
-			log.Printf("Error starting reboot command: %v", err)
-		} else {
-			log.Println("Reboot command started successfully, system will reboot momentarily...")
-		}
+	if s.pending == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no reboot is scheduled")
+	}
+	if s.pending.executing || !s.pending.timer.Stop() {
+		return nil, status.Error(codes.FailedPrecondition, "the reboot is already in progress")
+	}
 
-		// Give the command a moment to execute
-		time.Sleep(1 * time.Second)
+	logger.Info("Cancelled scheduled reboot", "method", s.pending.method.String(),
+		"when", s.pending.when.Format(time.RFC3339), "reboot_message", s.pending.message)
+	s.pending = nil
+	return &system.CancelRebootResponse{}, nil
+}
 
-		// Log immediately after attempt to ensure we see this before any reboot happens
-		log.Printf("Reboot command executed. System should be rebooting now.")
+// executeReboot runs when the delay of p expires
+func (s *Service) executeReboot(p *pendingReboot) {
+	s.lock.Lock()
+	if s.pending != p {
+		// Cancelled while the timer fired
+		s.lock.Unlock()
+		return
+	}
+	p.executing = true
 
-		// Sleep a bit to ensure logs are flushed
-		log.Println("Waiting for reboot to take effect...")
-		time.Sleep(5 * time.Second)
-	}()
+	// Count the reboot before it happens, there is no chance afterwards
+	rebootsExecuted.Inc(p.method.String())
+	s.state.Count++
+	s.state.LastReason = p.message
+	s.state.LastMethod = p.method
+	s.state.LastRebootAt = time.Now()
+	s.state.LastStatus = system.RebootStatus_STATUS_SUCCESS
+	s.state.LastStatusMessage = ""
+	if err := saveRebootState(s.stateFile, s.state); err != nil {
+		p.logger.Warn("Failed to record reboot", logging.Err(err))
+	}
+	s.lock.Unlock()
 
-	log.Println("Reboot initiated successfully")
-	return &system.RebootResponse{}, nil
+	// Check if we should fake the reboot
+	if s.fakeReboot {
+		p.logger.Info("Fake reboot mode: simulating a reboot without rebooting", "command", p.command.String())
+		s.finishReboot(p, nil)
+		return
+	}
+
+	// Ensure all log messages are written before the reboot command
+	p.logger.Warn("Rebooting the host, the reboot command runs next", "executor", s.executor.Name())
+	// Force flush log buffers by syncing filesystem
+	s.executor.Run(context.Background(), executor.Command{Name: "sync"}, nil)
+	time.Sleep(1 * time.Second)
+
+	p.logger.Info("Executing reboot command", "command", p.command.String())
+
+	// Run the command and don't wait for output to avoid being killed mid-execution
+	wait, err := s.executor.Start(p.command)
+	if err != nil {
+		p.logger.Error("Failed to start reboot command", logging.Err(err))
+		s.finishReboot(p, err)
+		return
+	}
+	p.logger.Info("Reboot command started, waiting for the reboot to take effect")
+
+	// The command only returns if the reboot did not take the server down
+	// with it. reboot itself exits 0 once the reboot is under way, while
+	// warm-reboot and fast-reboot exit non-zero when a pre-check fails.
+	exitCode, err := wait()
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("%s exited with code %d", p.command.Name, exitCode)
+	}
+	if err != nil {
+		p.logger.Error("Reboot command failed", logging.Err(err))
+		s.finishReboot(p, err)
+		return
+	}
+	p.logger.Info("Reboot command finished, the reboot is under way")
 }
 
-// RebootStatus implements the gNOI System.RebootStatus RPC
-func (s *Service) RebootStatus(ctx context.Context, req *system.RebootStatusRequest) (*system.RebootStatusResponse, error) {
-	log.Println("Received System.RebootStatus request")
+// finishReboot clears the pending reboot p once it is known not to take the
+// server down with it: it was faked, or the command failed to start or
+// exited with an error
+func (s *Service) finishReboot(p *pendingReboot, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	// For this simple implementation, we'll just return a fixed response
-	// In a real implementation, we would track the reboot status
+	if s.pending == p {
+		s.pending = nil
+	}
+	if err == nil {
+		return
+	}
+	// The reboot did not happen, so it does not count
+	rebootFailures.Inc(p.method.String())
+	s.state.Count--
+	s.state.LastStatus = system.RebootStatus_STATUS_FAILURE
+	s.state.LastStatusMessage = err.Error()
+	if err := saveRebootState(s.stateFile, s.state); err != nil {
+		p.logger.Warn("Failed to record reboot failure", logging.Err(err))
+	}
+}
 
-	if s.fakeReboot {
-		log.Println("FAKE REBOOT MODE: Reporting reboot as completed")
+// RebootStatus implements the gNOI System.RebootStatus RPC. While a reboot is
+// scheduled it reports its method, reason and remaining wait; otherwise it
+// describes the last reboot.
+func (s *Service) RebootStatus(ctx context.Context, req *system.RebootStatusRequest) (*system.RebootStatusResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if p := s.pending; p != nil {
+		var wait time.Duration
+		if !p.executing {
+			wait = time.Until(p.when)
+			if wait < 0 {
+				wait = 0
+			}
+		}
+		return &system.RebootStatusResponse{
+			Active: true,
+			Wait:   uint64(wait),
+			When:   uint64(p.when.UnixNano()),
+			Reason: p.message,
+			Count:  s.state.Count,
+			Method: p.method,
+		}, nil
 	}
 
-	return &system.RebootStatusResponse{
-		Active: false, // No reboot is currently active
-		Wait:   0,     // No wait time
+	resp := &system.RebootStatusResponse{
+		Active: false,
 		Reason: "No reboot scheduled",
-		Count:  1,     // Assume at least one reboot has occurred
-		Method: system.RebootMethod_COLD, // Assume a cold reboot
-	}, nil
+		Count:  s.state.Count,
+		Method: s.state.LastMethod,
+	}
+	if !s.state.LastRebootAt.IsZero() {
+		resp.When = uint64(s.state.LastRebootAt.UnixNano())
+		resp.Reason = s.state.LastReason
+		resp.Status = &system.RebootStatus{
+			Status:  s.state.LastStatus,
+			Message: s.state.LastStatusMessage,
+		}
+	}
+	if s.fakeReboot {
+		logging.FromContext(ctx).Debug("Fake reboot mode: reporting the reboot as completed")
+	}
+	return resp, nil
 }
@@ -0,0 +1,228 @@
+package systemservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"upgrade-agent/internal/executor"
+
+	"github.com/openconfig/gnoi/system"
+	"github.com/openconfig/gnoi/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rebootStatus calls RebootStatus, failing the test on error
+func rebootStatus(t *testing.T, s *Service) *system.RebootStatusResponse {
+	t.Helper()
+	resp, err := s.RebootStatus(context.Background(), &system.RebootStatusRequest{})
+	if err != nil {
+		t.Fatalf("RebootStatus() error = %v", err)
+	}
+	return resp
+}
+
+// ranCommand reports whether rec ran or started a command called name
+func ranCommand(rec *executor.Recorder, name string) (executor.Command, bool) {
+	for _, cmd := range rec.Commands() {
+		if cmd.Name == name {
+			return cmd, true
+		}
+	}
+	return executor.Command{}, false
+}
+
+func TestRebootRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *system.RebootRequest
+		wantCode codes.Code
+	}{
+		{
+			name: "cold",
+			req:  &system.RebootRequest{Method: system.RebootMethod_COLD, Delay: uint64(time.Hour)},
+		},
+		{
+			name:     "no method",
+			req:      &system.RebootRequest{Delay: uint64(time.Hour)},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "unsupported method",
+			req:      &system.RebootRequest{Method: system.RebootMethod_HALT, Delay: uint64(time.Hour)},
+			wantCode: codes.Unimplemented,
+		},
+		{
+			name: "subcomponent",
+			req: &system.RebootRequest{
+				Method:        system.RebootMethod_COLD,
+				Delay:         uint64(time.Hour),
+				Subcomponents: []*types.Path{{Elem: []*types.PathElem{{Name: "components"}}}},
+			},
+			wantCode: codes.Unimplemented,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewService(false, "", executor.NewRecorder())
+
+			_, err := s.Reboot(context.Background(), tt.req)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("Reboot() error = %v, want code %v", err, tt.wantCode)
+			}
+			if got := rebootStatus(t, s).GetActive(); got != (err == nil) {
+				t.Errorf("RebootStatus().Active = %v, want %v", got, err == nil)
+			}
+		})
+	}
+}
+
+func TestRebootScheduled(t *testing.T) {
+	rec := executor.NewRecorder()
+	s := NewService(false, "", rec)
+	ctx := context.Background()
+
+	req := &system.RebootRequest{Method: system.RebootMethod_WARM, Delay: uint64(time.Hour), Message: "upgrade"}
+	if _, err := s.Reboot(ctx, req); err != nil {
+		t.Fatalf("Reboot() error = %v", err)
+	}
+	resp := rebootStatus(t, s)
+	if !resp.GetActive() || resp.GetMethod() != system.RebootMethod_WARM || resp.GetReason() != "upgrade" {
+		t.Errorf("RebootStatus() = %v, want an active WARM reboot for upgrade", resp)
+	}
+	if wait := time.Duration(resp.GetWait()); wait <= 59*time.Minute || wait > time.Hour {
+		t.Errorf("RebootStatus().Wait = %v, want about an hour", wait)
+	}
+
+	_, err := s.Reboot(ctx, &system.RebootRequest{Method: system.RebootMethod_COLD})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("second Reboot() error = %v, want FailedPrecondition", err)
+	}
+
+	if _, err := s.CancelReboot(ctx, &system.CancelRebootRequest{Message: "changed my mind"}); err != nil {
+		t.Fatalf("CancelReboot() error = %v", err)
+	}
+	if resp := rebootStatus(t, s); resp.GetActive() || resp.GetCount() != 0 {
+		t.Errorf("RebootStatus() after cancelling = %v, want no reboot", resp)
+	}
+	if _, err := s.CancelReboot(ctx, &system.CancelRebootRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("second CancelReboot() error = %v, want FailedPrecondition", err)
+	}
+
+	// A new reboot can be requested once the first one is cancelled
+	if _, err := s.Reboot(ctx, req); err != nil {
+		t.Fatalf("Reboot() after cancelling error = %v", err)
+	}
+	if _, err := s.CancelReboot(ctx, &system.CancelRebootRequest{}); err != nil {
+		t.Fatalf("CancelReboot() error = %v", err)
+	}
+	if cmd, ok := ranCommand(rec, "warm-reboot"); ok {
+		t.Errorf("cancelled reboot ran %q", cmd)
+	}
+}
+
+func TestRebootExecuted(t *testing.T) {
+	tests := []struct {
+		name        string
+		fakeReboot  bool
+		req         *system.RebootRequest
+		result      executor.Result
+		wantCommand string
+		// wantActive is set when the reboot is still under way, as it is
+		// until the command takes the server down
+		wantActive  bool
+		wantStatus  system.RebootStatus_Status
+		wantMessage string
+		wantCount   uint32
+	}{
+		{
+			name:        "cold",
+			req:         &system.RebootRequest{Method: system.RebootMethod_COLD},
+			wantCommand: "reboot",
+			wantActive:  true,
+			wantCount:   1,
+		},
+		{
+			name:        "forced warm",
+			req:         &system.RebootRequest{Method: system.RebootMethod_WARM, Force: true},
+			wantCommand: "warm-reboot -f",
+			wantActive:  true,
+			wantCount:   1,
+		},
+		{
+			name:        "pre-check failed",
+			req:         &system.RebootRequest{Method: system.RebootMethod_WARM},
+			result:      executor.Result{ExitCode: 3},
+			wantCommand: "warm-reboot",
+			wantStatus:  system.RebootStatus_STATUS_FAILURE,
+			wantMessage: "warm-reboot exited with code 3",
+		},
+		{
+			name:        "start failed",
+			req:         &system.RebootRequest{Method: system.RebootMethod_NSF},
+			result:      executor.Result{Err: errors.New("no such file")},
+			wantCommand: "fast-reboot",
+			wantStatus:  system.RebootStatus_STATUS_FAILURE,
+			wantMessage: "no such file",
+		},
+		{
+			name:       "faked",
+			fakeReboot: true,
+			req:        &system.RebootRequest{Method: system.RebootMethod_COLD},
+			wantStatus: system.RebootStatus_STATUS_SUCCESS,
+			wantCount:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			rec := executor.NewRecorder()
+			name := rebootCommands[tt.req.GetMethod()]
+			rec.SetResult(name, tt.result)
+			s := NewService(tt.fakeReboot, "", rec)
+
+			if _, err := s.Reboot(context.Background(), tt.req); err != nil {
+				t.Fatalf("Reboot() error = %v", err)
+			}
+
+			// Wait for the grace period to pass and the outcome to settle
+			deadline := time.Now().Add(10 * time.Second)
+			var resp *system.RebootStatusResponse
+			for {
+				resp = rebootStatus(t, s)
+				_, started := ranCommand(rec, name)
+				if (tt.wantActive && started) || (!tt.wantActive && !resp.GetActive()) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("reboot did not settle, last status %v", resp)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			cmd, started := ranCommand(rec, name)
+			if tt.wantCommand == "" && started {
+				t.Errorf("faked reboot ran %q", cmd)
+			}
+			if tt.wantCommand != "" && cmd.String() != tt.wantCommand {
+				t.Errorf("ran %q, want %q", cmd, tt.wantCommand)
+			}
+			if resp.GetActive() != tt.wantActive || resp.GetCount() != tt.wantCount {
+				t.Errorf("RebootStatus() = %v, want active %v and count %d", resp, tt.wantActive, tt.wantCount)
+			}
+			if !tt.wantActive {
+				if resp.GetStatus().GetStatus() != tt.wantStatus || resp.GetStatus().GetMessage() != tt.wantMessage {
+					t.Errorf("RebootStatus().Status = %v, want %v %q", resp.GetStatus(), tt.wantStatus, tt.wantMessage)
+				}
+				// The reboot is over, so another one can be requested
+				if _, err := s.Reboot(context.Background(), &system.RebootRequest{
+					Method: system.RebootMethod_COLD, Delay: uint64(time.Hour),
+				}); err != nil {
+					t.Errorf("Reboot() after the first one ended error = %v", err)
+				}
+			}
+		})
+	}
+}
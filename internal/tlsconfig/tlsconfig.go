@@ -0,0 +1,254 @@
+// Package tlsconfig builds the TLS configurations of the gRPC channel between
+// the agent and the server. Certificates and CA bundles are reloaded from disk
+// when they change, so rotating them does not need a restart.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"upgrade-agent/internal/logging"
+)
+
+// Files names the PEM files making up one side of a TLS connection
+type Files struct {
+	// CertFile and KeyFile are this side's certificate chain and private key
+	CertFile string
+	KeyFile  string
+	// CAFile is the bundle of CAs the peer's certificate is verified against
+	CAFile string
+}
+
+// NewServerConfig returns a server TLS configuration serving Files.CertFile.
+// When Files.CAFile is set, clients must present a certificate signed by one
+// of its CAs (mutual TLS).
+func NewServerConfig(files Files) (*tls.Config, error) {
+	if files.CertFile == "" || files.KeyFile == "" {
+		return nil, errors.New("TLS requires both a certificate and a key file")
+	}
+
+	cert, err := newKeyPairReloader(files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var ca *caReloader
+	if files.CAFile != "" {
+		if ca, err = newCAReloader(files.CAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Build the configuration per handshake so both the certificate and
+		// the client CAs pick up rotated files
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert.get()},
+			}
+			if ca != nil {
+				cfg.ClientCAs = ca.get()
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}, nil
+}
+
+// NewClientConfig returns a client TLS configuration. The server certificate
+// is verified against Files.CAFile, or the system roots if it is empty, and
+// must be issued for serverName, a host name or IP address. Files.CertFile
+// and Files.KeyFile are presented as the client certificate when set.
+func NewClientConfig(files Files, serverName string) (*tls.Config, error) {
+	if serverName == "" {
+		return nil, errors.New("TLS requires the server name to verify")
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	if files.CertFile != "" || files.KeyFile != "" {
+		cert, err := newKeyPairReloader(files.CertFile, files.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.get(), nil
+		}
+	}
+
+	if files.CAFile != "" {
+		ca, err := newCAReloader(files.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		// RootCAs is fixed once the config is in use, so verify against the
+		// current bundle by hand instead
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyServer(cs, serverName, ca.get())
+		}
+	}
+
+	return cfg, nil
+}
+
+// verifyServer does the verification crypto/tls skips with InsecureSkipVerify
+func verifyServer(cs tls.ConnectionState, serverName string, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// fileVersion identifies the content of a file without reading it
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// statFiles returns the versions of the given files
+func statFiles(paths ...string) ([]fileVersion, error) {
+	versions := make([]fileVersion, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+	return versions, nil
+}
+
+// changed reports whether the files differ from the versions last loaded
+func changed(loaded []fileVersion, paths ...string) ([]fileVersion, bool) {
+	current, err := statFiles(paths...)
+	if err != nil {
+		// Probably caught in the middle of a rotation, keep what works
+		return loaded, false
+	}
+	for i := range current {
+		if current[i] != loaded[i] {
+			return current, true
+		}
+	}
+	return loaded, false
+}
+
+// keyPairReloader holds a certificate and key, reloading them when the files change
+type keyPairReloader struct {
+	certFile, keyFile string
+	lock              sync.Mutex
+	cert              *tls.Certificate
+	loaded            []fileVersion
+}
+
+// newKeyPairReloader loads the key pair, failing if it is unusable
+func newKeyPairReloader(certFile, keyFile string) (*keyPairReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("a TLS certificate needs both a certificate and a key file")
+	}
+	r := &keyPairReloader{certFile: certFile, keyFile: keyFile}
+	loaded, err := statFiles(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.cert, r.loaded = &cert, loaded
+	return r, nil
+}
+
+// get returns the current key pair, reloading it first if the files changed.
+// A failed reload keeps the previous key pair.
+func (r *keyPairReloader) get() *tls.Certificate {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	current, ok := changed(r.loaded, r.certFile, r.keyFile)
+	if !ok {
+		return r.cert
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		slog.Warn("Failed to reload TLS certificate, keeping the previous one", "file", r.certFile, logging.Err(err))
+		return r.cert
+	}
+	slog.Info("Reloaded TLS certificate", "file", r.certFile)
+	r.cert, r.loaded = &cert, current
+	return r.cert
+}
+
+// caReloader holds a CA bundle, reloading it when the file changes
+type caReloader struct {
+	file   string
+	lock   sync.Mutex
+	pool   *x509.CertPool
+	loaded []fileVersion
+}
+
+// newCAReloader loads the CA bundle, failing if it holds no certificate
+func newCAReloader(file string) (*caReloader, error) {
+	loaded, err := statFiles(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA bundle: %w", err)
+	}
+	pool, err := loadCAPool(file)
+	if err != nil {
+		return nil, err
+	}
+	return &caReloader{file: file, pool: pool, loaded: loaded}, nil
+}
+
+// get returns the current CA pool, reloading it first if the file changed.
+// A failed reload keeps the previous pool.
+func (r *caReloader) get() *x509.CertPool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	current, ok := changed(r.loaded, r.file)
+	if !ok {
+		return r.pool
+	}
+	pool, err := loadCAPool(r.file)
+	if err != nil {
+		slog.Warn("Failed to reload CA bundle, keeping the previous one", "file", r.file, logging.Err(err))
+		return r.pool
+	}
+	slog.Info("Reloaded CA bundle", "file", r.file)
+	r.pool, r.loaded = pool, current
+	return r.pool
+}
+
+// loadCAPool reads a PEM bundle of CA certificates
+func loadCAPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", file)
+	}
+	return pool, nil
+}
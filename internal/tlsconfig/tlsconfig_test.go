@@ -0,0 +1,328 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA creates a self-signed CA
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for name, valid for servers and
+// clients alike
+func (ca *testCA) issue(t *testing.T, name string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes data to path with a modification time that differs from
+// any earlier write, so the reloaders notice the change
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Duration(len(data)) * time.Second)
+	if info, err := os.Stat(path); err == nil && !info.ModTime().Before(mtime) {
+		mtime = info.ModTime().Add(time.Second)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// side writes the files of one side of a connection into dir
+func side(t *testing.T, dir, name string, ca *testCA, peerCA *testCA) Files {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, name)
+	files := Files{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+		CAFile:   filepath.Join(dir, name+"-ca.crt"),
+	}
+	writeFile(t, files.CertFile, certPEM)
+	writeFile(t, files.KeyFile, keyPEM)
+	writeFile(t, files.CAFile, peerCA.pem)
+	return files
+}
+
+// handshake connects a client and a server over a loopback connection and
+// returns the first error either side saw
+func handshake(t *testing.T, server, client *tls.Config) error {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	clientConn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	serverConn.SetDeadline(deadline)
+	clientConn.SetDeadline(deadline)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		s := tls.Server(serverConn, server)
+		err := s.Handshake()
+		if err == nil {
+			// Have the client's certificate checked under TLS 1.3 too
+			_, err = s.Read(make([]byte, 1))
+		}
+		s.Close()
+		serverErr <- err
+	}()
+
+	c := tls.Client(clientConn, client)
+	err = c.Handshake()
+	if err == nil {
+		_, err = c.Write([]byte{0})
+	}
+	c.Close()
+	if sErr := <-serverErr; err == nil {
+		err = sErr
+	}
+	return err
+}
+
+func TestHandshake(t *testing.T) {
+	ca := newTestCA(t, "switch CA")
+	otherCA := newTestCA(t, "other CA")
+
+	tests := []struct {
+		name string
+		// configure returns the server and client files
+		configure  func(dir string) (server, client Files)
+		serverName string
+		wantErr    bool
+	}{
+		{
+			name: "mutual TLS",
+			configure: func(dir string) (Files, Files) {
+				return side(t, dir, "server", ca, ca), side(t, dir, "agent", ca, ca)
+			},
+			serverName: "server",
+		},
+		{
+			name: "server certificate only",
+			configure: func(dir string) (Files, Files) {
+				server := side(t, dir, "server", ca, ca)
+				server.CAFile = ""
+				return server, Files{CAFile: side(t, dir, "agent", ca, ca).CAFile}
+			},
+			serverName: "server",
+		},
+		{
+			name: "IP address",
+			configure: func(dir string) (Files, Files) {
+				return side(t, dir, "server", ca, ca), side(t, dir, "agent", ca, ca)
+			},
+			serverName: "127.0.0.1",
+		},
+		{
+			name: "wrong server name",
+			configure: func(dir string) (Files, Files) {
+				return side(t, dir, "server", ca, ca), side(t, dir, "agent", ca, ca)
+			},
+			serverName: "other-switch",
+			wantErr:    true,
+		},
+		{
+			name: "untrusted server",
+			configure: func(dir string) (Files, Files) {
+				return side(t, dir, "server", otherCA, ca), side(t, dir, "agent", ca, ca)
+			},
+			serverName: "server",
+			wantErr:    true,
+		},
+		{
+			name: "untrusted client",
+			configure: func(dir string) (Files, Files) {
+				return side(t, dir, "server", ca, ca), side(t, dir, "agent", otherCA, ca)
+			},
+			serverName: "server",
+			wantErr:    true,
+		},
+		{
+			name: "client without certificate",
+			configure: func(dir string) (Files, Files) {
+				return side(t, dir, "server", ca, ca), Files{CAFile: side(t, dir, "agent", ca, ca).CAFile}
+			},
+			serverName: "server",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverFiles, clientFiles := tt.configure(t.TempDir())
+			server, err := NewServerConfig(serverFiles)
+			if err != nil {
+				t.Fatalf("NewServerConfig() error = %v", err)
+			}
+			client, err := NewClientConfig(clientFiles, tt.serverName)
+			if err != nil {
+				t.Fatalf("NewClientConfig() error = %v", err)
+			}
+
+			if err := handshake(t, server, client); (err != nil) != tt.wantErr {
+				t.Errorf("handshake error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	oldCA, newCA := newTestCA(t, "old CA"), newTestCA(t, "new CA")
+	serverFiles := side(t, dir, "server", oldCA, oldCA)
+	clientFiles := side(t, dir, "agent", oldCA, oldCA)
+
+	server, err := NewServerConfig(serverFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClientConfig(clientFiles, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, server, client); err != nil {
+		t.Fatalf("handshake before rotation error = %v", err)
+	}
+
+	// A half-written certificate is ignored until it is complete
+	writeFile(t, serverFiles.CertFile, []byte("-----BEGIN CERTIFICATE-----\n"))
+	if err := handshake(t, server, client); err != nil {
+		t.Errorf("handshake with a broken certificate file error = %v, want the previous certificate kept", err)
+	}
+
+	// Rotate both sides to certificates of the new CA, trusting only it
+	certPEM, keyPEM := newCA.issue(t, "server")
+	writeFile(t, serverFiles.CertFile, certPEM)
+	writeFile(t, serverFiles.KeyFile, keyPEM)
+	writeFile(t, serverFiles.CAFile, newCA.pem)
+	if err := handshake(t, server, client); err == nil {
+		t.Errorf("handshake with only the server rotated succeeded, want the old client rejected")
+	}
+
+	certPEM, keyPEM = newCA.issue(t, "agent")
+	writeFile(t, clientFiles.CertFile, certPEM)
+	writeFile(t, clientFiles.KeyFile, keyPEM)
+	writeFile(t, clientFiles.CAFile, newCA.pem)
+	if err := handshake(t, server, client); err != nil {
+		t.Errorf("handshake after rotating both sides error = %v", err)
+	}
+}
+
+func TestNewConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "switch CA")
+	files := side(t, dir, "server", ca, ca)
+	garbage := filepath.Join(dir, "garbage.pem")
+	writeFile(t, garbage, []byte("not PEM"))
+
+	tests := []struct {
+		name  string
+		build func() error
+	}{
+		{"server without key", func() error {
+			_, err := NewServerConfig(Files{CertFile: files.CertFile})
+			return err
+		}},
+		{"server with missing certificate", func() error {
+			_, err := NewServerConfig(Files{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: files.KeyFile})
+			return err
+		}},
+		{"server with empty CA bundle", func() error {
+			_, err := NewServerConfig(Files{CertFile: files.CertFile, KeyFile: files.KeyFile, CAFile: garbage})
+			return err
+		}},
+		{"client without server name", func() error {
+			_, err := NewClientConfig(Files{CAFile: files.CAFile}, "")
+			return err
+		}},
+		{"client certificate without key", func() error {
+			_, err := NewClientConfig(Files{CertFile: files.CertFile}, "server")
+			return err
+		}},
+		{"client with mismatched key pair", func() error {
+			_, err := NewClientConfig(Files{CertFile: files.CertFile, KeyFile: garbage}, "server")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		if err := tt.build(); err == nil {
+			t.Errorf("%s: got no error", tt.name)
+		}
+	}
+}
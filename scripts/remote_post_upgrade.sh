@@ -1,12 +1,12 @@
 #!/bin/bash
-# Helper script to check or manipulate the post_upgrade_done file on a remote host
+# Helper script to check or reset the upgrade agent state journal on a remote host
 # Usage: ./remote_post_upgrade.sh [host] [action]
 
 set -e
 
 SSH_HOST=${1:-"localhost"}
 ACTION=${2:-"status"}
-FILE_PATH="/etc/sonic/post_upgrade_done"
+FILE_PATH="/etc/sonic/upgrade_agent_state.json"
 
 SSH_USER="${SSH_USER:-admin}"
 SSH_OPTIONS="-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null"
@@ -16,23 +16,18 @@ run_ssh() {
 }
 
 case "$ACTION" in
-  create)
-    echo "Creating post_upgrade_done file on ${SSH_HOST}..."
-    run_ssh "sudo mkdir -p \$(dirname $FILE_PATH) && sudo touch $FILE_PATH && sudo chmod 644 $FILE_PATH"
-    echo "Created: $FILE_PATH on ${SSH_HOST}"
-    ;;
   remove)
-    echo "Removing post_upgrade_done file on ${SSH_HOST}..."
+    echo "Removing upgrade state file on ${SSH_HOST}..."
     run_ssh "sudo rm -f $FILE_PATH"
     echo "Removed: $FILE_PATH from ${SSH_HOST}"
     ;;
   status)
-    echo "Checking status of post_upgrade_done file on ${SSH_HOST}..."
-    run_ssh "if [ -f $FILE_PATH ]; then echo 'File exists:'; sudo ls -la $FILE_PATH; else echo 'File does not exist: $FILE_PATH'; fi"
+    echo "Checking status of upgrade state file on ${SSH_HOST}..."
+    run_ssh "if [ -f $FILE_PATH ]; then echo 'File exists:'; sudo cat $FILE_PATH; else echo 'File does not exist: $FILE_PATH'; fi"
     ;;
   *)
     echo "Unknown action: $ACTION"
-    echo "Usage: $0 [host] [create|remove|status]"
+    echo "Usage: $0 [host] [remove|status]"
     exit 1
     ;;
 esac
@@ -1,36 +1,50 @@
 #!/bin/bash
-# Simple script to manually create or remove the post_upgrade_done file
+# Simple script to inspect or reset the upgrade agent state journal
 # This is useful for testing the post-upgrade verification
 
 set -e
 
 ACTION=${1:-"status"}
-FILE_PATH="/etc/sonic/post_upgrade_done"
+FILE_PATH="/etc/sonic/upgrade_agent_state.json"
 
 case "$ACTION" in
-  create)
-    echo "Creating post_upgrade_done file..."
+  verify)
+    # Pretend a reboot just finished so the agent verifies on next start
+    TARGET_VERSION=${2:?"Usage: $0 verify <target-version>"}
+    echo "Writing upgrade state for post-reboot verification of $TARGET_VERSION..."
     sudo mkdir -p "$(dirname "$FILE_PATH")"
-    sudo touch "$FILE_PATH"
+    NOW=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+    sudo tee "$FILE_PATH" > /dev/null <<JSON
+{
+  "phase": "rebooting",
+  "targetVersion": "$TARGET_VERSION",
+  "config": {
+    "targetVersion": "$TARGET_VERSION"
+  },
+  "startedAt": "$NOW",
+  "updatedAt": "$NOW",
+  "attempts": 1
+}
+JSON
     sudo chmod 644 "$FILE_PATH"
     echo "Created: $FILE_PATH"
     ;;
   remove)
-    echo "Removing post_upgrade_done file..."
+    echo "Removing upgrade state file..."
     sudo rm -f "$FILE_PATH"
     echo "Removed: $FILE_PATH"
     ;;
   status)
     if [ -f "$FILE_PATH" ]; then
-      echo "Post upgrade done file exists: $FILE_PATH"
-      ls -la "$FILE_PATH"
+      echo "Upgrade state file exists: $FILE_PATH"
+      cat "$FILE_PATH"
     else
-      echo "Post upgrade done file does not exist: $FILE_PATH"
+      echo "Upgrade state file does not exist: $FILE_PATH"
     fi
     ;;
   *)
     echo "Unknown action: $ACTION"
-    echo "Usage: $0 [create|remove|status]"
+    echo "Usage: $0 [verify <target-version>|remove|status]"
     exit 1
     ;;
 esac
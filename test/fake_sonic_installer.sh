@@ -0,0 +1,36 @@
+#!/bin/bash
+# Fake sonic-installer for exercising the UpdateFirmware pipeline on a plain
+# Linux box. Run the server with:
+#
+#   ./upgrade-server --port 8080 --executor local --installer "$(pwd)/test/fake_sonic_installer.sh install -y"
+#
+# Environment variables:
+#   FAKE_INSTALLER_EXIT_CODE  Exit code to return (default: 0)
+#   FAKE_INSTALLER_DELAY      Seconds to sleep between output lines (default: 0)
+
+EXIT_CODE=${FAKE_INSTALLER_EXIT_CODE:-0}
+DELAY=${FAKE_INSTALLER_DELAY:-0}
+IMAGE="${!#}"
+
+step() {
+  echo "$1"
+  sleep "$DELAY"
+}
+
+step "Fake installer invoked with: $*"
+step "UPDATE_MLNX_CPLD_FW=${UPDATE_MLNX_CPLD_FW:-0}"
+
+if [ ! -f "$IMAGE" ]; then
+  echo "Image file '$IMAGE' does not exist or is not a regular file" >&2
+  exit 1
+fi
+
+step "Installing image from $IMAGE"
+step "Verifying image checksum..."
+step "Installing image files..."
+if [ "$EXIT_CODE" -ne 0 ]; then
+  echo "Installation failed, exiting with $EXIT_CODE" >&2
+  exit "$EXIT_CODE"
+fi
+step "Set next boot to new image"
+step "Done"
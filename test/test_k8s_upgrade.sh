@@ -144,7 +144,7 @@ run_ssh "docker exec ${AGENT_CONTAINER} cat /etc/upgrade-agent/config.yaml"
 # Stream logs from both containers using SSH and docker logs
 echo "Streaming logs from agent and server containers..."
 echo "=== AGENT LOGS ==="
-run_ssh "docker logs -f ${AGENT_CONTAINER} | grep -E 'post-reboot|upgrade in progress|post_upgrade_done|version after'" &
+run_ssh "docker logs -f ${AGENT_CONTAINER} | grep -E 'post-reboot|upgrade state|phase=|version after'" &
 AGENT_LOG_PID=$!
 
 echo "=== SERVER LOGS ==="
@@ -155,9 +155,9 @@ SERVER_LOG_PID=$!
 echo "Monitoring logs for 60 seconds..."
 sleep 60
 
-# Check for post_upgrade_done file
-echo "Checking for post_upgrade_done file..."
-run_ssh "ls -la /etc/sonic/post_upgrade_done 2>/dev/null || echo 'Post upgrade done file not found'"
+# Check the upgrade state journal
+echo "Checking upgrade state file..."
+run_ssh "cat /etc/sonic/upgrade_agent_state.json 2>/dev/null || echo 'Upgrade state file not found'"
 
 # Cleanup
 echo "Cleaning up..."
@@ -294,7 +294,7 @@ START_TIME=$(date +%s)
 
 # Success indicator phrases to look for in logs
 COMPLETE_INDICATORS=(
-  "Firmware update to version ${NEW_VERSION} completed successfully"
+  "Firmware update completed.*target_version=${NEW_VERSION}"
   "System reboot completed successfully"
   "System stabilization period complete"
   "OS version after update"
@@ -309,7 +309,7 @@ check_upgrade_complete() {
     server_logs=$(run_ssh "docker logs ${SERVER_CONTAINER_NAME} 2>&1" 2>/dev/null || echo "")
 
     # Check if the reboot command was initiated
-    if echo "$server_logs" | grep -q "Initiating host reboot via nsenter"; then
+    if echo "$server_logs" | grep -q "Rebooting the host, the reboot command runs next"; then
       echo "Reboot command initiated, waiting for system to reboot..."
 
       # Use ping to check if the system goes down (reboot starts)
@@ -587,19 +587,19 @@ if [[ "$FAKE_REBOOT" == "false" || "$REBOOT_DETECTED" == "true" ]]; then
   run_ssh "uptime -s" || echo "Could not check system uptime"
   echo ""
 
-  # Check upgrade state file to see if it was created and cleared properly
-  echo "Checking post upgrade done file status:"
-  run_ssh "sudo ls -la /etc/sonic/post_upgrade_done 2>/dev/null || echo 'Post upgrade done file not found'"
+  # Check upgrade state file to see which phase the upgrade reached
+  echo "Checking upgrade state file:"
+  run_ssh "sudo cat /etc/sonic/upgrade_agent_state.json 2>/dev/null || echo 'Upgrade state file not found'"
   echo ""
 
   # Check agent logs for post-reboot verification
   echo "Checking agent logs for post-reboot verification:"
-  run_ssh "docker logs ${CONTAINER_NAME} 2>&1 | grep -E 'post-reboot|upgrade in progress|post_upgrade_done|version after'" || echo "No post-reboot verification found in logs"
+  run_ssh "docker logs ${CONTAINER_NAME} 2>&1 | grep -E 'post-reboot|upgrade state|phase=|version after'" || echo "No post-reboot verification found in logs"
   echo ""
 
   # Check if the upgrade was completed
   echo "Checking final upgrade status:"
-  run_ssh "docker logs ${CONTAINER_NAME} 2>&1 | grep -E 'Upgrade to version .* completed successfully'" || echo "No upgrade completion message found"
+  run_ssh "docker logs ${CONTAINER_NAME} 2>&1 | grep -E 'Upgrade completed successfully'" || echo "No upgrade completion message found"
   echo ""
 
   echo "You can manually connect to the system with:"